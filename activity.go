@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Activity feed:
+ *   1. File services record an event for each change they make, see recordActivity
+ *   2. GetActivity reads the events of a folder subtree, newest first
+ *   3. Events the user cannot read are dropped, consecutive similar ones are grouped
+ */
+
+const (
+	activityCollection = "activity"
+	// Similar events further apart are not grouped
+	activityGroupWindow = 10 * time.Minute
+)
+
+const (
+	ActivityUpload    = "upload"
+	ActivityUpdate    = "update"
+	ActivityNewFolder = "new_folder"
+	ActivityRemove    = "remove"
+	ActivityCopy      = "copy"
+	ActivityMove      = "move"
+)
+
+// ActivityEvent is also what /events streams send, as JSON
+type ActivityEvent struct {
+	Id     bson.ObjectId `bson:"_id" json:"-"`
+	Time   int64         `bson:"time" json:"time"`
+	Actor  string        `bson:"actor" json:"actor"`
+	Action string        `bson:"action" json:"action"`
+	// Folder holding the items, before they are moved or copied
+	Folder      string   `bson:"folder" json:"folder"`
+	Items       []string `bson:"items" json:"items"`
+	Destination string   `bson:"destination,omitempty" json:"destination,omitempty"`
+}
+
+// Activity is made of consecutive similar events, e.g. files uploaded one after the other to the same folder
+type Activity struct {
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Folder string `json:"folder"`
+	// Names of the files or folders, without duplicates
+	Items []string `json:"items"`
+	// Folder the items were copied or moved to
+	Destination string `json:"destination,omitempty"`
+	// Unix times of the first and last events
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Number of events grouped
+	Count int `json:"count"`
+}
+
+type ActivityFeed struct {
+	Activities []Activity `json:"activities"`
+	// Events were left unread, older changes may be listed with before
+	Truncated bool `json:"truncated"`
+}
+
+func ensureActivityIndexes() {
+	if err := db.C(activityCollection).EnsureIndex(mgo.Index{Key: []string{"folder", "-time"}}); err != nil {
+		log.Printf("Cannot index the activity: %s\n", err)
+	}
+}
+
+func newActivityEvent(u *User, action, folder string, items []string, destination string) *ActivityEvent {
+	return &ActivityEvent{
+		Id:          bson.NewObjectId(),
+		Time:        time.Now().Unix(),
+		Actor:       u.Email,
+		Action:      action,
+		Folder:      folder,
+		Items:       items,
+		Destination: destination,
+	}
+}
+
+// recordActivity adds the event to the feed, sends it to the /events streams and queues it for webhooks
+func (m *Miogo) recordActivity(u *User, action, folder string, items []string, destination string) {
+	e := newActivityEvent(u, action, folder, items, destination)
+
+	if err := db.C(activityCollection).Insert(e); err != nil {
+		log.Printf("Cannot record the activity of %s: %s\n", u.Email, err)
+	}
+
+	m.events.Publish(e)
+	m.queueWebhooks(e)
+}
+
+// similar tells whether the event can join the activity, events being read newest first
+func (a *Activity) similar(e *ActivityEvent) bool {
+	return a.Actor == e.Actor && a.Action == e.Action && a.Folder == e.Folder && a.Destination == e.Destination &&
+		time.Duration(a.Start-e.Time)*time.Second <= activityGroupWindow
+}
+
+func (a *Activity) add(e *ActivityEvent) {
+	a.Start = e.Time
+	a.Count++
+
+	for _, item := range e.Items {
+		if !contains(a.Items, item) {
+			a.Items = append(a.Items, item)
+		}
+	}
+}
+
+// groupActivity merges events read newest first, up to limit activities
+func groupActivity(next func(*ActivityEvent) bool, limit int) []Activity {
+	activities := []Activity{}
+	var e ActivityEvent
+
+	for next(&e) {
+		if n := len(activities); n > 0 && activities[n-1].similar(&e) {
+			activities[n-1].add(&e)
+		} else if n == limit {
+			break
+		} else {
+			a := Activity{Actor: e.Actor, Action: e.Action, Folder: e.Folder, Destination: e.Destination, End: e.Time, Items: []string{}}
+			a.add(&e)
+			activities = append(activities, a)
+		}
+
+		e = ActivityEvent{}
+	}
+
+	return activities
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Events checked by GetActivity, older ones are read with before
+const activityScanLimit = 10000
+
+// visible drops the items and destination of the event which the user cannot read
+func (f *readFilter) visible(e *ActivityEvent) bool {
+	if _, ok := f.canRead(e.Folder, true); !ok {
+		return false
+	}
+
+	var items []string
+
+	for _, item := range e.Items {
+		path := strings.TrimSuffix(e.Folder, "/") + "/" + item
+
+		// Items which no longer exist are shown according to the rights of their folder
+		if exists, ok := f.canRead(path, false); exists && !ok {
+			continue
+		}
+
+		if exists, ok := f.canRead(path, true); exists && !ok {
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		return false
+	}
+
+	e.Items = items
+
+	if e.Destination != "" {
+		if _, ok := f.canRead(e.Destination, true); !ok {
+			e.Destination = ""
+		}
+	}
+
+	return true
+}
+
+func (m *Miogo) GetActivity(ctx *fasthttp.RequestCtx, u *User) error {
+	path := formatD(string(ctx.FormValue("path")))
+
+	if folder, ok := m.FetchFolder(path); !ok {
+		return errFolderMissing
+	} else if GetRightType(u, folder.Rights) < AllowedToRead {
+		return errAccessDenied
+	}
+
+	limit, _ := strconv.Atoi(string(ctx.FormValue("limit")))
+
+	if limit < 1 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	selector := bson.M{}
+
+	if or := subtree("folder", path); or != nil {
+		selector["$or"] = or
+	}
+
+	if v := string(ctx.FormValue("before")); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			return errWrongArgs.WithDetails("before", "Unix time expected")
+		}
+
+		selector["time"] = bson.M{"$lt": before}
+	}
+
+	iter := scanCapped(db.C(activityCollection).Find(selector).Sort("-time", "-_id"), activityScanLimit)
+	filter := newReadFilter(m, u)
+
+	activities := groupActivity(func(e *ActivityEvent) bool {
+		for iter.Next(e) {
+			if filter.visible(e) {
+				return true
+			}
+
+			*e = ActivityEvent{}
+		}
+
+		return false
+	}, limit)
+
+	if err := iter.Close(); err != nil {
+		return errFailure
+	}
+
+	res, _ := json.Marshal(ActivityFeed{activities, iter.truncated})
+
+	ctx.SetBody(res)
+	return nil
+}
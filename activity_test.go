@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupActivity(t *testing.T) {
+	events := []ActivityEvent{
+		{Time: 1000, Actor: "alice", Action: ActivityUpload, Folder: "/x", Items: []string{"c.txt"}},
+		{Time: 990, Actor: "alice", Action: ActivityUpload, Folder: "/x", Items: []string{"a.txt", "b.txt"}},
+		{Time: 980, Actor: "alice", Action: ActivityUpload, Folder: "/x", Items: []string{"a.txt"}},
+		{Time: 970, Actor: "bob", Action: ActivityMove, Folder: "/x", Items: []string{"report.pdf"}, Destination: "/y"},
+		{Time: 960, Actor: "bob", Action: ActivityMove, Folder: "/x", Items: []string{"other.pdf"}, Destination: "/z"},
+		// Too old to be grouped with the previous one
+		{Time: 100, Actor: "bob", Action: ActivityMove, Folder: "/x", Items: []string{"old.pdf"}, Destination: "/z"},
+	}
+
+	iterate := func() func(*ActivityEvent) bool {
+		i := 0
+
+		return func(e *ActivityEvent) bool {
+			if i == len(events) {
+				return false
+			}
+
+			*e = events[i]
+			i++
+
+			return true
+		}
+	}
+
+	expected := []Activity{
+		{Actor: "alice", Action: ActivityUpload, Folder: "/x", Items: []string{"c.txt", "a.txt", "b.txt"}, Start: 980, End: 1000, Count: 3},
+		{Actor: "bob", Action: ActivityMove, Folder: "/x", Items: []string{"report.pdf"}, Destination: "/y", Start: 970, End: 970, Count: 1},
+		{Actor: "bob", Action: ActivityMove, Folder: "/x", Items: []string{"other.pdf"}, Destination: "/z", Start: 960, End: 960, Count: 1},
+		{Actor: "bob", Action: ActivityMove, Folder: "/x", Items: []string{"old.pdf"}, Destination: "/z", Start: 100, End: 100, Count: 1},
+	}
+
+	if got := groupActivity(iterate(), 10); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+
+	if got := groupActivity(iterate(), 2); !reflect.DeepEqual(got, expected[:2]) {
+		t.Errorf("Limit not applied: %+v", got)
+	}
+}
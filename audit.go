@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Calls of services with the Audited option are recorded in an append-only collection, see GetAuditLog
+
+const auditCollection = "audit"
+
+type AuditEntry struct {
+	Id bson.ObjectId `bson:"_id" json:"id"`
+	// Unix time
+	Time int64 `bson:"time" json:"time"`
+	// Email of the logged in user, or the one given to services reachable without login
+	Actor   string `bson:"actor" json:"actor"`
+	IP      string `bson:"ip" json:"ip"`
+	Service string `bson:"service" json:"service"`
+	// File or folder the service acted on
+	Path string `bson:"path,omitempty" json:"path,omitempty"`
+	// Other arguments telling what was changed, passwords and tokens are never recorded
+	Arguments    map[string]string `bson:"arguments,omitempty" json:"arguments,omitempty"`
+	RightsBefore *Right            `bson:"rights_before,omitempty" json:"rights_before,omitempty"`
+	RightsAfter  *Right            `bson:"rights_after,omitempty" json:"rights_after,omitempty"`
+	// "success" or the code of the error
+	Outcome   string `bson:"outcome" json:"outcome"`
+	Status    int    `bson:"status" json:"status"`
+	RequestID string `bson:"request_id,omitempty" json:"request_id,omitempty"`
+}
+
+var auditedArguments = []string{"destination", "destFilename", "rights", "user", "group", "all", "subgroup", "name", "new_name", "email", "url", "prefix", "events", "id", "tags"}
+
+func ensureAuditIndexes() {
+	for _, key := range [][]string{{"-time"}, {"actor", "-time"}, {"path", "-time"}} {
+		if err := db.C(auditCollection).EnsureIndex(mgo.Index{Key: key}); err != nil {
+			log.Printf("Cannot index the audit log: %s\n", err)
+		}
+	}
+}
+
+func auditEntry(ctx *fasthttp.RequestCtx) *AuditEntry {
+	e, _ := ctx.UserValue(auditKey).(*AuditEntry)
+	return e
+}
+
+// auditRights records the rights of the resource changed by the request
+func auditRights(ctx *fasthttp.RequestCtx, before, after *Right) {
+	if e := auditEntry(ctx); e != nil {
+		e.RightsBefore, e.RightsAfter = before, after
+	}
+}
+
+// complete fills the entry once the service has run, arguments being parsed by then
+func (e *AuditEntry) complete(ctx *fasthttp.RequestCtx, err error) {
+	if u := CurrentUser(ctx); u != nil {
+		e.Actor = u.Email
+	} else {
+		e.Actor = strings.TrimSpace(string(ctx.FormValue("email")))
+	}
+
+	for _, name := range []string{"path", "resource"} {
+		if hasArg(ctx, name) {
+			e.Path = formatD(string(ctx.FormValue(name)))
+		}
+	}
+
+	args := make(map[string]string)
+
+	for _, name := range auditedArguments {
+		if v := string(ctx.FormValue(name)); hasArg(ctx, name) && !(name == "email" && v == e.Actor) {
+			args[name] = v
+		}
+	}
+
+	if form, ferr := ctx.MultipartForm(); ferr == nil && len(form.File["file"]) > 0 {
+		var names []string
+
+		for _, f := range form.File["file"] {
+			names = append(names, f.Filename)
+		}
+
+		args["files"] = strings.Join(names, ",")
+	}
+
+	if len(args) > 0 {
+		e.Arguments = args
+	}
+
+	e.setOutcome(ctx, err)
+}
+
+func (e *AuditEntry) setOutcome(ctx *fasthttp.RequestCtx, err error) {
+	switch ae := err.(type) {
+	case nil:
+		e.Outcome, e.Status = "success", ctx.Response.StatusCode()
+	case *Error:
+		e.Outcome, e.Status = ae.Code, ae.Status
+	default:
+		e.Outcome, e.Status = errFailure.Code, errFailure.Status
+	}
+}
+
+func (m *Miogo) audit(s *Service) Middleware {
+	return func(next Handler) Handler {
+		if s.Options&Audited == 0 {
+			return next
+		}
+
+		return func(ctx *fasthttp.RequestCtx) error {
+			e := m.newAuditEntry(ctx, s.Name)
+			ctx.SetUserValue(auditKey, e)
+			err := next(ctx)
+			e.complete(ctx, err)
+			writeAudit(e)
+
+			return err
+		}
+	}
+}
+
+// newAuditEntry starts the entry of a request, handlers not registered as services fill it themselves
+func (m *Miogo) newAuditEntry(ctx *fasthttp.RequestCtx, service string) *AuditEntry {
+	return &AuditEntry{
+		Id:        bson.NewObjectId(),
+		Time:      time.Now().Unix(),
+		IP:        m.clientIP(ctx),
+		Service:   service,
+		RequestID: RequestID(ctx),
+	}
+}
+
+// writeAudit must not prevent the request from being answered, failures are only logged
+func writeAudit(e *AuditEntry) {
+	if err := db.C(auditCollection).Insert(e); err != nil {
+		log.Printf("Cannot write the audit log of %s by %s: %s\n", e.Service, e.Actor, err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+}
+
+var auditCSVHeader = []string{"time", "actor", "ip", "service", "path", "arguments", "rights_before", "rights_after", "outcome", "status", "request_id"}
+
+// auditSelector builds the query from the filters given as arguments
+func auditSelector(ctx *fasthttp.RequestCtx) (bson.M, error) {
+	selector := bson.M{}
+
+	for _, name := range []string{"actor", "service"} {
+		if v := strings.TrimSpace(string(ctx.FormValue(name))); v != "" {
+			selector[name] = v
+		}
+	}
+
+	// A folder selects everything below it
+	if hasArg(ctx, "path") {
+		if or := subtree("path", formatD(string(ctx.FormValue("path")))); or != nil {
+			selector["$or"] = or
+		}
+	}
+
+	switch outcome := string(ctx.FormValue("outcome")); outcome {
+	case "":
+	case "failure":
+		selector["outcome"] = bson.M{"$ne": "success"}
+	default:
+		selector["outcome"] = outcome
+	}
+
+	period := bson.M{}
+
+	for name, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		if v := string(ctx.FormValue(name)); v != "" {
+			t, err := strconv.ParseInt(v, 10, 64)
+
+			if err != nil {
+				return nil, errWrongArgs.WithDetails(name, "Unix time expected")
+			}
+
+			period[op] = t
+		}
+	}
+
+	if len(period) > 0 {
+		selector["time"] = period
+	}
+
+	return selector, nil
+}
+
+// GetAuditLog lists audit entries, newest first, or exports all of them as CSV
+func (m *Miogo) GetAuditLog(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
+	selector, err := auditSelector(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	query := db.C(auditCollection).Find(selector).Sort("-time", "-_id")
+
+	switch string(ctx.FormValue("format")) {
+	case "", "json":
+	case "csv":
+		return exportAuditLog(ctx, query.Iter())
+	default:
+		return errWrongArgs.WithDetails("format", "json or csv")
+	}
+
+	page, perPage := pagination(ctx)
+	total, err := query.Count()
+
+	if err != nil {
+		return errFailure
+	}
+
+	entries := []AuditEntry{}
+
+	if err := query.Skip((page - 1) * perPage).Limit(perPage).All(&entries); err != nil {
+		return errFailure
+	}
+
+	res, _ := json.Marshal(AuditPage{entries, total, page, perPage})
+
+	ctx.SetBody(res)
+	return nil
+}
+
+func exportAuditLog(ctx *fasthttp.RequestCtx, iter *mgo.Iter) error {
+	ctx.SetContentType("text/csv; charset=utf-8")
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="audit.csv"`)
+
+	w := csv.NewWriter(ctx.Response.BodyWriter())
+	w.Write(auditCSVHeader)
+
+	var e AuditEntry
+
+	for iter.Next(&e) {
+		w.Write(e.record())
+		e = AuditEntry{}
+	}
+
+	w.Flush()
+
+	if err := iter.Close(); err != nil {
+		return errFailure
+	}
+
+	return w.Error()
+}
+
+func (e *AuditEntry) record() []string {
+	var args []string
+
+	for k, v := range e.Arguments {
+		args = append(args, k+"="+v)
+	}
+
+	sort.Strings(args)
+
+	rights := func(r *Right) string {
+		if r == nil {
+			return ""
+		}
+
+		b, _ := json.Marshal(r)
+		return string(b)
+	}
+
+	record := []string{
+		time.Unix(e.Time, 0).UTC().Format(time.RFC3339), e.Actor, e.IP, e.Service, e.Path,
+		strings.Join(args, "&"), rights(e.RightsBefore), rights(e.RightsAfter),
+		e.Outcome, strconv.Itoa(e.Status), e.RequestID,
+	}
+
+	for i := range record {
+		record[i] = csvCell(record[i])
+	}
+
+	return record
+}
+
+// csvCell keeps spreadsheets from running user values as formulas, e.g. the email of a failed login
+func csvCell(s string) string {
+	if s != "" && strings.IndexByte("=+-@\t\r", s[0]) >= 0 {
+		return "'" + s
+	}
+
+	return s
+}
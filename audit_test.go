@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAuditEntryComplete(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetContentType("application/x-www-form-urlencoded")
+	ctx.Request.SetBodyString("path=/a/b/&destination=/c&password=secret&email=admin@miogo.tld")
+	ctx.SetUserValue(userKey, &User{Email: "admin@miogo.tld"})
+
+	e := &AuditEntry{}
+	e.complete(&ctx, errFolderMissing)
+
+	expected := &AuditEntry{
+		Actor:     "admin@miogo.tld",
+		Path:      "/a/b",
+		Arguments: map[string]string{"destination": "/c"},
+		Outcome:   "folder_not_found",
+		Status:    fasthttp.StatusNotFound,
+	}
+
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, e)
+	}
+
+	// Without login, the actor is the email given
+	ctx.SetUserValue(userKey, nil)
+	e = &AuditEntry{}
+	e.complete(&ctx, nil)
+
+	if e.Actor != "admin@miogo.tld" || e.Outcome != "success" || e.Status != 200 {
+		t.Errorf("Wrong entry %+v", e)
+	}
+}
+
+func TestAuditRecord(t *testing.T) {
+	e := AuditEntry{
+		Time:        0,
+		Actor:       "admin@miogo.tld",
+		Service:     "SetResourceRights",
+		Path:        "/a",
+		Arguments:   map[string]string{"user": "u@miogo.tld", "rights": "r"},
+		RightsAfter: &Right{All: "r"},
+		Outcome:     "success",
+		Status:      200,
+	}
+
+	expected := []string{"1970-01-01T00:00:00Z", "admin@miogo.tld", "", "SetResourceRights", "/a", "rights=r&user=u@miogo.tld", "", `{"all":"r"}`, "success", "200", ""}
+
+	if got := e.record(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	if len(expected) != len(auditCSVHeader) {
+		t.Error("Records and header differ")
+	}
+
+	// Values starting like formulas are quoted
+	e = AuditEntry{Actor: "=HYPERLINK(\"http://evil.tld\")", Path: "@SUM(A1)", Arguments: map[string]string{"email": "-1"}}
+	got := e.record()
+
+	if got[1] != `'=HYPERLINK("http://evil.tld")` || got[4] != "'@SUM(A1)" || got[5] != "email=-1" {
+		t.Errorf("Formulas not escaped: %q", got)
+	}
+
+	if csvCell("\tcmd") != "'\tcmd" || csvCell("+1") != "'+1" || csvCell("a=b") != "a=b" {
+		t.Error("Wrong cell escaping")
+	}
+}
+
+func TestAuditSelector(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/?actor=a@miogo.tld&path=/x/&outcome=failure&from=10")
+
+	selector, err := auditSelector(&ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bson.M{
+		"actor":   "a@miogo.tld",
+		"$or":     []bson.M{{"path": "/x"}, {"path": bson.RegEx{Pattern: "^/x/"}}},
+		"outcome": bson.M{"$ne": "success"},
+		"time":    bson.M{"$gte": int64(10)},
+	}
+
+	if !reflect.DeepEqual(selector, expected) {
+		t.Errorf("Expected %v, got %v", expected, selector)
+	}
+
+	ctx.Request.SetRequestURI("/?to=yesterday")
+
+	if _, err := auditSelector(&ctx); err == nil {
+		t.Error("Wrong time accepted")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errUnknownUser   = NewError(fasthttp.StatusNotFound, "user_not_found", "User does not exist")
+	errWrongPassword = NewError(fasthttp.StatusUnauthorized, "wrong_password", "Wrong password")
+)
+
+// An AuthProvider checks credentials given to Login and returns the matching user.
+// It must return errUnknownUser when it does not know the user so that the next
+// provider can be tried.
+type AuthProvider interface {
+	Authenticate(email, password string) (*User, error)
+}
+
+func (m *Miogo) RegisterAuthProvider(p AuthProvider) {
+	m.authProviders = append(m.authProviders, p)
+}
+
+// Providers are tried in registration order, the first one accepting the credentials wins
+func (m *Miogo) authenticate(email, password string) (*User, error) {
+	var err error = errUnknownUser
+
+	for _, p := range m.authProviders {
+		usr, perr := p.Authenticate(email, password)
+
+		if perr == nil {
+			return usr, nil
+		}
+
+		// Report the most relevant failure: a known user beats an unknown one
+		if perr != errUnknownUser {
+			err = perr
+		}
+	}
+
+	return nil, err
+}
+
+// localAuth checks bcrypt passwords stored in the users collection
+type localAuth struct {
+	m *Miogo
+}
+
+func (l *localAuth) Authenticate(email, password string) (*User, error) {
+	usr, ok := l.m.FetchUser(email)
+
+	// Users provisioned by another provider have no local password
+	if !ok || usr.Password == "" {
+		return nil, errUnknownUser
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(usr.Password), []byte(password)); err != nil {
+		return nil, errWrongPassword
+	}
+
+	return usr, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Cross-instance cache invalidation:
+ *   1. Every invalidation of a cache is published on a bus with the node ID
+ *   2. Every node receives it and applies it to its cache of the same name
+ *   3. A node ignores its own invalidations, they are already applied
+ */
+
+const (
+	invalidateKeys    = "keys"
+	invalidatePrefix  = "prefix"
+	invalidateMatcher = "matcher"
+)
+
+type Invalidation struct {
+	Id      bson.ObjectId `bson:"_id,omitempty"`
+	Node    string        `bson:"node"`
+	Cache   string        `bson:"cache"`
+	Op      string        `bson:"op"`
+	Keys    []string      `bson:"keys,omitempty"`
+	Matcher string        `bson:"matcher,omitempty"`
+	Arg     string        `bson:"arg,omitempty"`
+}
+
+type InvalidationBus interface {
+	Publish(inv Invalidation) error
+	// Subscribe registers a function receiving every invalidation, including the ones published by the node
+	Subscribe(f func(Invalidation))
+	Close()
+}
+
+type ClusterConfig struct {
+	// "mongo" (default) or "none" for a single instance
+	Bus string
+	// Size of the capped collections used by the MongoDB bus and the events, in megabytes
+	BusSize int
+}
+
+// connectCaches attaches caches to the bus and applies invalidations coming from other nodes
+func connectCaches(bus InvalidationBus, node string, caches map[string]*Cache) {
+	for name, c := range caches {
+		c.Attach(name, bus, node)
+	}
+
+	bus.Subscribe(func(inv Invalidation) {
+		if inv.Node == node {
+			return
+		}
+
+		// Invalidations cannot be lost without serving stale data, flush everything when in doubt
+		if inv.Op == "" {
+			for _, c := range caches {
+				c.invalidatePrefix("")
+			}
+
+			return
+		}
+
+		if c, ok := caches[inv.Cache]; ok {
+			c.Apply(inv)
+		}
+	})
+}
+
+// LocalBus delivers invalidations within the process, it is meant for tests
+type LocalBus struct {
+	sync.Mutex
+	subscribers []func(Invalidation)
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (b *LocalBus) Publish(inv Invalidation) error {
+	b.Lock()
+	subscribers := b.subscribers
+	b.Unlock()
+
+	for _, f := range subscribers {
+		f(inv)
+	}
+
+	return nil
+}
+
+func (b *LocalBus) Subscribe(f func(Invalidation)) {
+	b.Lock()
+	b.subscribers = append(b.subscribers, f)
+	b.Unlock()
+}
+
+func (b *LocalBus) Close() {}
+
+// MongoBus relies on a capped collection read with a tailable cursor
+type MongoBus struct {
+	sync.Mutex
+	capped      *cappedCollection
+	subscribers []func(Invalidation)
+}
+
+const (
+	defaultBusSize    = 16
+	busTailTimeout    = 5 * time.Second
+	busRetryInterval  = time.Second
+	busCollectionName = "invalidations"
+)
+
+func NewMongoBus(database *mgo.Database, size int) (*MongoBus, error) {
+	c, err := openCapped(database, busCollectionName, size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := &MongoBus{capped: c}
+
+	go c.tail(func(raw bson.Raw) {
+		var inv Invalidation
+
+		if err := raw.Unmarshal(&inv); err == nil {
+			b.deliver(inv)
+		}
+	}, func() {
+		logInfo("Invalidation bus lagged behind, flushing caches\n")
+		b.deliver(Invalidation{})
+	})
+
+	return b, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *MongoBus) Publish(inv Invalidation) error {
+	inv.Id = bson.NewObjectId()
+	return b.capped.insert(&inv)
+}
+
+func (b *MongoBus) Subscribe(f func(Invalidation)) {
+	b.Lock()
+	b.subscribers = append(b.subscribers, f)
+	b.Unlock()
+}
+
+func (b *MongoBus) deliver(inv Invalidation) {
+	b.Lock()
+	subscribers := b.subscribers
+	b.Unlock()
+
+	for _, f := range subscribers {
+		f(inv)
+	}
+}
+
+func (b *MongoBus) Close() {
+	b.capped.close()
+}
+
+// cappedCollection delivers the documents inserted by every node, in insertion order
+type cappedCollection struct {
+	session *mgo.Session
+	name    string
+	// Last document inserted before opening, only the following ones are delivered
+	last bson.ObjectId
+	stop chan struct{}
+	done chan struct{}
+}
+
+type cappedId struct {
+	Id bson.ObjectId `bson:"_id"`
+}
+
+// openCapped creates the collection if needed, size being in megabytes
+func openCapped(database *mgo.Database, name string, size int) (*cappedCollection, error) {
+	if size <= 0 {
+		size = defaultBusSize
+	}
+
+	err := database.C(name).Create(&mgo.CollectionInfo{Capped: true, MaxBytes: size << 20})
+
+	if err != nil {
+		if names, lerr := database.CollectionNames(); lerr != nil || !contains(names, name) {
+			return nil, err
+		}
+	}
+
+	c := &cappedCollection{
+		session: database.Session.Copy(),
+		name:    name,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	var last cappedId
+	c.c().Find(nil).Sort("-$natural").Select(bson.M{"_id": 1}).One(&last)
+	c.last = last.Id
+
+	return c, nil
+}
+
+func (c *cappedCollection) c() *mgo.Collection {
+	return c.session.DB(db.Name).C(c.name)
+}
+
+// insert expects documents with an ID
+func (c *cappedCollection) insert(doc interface{}) error {
+	s := c.session.Copy()
+	defer s.Close()
+
+	return s.DB(db.Name).C(c.name).Insert(doc)
+}
+
+// tail reads the collection in natural order, skipping documents up to the last one already seen.
+// IDs are not compared because they are generated by different nodes with different clocks.
+// lagged is called when the last seen document has been overwritten, some documents may have been missed.
+func (c *cappedCollection) tail(deliver func(bson.Raw), lagged func()) {
+	defer close(c.done)
+
+	last := c.last
+
+	for {
+		iter := c.c().Find(nil).Sort("$natural").Tail(busTailTimeout)
+		skipping := last != ""
+
+		for {
+			var raw bson.Raw
+
+			if iter.Next(&raw) {
+				var doc cappedId
+				raw.Unmarshal(&doc)
+
+				if skipping {
+					skipping = doc.Id != last
+					continue
+				}
+
+				last = doc.Id
+				deliver(raw)
+				continue
+			}
+
+			if iter.Err() != nil {
+				break
+			}
+
+			if iter.Timeout() {
+				if skipping {
+					lagged()
+					skipping = false
+				}
+
+				select {
+				case <-c.stop:
+					iter.Close()
+					return
+				default:
+				}
+
+				continue
+			}
+
+			break
+		}
+
+		if err := iter.Close(); err != nil {
+			log.Printf("Cursor on %s failed: %s\n", c.name, err)
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(busRetryInterval):
+			c.session.Refresh()
+		}
+	}
+}
+
+func (c *cappedCollection) close() {
+	close(c.stop)
+	<-c.done
+	c.session.Close()
+}
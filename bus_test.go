@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func newNode(bus InvalidationBus, node string) map[string]*Cache {
+	caches := map[string]*Cache{"users": NewCache(0), "sessions": NewCache(0)}
+	caches["sessions"].RegisterMatcher("user", sessionsOfUser)
+	connectCaches(bus, node, caches)
+
+	return caches
+}
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+	a, b := newNode(bus, "a"), newNode(bus, "b")
+
+	for _, n := range []map[string]*Cache{a, b} {
+		n["users"].Set("alice", 1)
+		n["users"].Set("bob", 2)
+		n["users"].Set("prefix:1", 3)
+		n["sessions"].Set("s1", &User{Email: "alice"})
+		n["sessions"].Set("s2", &User{Email: "bob"})
+	}
+
+	a["users"].Invalidate("alice")
+
+	if _, ok := b["users"].Get("alice"); ok {
+		t.Error("Key invalidation was not propagated")
+	}
+
+	if _, ok := b["users"].Get("bob"); !ok {
+		t.Error("Unrelated key was invalidated")
+	}
+
+	b["users"].InvalidateStartWith("prefix:")
+
+	if _, ok := a["users"].Get("prefix:1"); ok {
+		t.Error("Prefix invalidation was not propagated")
+	}
+
+	a["sessions"].InvalidateMatching("user", "bob")
+
+	if _, ok := b["sessions"].Get("s2"); ok {
+		t.Error("Matcher invalidation was not propagated")
+	}
+
+	if _, ok := b["sessions"].Get("s1"); !ok {
+		t.Error("Session of another user was invalidated")
+	}
+
+	// Lost invalidations flush every cache
+	bus.Publish(Invalidation{Node: "bus"})
+
+	if a["users"].Len()+a["sessions"].Len() != 0 {
+		t.Error("Caches were not flushed")
+	}
+}
+
+func TestMongoBus(t *testing.T) {
+	busA, err := NewMongoBus(db, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer busA.Close()
+
+	busB, err := NewMongoBus(db, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer busB.Close()
+
+	received := make(chan Invalidation, 1)
+	busB.Subscribe(func(inv Invalidation) {
+		if inv.Node == "a" {
+			received <- inv
+		}
+	})
+
+	busA.Publish(Invalidation{Node: "a", Cache: "users", Op: invalidateKeys, Keys: []string{"alice"}})
+
+	select {
+	case inv := <-received:
+		if inv.Cache != "users" || len(inv.Keys) != 1 || inv.Keys[0] != "alice" || !inv.Id.Valid() {
+			t.Errorf("Unexpected invalidation: %+v", inv)
+		}
+	case <-time.After(2 * busTailTimeout):
+		t.Error("Invalidation was not received")
+	}
+
+	var count int
+
+	if count, err = db.C(busCollectionName).Find(bson.M{"node": "a"}).Count(); err != nil || count == 0 {
+		t.Errorf("Expected stored invalidations, got %d (%v)", count, err)
+	}
+}
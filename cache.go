@@ -1,7 +1,10 @@
 package main
 
 import (
-	"runtime"
+	"container/list"
+	"log"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 )
@@ -9,114 +12,477 @@ import (
 // Some parts are inspired by:
 // github.com/patrickmn/go-cache
 
+// Cache is a thread-safe LRU cache.
+// When a memory limit is set, least recently used entries are evicted as soon as it is exceeded.
+// Entries can expire, expired entries are removed on access and by a janitor started on first use.
+
 type (
 	entry struct {
-		size  int
-		use   int
-		value interface{}
+		key        string
+		value      interface{}
+		size       int64
+		expiration int64
 	}
 
+	// A Matcher selects entries to invalidate given an argument.
+	// Matchers are registered by name so that they can be used on every node.
+	Matcher func(arg string, key string, val interface{}) bool
+
 	Cache struct {
 		sync.Mutex
-		Stop          chan bool
-		StorageLength int64
-		MemoryLimit   int64
-		Entries       map[string]entry
+		name        string
+		bus         InvalidationBus
+		node        string
+		matchers    map[string]Matcher
+		memoryLimit int64
+		size        int64
+		entries     map[string]*list.Element
+		loads       map[string]*load
+		lru         *list.List
+		stop        chan struct{}
+		closed      bool
+		hits        uint64
+		misses      uint64
+		evictions   uint64
+	}
+
+	// A load is a pending fetch shared by concurrent misses on the same key
+	load struct {
+		done  chan struct{}
+		value interface{}
+		err   error
+	}
+
+	CacheStats struct {
+		Hits      uint64
+		Misses    uint64
+		Evictions uint64
+		Entries   int
+		Size      int64
 	}
 )
 
+const janitorInterval = time.Minute
+
 func NewCache(ml int64) *Cache {
 	if ml <= 0 {
 		ml = -1
 	}
 
-	ret := &Cache{MemoryLimit: ml, Entries: make(map[string]entry)}
+	return &Cache{
+		memoryLimit: ml,
+		matchers:    make(map[string]Matcher),
+		entries:     make(map[string]*list.Element),
+		loads:       make(map[string]*load),
+		lru:         list.New(),
+	}
+}
+
+// Attach makes invalidations of the cache propagate to caches with the same name on other nodes
+func (c *Cache) Attach(name string, bus InvalidationBus, node string) {
+	c.Lock()
+	c.name, c.bus, c.node = name, bus, node
+	c.Unlock()
+}
+
+func (c *Cache) RegisterMatcher(name string, f Matcher) {
+	c.Lock()
+	c.matchers[name] = f
+	c.Unlock()
+}
+
+func (c *Cache) publish(inv Invalidation) {
+	c.Lock()
+	bus := c.bus
+	inv.Node, inv.Cache = c.node, c.name
+	c.Unlock()
+
+	if bus != nil {
+		if err := bus.Publish(inv); err != nil {
+			log.Printf("Cannot publish invalidation of cache %s: %s\n", inv.Cache, err)
+		}
+	}
+}
 
-	if ml > 0 {
-		go ret.keepConstrained()
-		runtime.SetFinalizer(ret, func() { ret.Stop <- true })
+// Apply performs an invalidation received from another node
+func (c *Cache) Apply(inv Invalidation) {
+	switch inv.Op {
+	case invalidateKeys:
+		c.invalidateKeys(inv.Keys)
+	case invalidatePrefix:
+		c.invalidatePrefix(inv.Arg)
+	case invalidateMatcher:
+		c.invalidateMatcher(inv.Matcher, inv.Arg)
 	}
+}
 
-	return ret
+func (e *entry) expired(now int64) bool {
+	return e.expiration > 0 && e.expiration < now
 }
 
 func (c *Cache) Get(key string) (interface{}, bool) {
-	var ret interface{} = nil
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+
+	if e.expired(time.Now().UnixNano()) {
+		c.remove(el)
+		c.evictions++
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.hits++
+
+	return e.value, true
+}
+
+// GetOrLoad returns the cached value or calls f to fetch it.
+// Concurrent misses on the same key wait for a single call of f.
+// Nil values and values loaded while the key was being invalidated are returned but not cached.
+func (c *Cache) GetOrLoad(key string, f func() (interface{}, error)) (interface{}, error) {
+	if val, ok := c.Get(key); ok {
+		return val, nil
+	}
 
 	c.Lock()
 
-	val, ok := c.Entries[key]
+	if l, ok := c.loads[key]; ok {
+		c.Unlock()
+		<-l.done
 
-	if ok {
-		val.use++
-		c.Entries[key] = val
-		ret = val.value
+		return l.value, l.err
 	}
 
+	l := &load{done: make(chan struct{})}
+	c.loads[key] = l
 	c.Unlock()
 
-	return ret, ok
+	defer func() {
+		c.Lock()
+
+		if c.loads[key] == l {
+			delete(c.loads, key)
+		}
+
+		c.Unlock()
+		close(l.done)
+	}()
+
+	l.value, l.err = f()
+
+	if l.err == nil && l.value != nil {
+		e := newEntry(key, l.value, 0)
+
+		c.Lock()
+
+		if c.loads[key] == l {
+			c.insert(e, 0)
+		}
+
+		c.Unlock()
+	}
+
+	return l.value, l.err
 }
 
 func (c *Cache) Set(key string, val interface{}) {
-	e := entry{size: 0, use: 0, value: val}
+	c.SetWithTTL(key, val, 0)
+}
 
-	if _, areBytes := val.([]byte); areBytes {
-		e.size = len(val.([]byte))
-		c.StorageLength += int64(e.size)
-	}
+// SetWithTTL stores an entry which expires after ttl, a zero ttl means it never expires
+func (c *Cache) SetWithTTL(key string, val interface{}, ttl time.Duration) {
+	e := newEntry(key, val, ttl)
 
 	c.Lock()
-	c.Entries[key] = e
+	c.insert(e, ttl)
 	c.Unlock()
 }
 
+func newEntry(key string, val interface{}, ttl time.Duration) *entry {
+	e := &entry{key: key, value: val, size: int64(len(key)) + sizeOf(val)}
+
+	if ttl > 0 {
+		e.expiration = time.Now().Add(ttl).UnixNano()
+	}
+
+	return e
+}
+
+// insert must be called with the lock held
+func (c *Cache) insert(e *entry, ttl time.Duration) {
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+
+	// Do not flush the whole cache for an entry which cannot fit anyway
+	if c.memoryLimit > 0 && e.size > c.memoryLimit {
+		return
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+
+	if ttl > 0 && c.stop == nil && !c.closed {
+		c.stop = make(chan struct{})
+		go c.janitor(c.stop)
+	}
+
+	c.evict()
+}
+
 func (c *Cache) Invalidate(keys ...string) {
+	c.invalidateKeys(keys)
+	c.publish(Invalidation{Op: invalidateKeys, Keys: keys})
+}
+
+func (c *Cache) InvalidateStartWith(key string) {
+	c.invalidatePrefix(key)
+	c.publish(Invalidation{Op: invalidatePrefix, Arg: key})
+}
+
+// InvalidateMatching removes entries selected by the matcher registered under the given name
+func (c *Cache) InvalidateMatching(matcher, arg string) {
+	c.invalidateMatcher(matcher, arg)
+	c.publish(Invalidation{Op: invalidateMatcher, Matcher: matcher, Arg: arg})
+}
+
+func (c *Cache) invalidateKeys(keys []string) {
 	c.Lock()
 
 	for _, key := range keys {
-		delete(c.Entries, key)
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+
+		delete(c.loads, key)
 	}
 
 	c.Unlock()
 }
 
-func (c *Cache) InvalidateStartWith(key string) {
-	l := len(key)
+func (c *Cache) invalidatePrefix(prefix string) {
+	c.Lock()
+
+	for k, el := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			c.remove(el)
+		}
+	}
 
+	for k := range c.loads {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.loads, k)
+		}
+	}
+
+	c.Unlock()
+}
+
+func (c *Cache) invalidateMatcher(matcher, arg string) {
 	c.Lock()
 
-	for k, _ := range c.Entries {
-		if len(k) >= l {
-			if k[:l] == key {
-				delete(c.Entries, k)
+	if f, ok := c.matchers[matcher]; ok {
+		for k, el := range c.entries {
+			if f(arg, k, el.Value.(*entry).value) {
+				c.remove(el)
 			}
 		}
+
+		// Values being loaded are unknown yet, they might match
+		c.loads = make(map[string]*load)
+	} else {
+		log.Printf("Unknown matcher %s for cache %s\n", matcher, c.name)
+	}
+
+	c.Unlock()
+}
+
+// SetMemoryLimit changes the memory limit, evicting entries if needed
+func (c *Cache) SetMemoryLimit(ml int64) {
+	if ml <= 0 {
+		ml = -1
+	}
+
+	c.Lock()
+	c.memoryLimit = ml
+	c.evict()
+	c.Unlock()
+}
+
+// Len returns the number of entries
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
+
+// Size returns the estimated memory used by entries, in bytes
+func (c *Cache) Size() int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.size
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return CacheStats{c.hits, c.misses, c.evictions, c.lru.Len(), c.size}
+}
+
+// Close stops the janitor, the cache can still be used afterwards
+func (c *Cache) Close() {
+	c.Lock()
+
+	c.closed = true
+
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
 	}
 
 	c.Unlock()
 }
 
-func (c *Cache) keepConstrained() {
-	c.Stop = make(chan bool)
-	ticker := time.NewTicker(500 * time.Millisecond)
+// remove must be called with the lock held
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// evict must be called with the lock held
+func (c *Cache) evict() {
+	for c.memoryLimit > 0 && c.size > c.memoryLimit {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *Cache) janitor(stop chan struct{}) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			if c.StorageLength > c.MemoryLimit {
-				threshold := int(c.MemoryLimit / int64(len(c.Entries)))
-
-				for k, v := range c.Entries {
-					// TODO: improve this black magic
-					if (v.size*3)/(v.use+1) > threshold {
-						c.Invalidate(k)
-					}
+			now := time.Now().UnixNano()
+
+			c.Lock()
+
+			for _, el := range c.entries {
+				if el.Value.(*entry).expired(now) {
+					c.remove(el)
+					c.evictions++
 				}
 			}
-		case <-c.Stop:
-			ticker.Stop()
+
+			c.Unlock()
+		case <-stop:
 			return
 		}
 	}
 }
+
+// sizeOf estimates the memory retained by a value, including what it points to
+func sizeOf(val interface{}) int64 {
+	if val == nil {
+		return 0
+	}
+
+	v := reflect.ValueOf(val)
+
+	return int64(v.Type().Size()) + indirectSize(v, make(map[uintptr]bool))
+}
+
+// indirectSize returns the size of the memory referenced by v, not counting v itself
+func indirectSize(v reflect.Value, seen map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+
+		seen[v.Pointer()] = true
+
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+
+		seen[v.Pointer()] = true
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+
+		if hasPointers(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += indirectSize(v.Index(i), seen)
+			}
+		}
+
+		return size
+	case reflect.Array:
+		var size int64
+
+		if hasPointers(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += indirectSize(v.Index(i), seen)
+			}
+		}
+
+		return size
+	case reflect.Map:
+		if v.IsNil() {
+			return 0
+		}
+
+		var size int64
+		iter := v.MapRange()
+
+		for iter.Next() {
+			size += int64(iter.Key().Type().Size()) + indirectSize(iter.Key(), seen)
+			size += int64(iter.Value().Type().Size()) + indirectSize(iter.Value(), seen)
+		}
+
+		return size
+	case reflect.Struct:
+		var size int64
+
+		for i := 0; i < v.NumField(); i++ {
+			size += indirectSize(v.Field(i), seen)
+		}
+
+		return size
+	}
+
+	return 0
+}
+
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.String, reflect.Slice, reflect.Map, reflect.Struct, reflect.Array:
+		return true
+	}
+
+	return false
+}
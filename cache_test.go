@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestBasicCache(t *testing.T) {
 	c := NewCache(0)
@@ -104,3 +111,210 @@ func BenchmarkCacheGet(b *testing.B) {
 		c.Get("test")
 	}
 }
+
+func TestLRUEviction(t *testing.T) {
+	c := NewCache(300)
+
+	c.Set("a", make([]byte, 100))
+	c.Set("b", make([]byte, 100))
+
+	// "a" becomes the most recently used entry
+	c.Get("a")
+
+	c.Set("c", make([]byte, 100))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Least recently used entry has not been evicted")
+	}
+
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Recently used entry has been evicted")
+	}
+
+	if _, ok := c.Get("c"); !ok {
+		t.Error("New entry has been evicted")
+	}
+
+	c.Set("d", make([]byte, 1000))
+
+	if _, ok := c.Get("d"); ok {
+		t.Error("Entry bigger than the memory limit has been stored")
+	}
+
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+}
+
+func TestCacheAccounting(t *testing.T) {
+	c := NewCache(0)
+
+	c.Set("a", make([]byte, 100))
+	c.Set("b", "hello")
+	c.Set("c", &Folder{Path: "/test", Files: []File{{Name: "file"}}})
+
+	if c.Size() <= 100 {
+		t.Errorf("Sizes are not accounted for every value type: %d", c.Size())
+	}
+
+	c.Set("a", make([]byte, 10))
+	c.Invalidate("b")
+	c.InvalidateStartWith("c")
+	c.RegisterMatcher("key", func(arg, key string, _ interface{}) bool { return key == arg })
+	c.InvalidateMatching("key", "a")
+
+	if c.Size() != 0 || c.Len() != 0 {
+		t.Errorf("Size should be 0 after invalidation, got %d for %d entries", c.Size(), c.Len())
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := NewCache(0)
+	defer c.Close()
+
+	c.SetWithTTL("short", nil, time.Millisecond)
+	c.SetWithTTL("long", nil, time.Hour)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("short"); ok {
+		t.Error("Expired entry has been returned")
+	}
+
+	if _, ok := c.Get("long"); !ok {
+		t.Error("Entry expired too early")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := NewCache(150)
+
+	c.Set("a", make([]byte, 100))
+	c.Get("a")
+	c.Get("b")
+	c.Set("b", make([]byte, 100))
+
+	s := c.Stats()
+
+	if s.Hits != 1 || s.Misses != 1 || s.Evictions != 1 || s.Entries != 1 || s.Size != c.Size() {
+		t.Errorf("Wrong statistics: %+v", s)
+	}
+}
+
+func TestSizeOf(t *testing.T) {
+	if sizeOf(nil) != 0 {
+		t.Error("nil should have no size")
+	}
+
+	if s := sizeOf(make([]byte, 1000)); s < 1000 {
+		t.Errorf("Byte slice size is underestimated: %d", s)
+	}
+
+	if s := sizeOf(strings.Repeat("a", 1000)); s < 1000 {
+		t.Errorf("String size is underestimated: %d", s)
+	}
+
+	usr := &User{Email: strings.Repeat("a", 1000), Groups: []string{strings.Repeat("b", 1000)}}
+
+	if s := sizeOf(usr); s < 2000 {
+		t.Errorf("Struct size is underestimated: %d", s)
+	}
+}
+
+func BenchmarkCacheSetEvict(b *testing.B) {
+	c := NewCache(1 << 10)
+	val := make([]byte, 100)
+
+	for n := 0; n < b.N; n++ {
+		c.Set(strconv.Itoa(n), val)
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	c := NewCache(0)
+	release := make(chan struct{})
+	var calls int32
+	var wg sync.WaitGroup
+
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if val, err := c.GetOrLoad("key", load); err != nil || val != "value" {
+				t.Errorf("Unexpected result: %v, %v", val, err)
+			}
+		}()
+	}
+
+	// Let every goroutine reach the pending load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Concurrent misses triggered %d loads", calls)
+	}
+
+	if val, ok := c.Get("key"); !ok || val != "value" {
+		t.Error("Loaded value was not cached")
+	}
+
+	if val, _ := c.GetOrLoad("missing", func() (interface{}, error) { return nil, nil }); val != nil || c.Len() != 1 {
+		t.Error("Nil value was cached")
+	}
+}
+
+func TestCacheGetOrLoadInvalidated(t *testing.T) {
+	c := NewCache(0)
+
+	val, _ := c.GetOrLoad("key", func() (interface{}, error) {
+		c.Invalidate("key")
+		return "stale", nil
+	})
+
+	if val != "stale" {
+		t.Error("Loaded value was not returned")
+	}
+
+	if _, ok := c.Get("key"); ok {
+		t.Error("Value loaded during an invalidation was cached")
+	}
+}
+
+func TestCacheSetMemoryLimit(t *testing.T) {
+	c := NewCache(0)
+
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), strings.Repeat("x", 100))
+	}
+
+	limit := c.Size() / 2
+	c.SetMemoryLimit(limit)
+
+	if c.Size() > limit || c.Len() >= 100 {
+		t.Error("Lowering the memory limit did not evict entries")
+	}
+
+	if _, ok := c.Get("99"); !ok {
+		t.Error("Most recently used entry was evicted")
+	}
+
+	c.SetMemoryLimit(0)
+	n := c.Len()
+
+	for i := 100; i < 200; i++ {
+		c.Set(strconv.Itoa(i), strings.Repeat("x", 100))
+	}
+
+	if c.Len() != n+100 {
+		t.Error("Removing the memory limit did not stop evictions")
+	}
+}
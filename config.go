@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+)
+
+/*
+ * Configuration is read, by increasing priority, from:
+ *   1. Defaults given by the "default" tag, a field without one is required
+ *   2. The configuration file, "miogo.conf" unless the -config flag is given
+ *   3. Environment variables, e.g. MIOGO_MONGO_DB_HOST or MIOGO_TLS_CERT
+ *   4. Command-line flags, e.g. -mongo-db-host or -tls.cert
+ * Sections given as pointers are optional, their fields are neither required nor defaulted when they are absent.
+ */
+
+const defaultConfigFile = "miogo.conf"
+
+type TLSConfig struct {
+	// Addresses serving HTTPS, the ones in MiogoConfig.Listen redirect to the first of them
+	Listen []string `default:":8443"`
+	Cert   string
+	Key    string
+}
+
+// Sizes are given in megabytes
+type LimitsConfig struct {
+	MaxRequestBodySize int `default:"4"`
+	MaxUploadSize      int `default:"1024"`
+	// Files smaller than this are read at once and kept in the content cache
+	ContentBufferSize int `default:"64"`
+}
+
+// Memory limits of the caches in megabytes, 0 means unlimited
+type CachesConfig struct {
+	Folders      int `default:"0"`
+	Files        int `default:"0"`
+	FilesContent int `default:"64"`
+	Sessions     int `default:"0"`
+	Users        int `default:"0"`
+	Groups       int `default:"0"`
+}
+
+func megabytes(n int) int64 {
+	return int64(n) << 20
+}
+
+type configField struct {
+	path  []string
+	index []int
+	field reflect.StructField
+	// Part of an optional section
+	optional bool
+}
+
+func (f *configField) key() string {
+	return strings.Join(f.path, ".")
+}
+
+func (f *configField) env() string {
+	parts := make([]string, len(f.path))
+
+	for i, p := range f.path {
+		parts[i] = strings.ToUpper(splitWords(p, "_"))
+	}
+
+	return "MIOGO_" + strings.Join(parts, "_")
+}
+
+func (f *configField) flag() string {
+	parts := make([]string, len(f.path))
+
+	for i, p := range f.path {
+		parts[i] = strings.ToLower(splitWords(p, "-"))
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// splitWords separates the words of a CamelCase name, acronyms being kept together: MongoDBHost gives Mongo-DB-Host
+func splitWords(name, sep string) string {
+	r := []rune(name)
+	var b strings.Builder
+
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && (unicode.IsLower(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			b.WriteString(sep)
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// configFields lists the settable fields of a configuration type, going through sections
+func configFields(t reflect.Type, path []string, index []int, optional bool) []configField {
+	var fields []configField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		p := append(append([]string{}, path...), f.Name)
+		idx := append(append([]int{}, index...), i)
+		ft := f.Type
+
+		if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+			fields = append(fields, configFields(ft.Elem(), p, idx, true)...)
+		} else if ft.Kind() == reflect.Struct {
+			fields = append(fields, configFields(ft, p, idx, optional)...)
+		} else if ft.Kind() == reflect.Map {
+			// Maps can only be given in the file
+			continue
+		} else {
+			fields = append(fields, configField{p, idx, f, optional})
+		}
+	}
+
+	return fields
+}
+
+// lookup returns the value of the field, allocating the sections leading to it if alloc is set
+func (f *configField) lookup(v reflect.Value, alloc bool) (reflect.Value, bool) {
+	for i, n := range f.index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return v, false
+				}
+
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(n)
+	}
+
+	return v, true
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+
+		if err != nil {
+			return err
+		}
+
+		v.SetBool(b)
+	case reflect.Slice:
+		var list []string
+
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// LoadConfig reads the configuration, args being the command-line arguments without the program name
+func LoadConfig(args []string) (*MiogoConfig, error) {
+	var conf MiogoConfig
+
+	root := reflect.ValueOf(&conf).Elem()
+	fields := configFields(root.Type(), nil, nil, false)
+	flags := make(map[string]string)
+
+	fs := flag.NewFlagSet("miogo", flag.ContinueOnError)
+	file := fs.String("config", defaultConfigFile, "configuration file")
+
+	for _, f := range fields {
+		f := f
+		fs.Func(f.flag(), "overrides "+f.key()+" (env "+f.env()+")", func(s string) error {
+			flags[f.key()] = s
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	md, err := toml.DecodeFile(*file, &conf)
+
+	// Everything can be given by the environment or flags
+	if err != nil && !(os.IsNotExist(err) && *file == defaultConfigFile) {
+		return nil, fmt.Errorf("Error while loading configuration: %s", err)
+	}
+
+	set := make(map[string]bool)
+
+	for _, f := range fields {
+		s, ok := os.LookupEnv(f.env())
+
+		if fv, given := flags[f.key()]; given {
+			s, ok = fv, true
+		}
+
+		if !ok {
+			continue
+		}
+
+		v, _ := f.lookup(root, true)
+
+		if err := setConfigValue(v, s); err != nil {
+			return nil, fmt.Errorf("Wrong value for %s: %s", f.key(), err)
+		}
+
+		set[f.key()] = true
+	}
+
+	good := true
+
+	for _, f := range fields {
+		if set[f.key()] || md.IsDefined(f.path...) {
+			continue
+		}
+
+		v, exists := f.lookup(root, false)
+
+		if def, ok := f.field.Tag.Lookup("default"); ok {
+			if exists {
+				setConfigValue(v, def)
+			}
+		} else if !f.optional {
+			log.Printf("Lacking configuration field: %s\n", f.key())
+			good = false
+		}
+	}
+
+	if !good {
+		return nil, errors.New("Please provide the required data in the configuration file")
+	}
+
+	if err := conf.check(); err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+// check rejects settings which are missing or cannot be used together
+func (c *MiogoConfig) check() error {
+	if c.TLS != nil {
+		if len(c.TLS.Listen) == 0 {
+			return errors.New("TLS: Listen needs at least one address")
+		}
+
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			return errors.New("TLS: Cert and Key are required")
+		}
+	}
+
+	if c.CORS != nil && c.CORS.AllowCredentials && contains(c.CORS.AllowedOrigins, "*") {
+		return errors.New(`CORS: AllowCredentials cannot be used with the "*" origin`)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "miogo.conf")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestSplitWords(t *testing.T) {
+	for name, expected := range map[string]string{
+		"MongoDBHost":   "Mongo_DB_Host",
+		"SMTPPort":      "SMTP_Port",
+		"MaxUploadSize": "Max_Upload_Size",
+		"TLS":           "TLS",
+		"ClientID":      "Client_ID",
+	} {
+		if got := splitWords(name, "_"); got != expected {
+			t.Errorf("splitWords(%s) = %s, expected %s", name, got, expected)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+AdminEmail = "admin@miogo.tld"
+AdminPassword = "file"
+SessionDuration = 10
+
+[Caches]
+Users = 8
+
+[TLS]
+Cert = "cert.pem"
+Key = "key.pem"
+`)
+
+	os.Setenv("MIOGO_ADMIN_PASSWORD", "env")
+	os.Setenv("MIOGO_LIMITS_MAX_UPLOAD_SIZE", "16")
+	os.Setenv("MIOGO_SESSION_DURATION", "20")
+	defer os.Unsetenv("MIOGO_ADMIN_PASSWORD")
+	defer os.Unsetenv("MIOGO_LIMITS_MAX_UPLOAD_SIZE")
+	defer os.Unsetenv("MIOGO_SESSION_DURATION")
+
+	conf, err := LoadConfig([]string{"-config", path, "-session-duration", "40", "-listen", ":80, :8080"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.AdminEmail != "admin@miogo.tld" || conf.AdminPassword != "env" || conf.SessionDuration != 40 {
+		t.Errorf("Wrong priority between file, environment and flags: %+v", conf)
+	}
+
+	if conf.MongoDBHost != "localhost" || conf.Limits.MaxRequestBodySize != 4 || conf.Caches.FilesContent != 64 {
+		t.Errorf("Defaults were not applied: %+v", conf)
+	}
+
+	if conf.Limits.MaxUploadSize != 16 || conf.Caches.Users != 8 {
+		t.Errorf("Section values were not read: %+v", conf)
+	}
+
+	if !reflect.DeepEqual(conf.Listen, []string{":80", ":8080"}) {
+		t.Errorf("Wrong listen addresses: %v", conf.Listen)
+	}
+
+	if conf.TLS == nil || conf.TLS.Cert != "cert.pem" || !reflect.DeepEqual(conf.TLS.Listen, []string{":8443"}) {
+		t.Errorf("Wrong TLS section: %+v", conf.TLS)
+	}
+
+	if conf.Mail != nil || conf.OIDC != nil {
+		t.Error("Absent optional sections were created")
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	if _, err := LoadConfig([]string{"-config", writeConfig(t, `AdminEmail = "admin@miogo.tld"`)}); err == nil {
+		t.Error("Lacking AdminPassword was accepted")
+	}
+
+	if _, err := LoadConfig([]string{"-config", writeConfig(t, ""), "-admin-email", "a@b", "-admin-password", "p", "-mail.smtp-port", "25"}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "none.conf")}); err == nil {
+		t.Error("Missing configuration file was accepted")
+	}
+}
+
+func TestLoadConfigCheck(t *testing.T) {
+	for name, section := range map[string]string{
+		"Credentials allowed for any origin": "[CORS]\nAllowedOrigins = [\"*\"]\nAllowCredentials = true",
+		"TLS without address":                "[TLS]\nListen = []\nCert = \"cert.pem\"\nKey = \"key.pem\"",
+		"TLS without key":                    "[TLS]\nCert = \"cert.pem\"",
+	} {
+		path := writeConfig(t, "AdminEmail = \"admin@miogo.tld\"\nAdminPassword = \"file\"\n"+section)
+
+		if _, err := LoadConfig([]string{"-config", path}); err == nil {
+			t.Error(name)
+		}
+	}
+}
+
+func TestConfigExample(t *testing.T) {
+	if _, err := LoadConfig([]string{"-config", "miogo.conf.example"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Content indexing:
+ *   1. Indexing a file in search.go queues its text extraction in the contents collection
+ *   2. Pending entries are polled by every instance, see poller.go
+ *   3. The text is stored in the entry, which MongoDB indexes for SearchContent
+ * Removed files lose their entry, copies share the text of their source as the content is the same.
+ */
+
+const (
+	contentsCollection  = "contents"
+	contentPollInterval = time.Second
+	// An entry whose extraction did not end by then is extracted again
+	contentLease = 5 * time.Minute
+	// Bigger files are not read
+	maxExtractedFile = 64 << 20
+)
+
+const (
+	ContentPending     = "pending"
+	ContentIndexed     = "indexed"
+	ContentUnsupported = "unsupported"
+	ContentFailed      = "failed"
+)
+
+type ContentEntry struct {
+	Path      string        `bson:"_id"`
+	Folder    string        `bson:"folder"`
+	Name      string        `bson:"name"`
+	Ancestors []string      `bson:"ancestors"`
+	FileID    bson.ObjectId `bson:"file_id"`
+	Status    string        `bson:"status"`
+	// Unix time before which the entry is not extracted
+	Lease int64  `bson:"lease"`
+	Text  string `bson:"text,omitempty"`
+}
+
+func ensureContentIndexes() {
+	c := db.C(contentsCollection)
+
+	// Stemming depends on the language, which is not known
+	text := mgo.Index{Key: []string{"$text:name", "$text:text"}, Weights: map[string]int{"name": 5, "text": 1}, DefaultLanguage: "none"}
+
+	for _, index := range []mgo.Index{text, {Key: []string{"status", "lease"}}, {Key: []string{"ancestors"}}} {
+		if err := c.EnsureIndex(index); err != nil {
+			log.Printf("Cannot index the contents: %s\n", err)
+		}
+	}
+
+	if n, err := c.Count(); err != nil || n > 0 {
+		return
+	}
+
+	iter := db.C("folders").Find(bson.M{"files.0": bson.M{"$exists": true}}).Iter()
+	var folder Folder
+
+	for iter.Next(&folder) {
+		for _, f := range folder.Files {
+			queueExtraction(folder.Path, f.Name, f.FileID)
+		}
+
+		folder = Folder{}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.Printf("Cannot queue the extraction of existing files: %s\n", err)
+	}
+}
+
+// queueExtraction replaces the entry of a file by a pending one
+func queueExtraction(folder, name string, id bson.ObjectId) {
+	s := newSearchEntry(folder, name)
+	e := ContentEntry{Path: s.Path, Folder: folder, Name: name, Ancestors: s.Ancestors, FileID: id, Status: ContentPending}
+
+	if _, err := db.C(contentsCollection).UpsertId(e.Path, &e); err != nil {
+		log.Printf("Cannot queue the extraction of %s: %s\n", e.Path, err)
+	}
+}
+
+// copyContent gives a copy the text of its source, which is extracted again if not known yet
+func copyContent(source, folder, name string, id bson.ObjectId) {
+	var e ContentEntry
+
+	if err := db.C(contentsCollection).FindId(source).One(&e); err != nil || e.FileID != id || e.Status == ContentPending {
+		queueExtraction(folder, name, id)
+		return
+	}
+
+	s := newSearchEntry(folder, name)
+	e.Path, e.Folder, e.Name, e.Ancestors = s.Path, folder, name, s.Ancestors
+
+	if _, err := db.C(contentsCollection).UpsertId(e.Path, &e); err != nil {
+		log.Printf("Cannot index the content of %s: %s\n", e.Path, err)
+	}
+}
+
+func removeContent(path string) {
+	if err := db.C(contentsCollection).RemoveId(path); err != nil && err != mgo.ErrNotFound {
+		log.Printf("Cannot remove the content of %s: %s\n", path, err)
+	}
+}
+
+type contentExtractor struct {
+	*poller
+}
+
+func newContentExtractor() *contentExtractor {
+	x := &contentExtractor{}
+	x.poller = startPoller(contentPollInterval, x.extractNext)
+
+	return x
+}
+
+// extractNext leases a pending entry and extracts its text, it returns false when there is none
+func (x *contentExtractor) extractNext() bool {
+	now := time.Now()
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"lease": now.Add(contentLease).Unix()}}, ReturnNew: true}
+
+	var e ContentEntry
+	_, err := db.C(contentsCollection).Find(bson.M{"status": ContentPending, "lease": bson.M{"$lte": now.Unix()}}).Apply(change, &e)
+
+	if err == mgo.ErrNotFound {
+		return false
+	} else if err != nil {
+		log.Printf("Cannot read the extraction queue: %s\n", err)
+		return false
+	}
+
+	update, ok := x.extract(&e)
+
+	// Extracted again once the lease ends
+	if !ok {
+		return true
+	}
+
+	// Nothing is written if the file changed meanwhile
+	err = db.C(contentsCollection).Update(bson.M{"_id": e.Path, "file_id": e.FileID, "status": ContentPending}, bson.M{"$set": update})
+
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("Cannot store the text of %s: %s\n", e.Path, err)
+	}
+
+	return true
+}
+
+// extract returns the update of the entry, or false when GridFS cannot be read for now
+func (x *contentExtractor) extract(e *ContentEntry) (bson.M, bool) {
+	if _, ok := extractors[extension(e.Name)]; !ok {
+		return bson.M{"status": ContentUnsupported}, true
+	}
+
+	gf, err := db.GridFS("fs").OpenId(e.FileID)
+
+	if err == mgo.ErrNotFound {
+		return bson.M{"status": ContentFailed}, true
+	} else if err != nil {
+		log.Printf("Cannot read %s for extraction: %s\n", e.Path, err)
+		return nil, false
+	}
+
+	defer gf.Close()
+
+	if gf.Size() > maxExtractedFile {
+		return bson.M{"status": ContentUnsupported}, true
+	}
+
+	content, err := ioutil.ReadAll(gf)
+
+	if err != nil {
+		log.Printf("Cannot read %s for extraction: %s\n", e.Path, err)
+		return nil, false
+	}
+
+	text, err := extractText(e.Name, content)
+
+	if err != nil {
+		logDebug("Cannot extract the text of %s: %s\n", e.Path, err)
+		return bson.M{"status": ContentFailed}, true
+	}
+
+	return bson.M{"status": ContentIndexed, "text": text}, true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Best matches checked by SearchContent
+	contentScanLimit = 1000
+	// Bytes of text around a match
+	snippetContext = 60
+	maxSnippets    = 3
+)
+
+type ContentResult struct {
+	Path   string  `json:"path"`
+	Folder string  `json:"folder"`
+	Name   string  `json:"name"`
+	Score  float64 `json:"score"`
+	// HTML escaped extracts, the words searched being in <mark> elements
+	Snippets []string `json:"snippets"`
+}
+
+type ContentPage struct {
+	Results []ContentResult `json:"results"`
+	Total   int             `json:"total"`
+	Page    int             `json:"page"`
+	PerPage int             `json:"per_page"`
+	// Matches were left unread, the best ones being returned
+	Truncated bool `json:"truncated"`
+}
+
+// searchTerms returns the words of a MongoDB text search, excluded ones being left out
+func searchTerms(query string) []string {
+	var terms []string
+
+	for _, word := range strings.Fields(strings.Replace(query, `"`, " ", -1)) {
+		if !strings.HasPrefix(word, "-") {
+			terms = append(terms, word)
+		}
+	}
+
+	return terms
+}
+
+func runeStart(text string, i int) int {
+	for i > 0 && i < len(text) && !utf8.RuneStart(text[i]) {
+		i--
+	}
+
+	return i
+}
+
+// snippets returns the extracts of the text around the terms, highlighted
+func snippets(text string, terms []string) []string {
+	list := []string{}
+
+	if len(terms) == 0 {
+		return list
+	}
+
+	quoted := make([]string, len(terms))
+
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+
+	re := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+	matches := re.FindAllStringIndex(text, -1)
+	covered := 0
+
+	for _, match := range matches {
+		if len(list) == maxSnippets {
+			break
+		}
+
+		if match[0] < covered {
+			continue
+		}
+
+		start, end := match[0]-snippetContext, match[1]+snippetContext
+
+		if start < 0 {
+			start = 0
+		}
+
+		if end > len(text) {
+			end = len(text)
+		}
+
+		start, end = runeStart(text, start), runeStart(text, end)
+		covered = end
+
+		var b strings.Builder
+
+		if start > 0 {
+			b.WriteString("…")
+		}
+
+		last := start
+
+		for _, m := range matches {
+			if m[0] >= start && m[1] <= end {
+				b.WriteString(html.EscapeString(text[last:m[0]]))
+				b.WriteString("<mark>" + html.EscapeString(text[m[0]:m[1]]) + "</mark>")
+				last = m[1]
+			}
+		}
+
+		b.WriteString(html.EscapeString(text[last:end]))
+
+		if end < len(text) {
+			b.WriteString("…")
+		}
+
+		list = append(list, b.String())
+	}
+
+	return list
+}
+
+// SearchContent lists the documents containing the words searched, best matches first
+func (m *Miogo) SearchContent(ctx *fasthttp.RequestCtx, u *User) error {
+	query := strings.TrimSpace(string(ctx.FormValue("query")))
+
+	if query == "" {
+		return errWrongArgs.WithDetails("query", "Words expected")
+	}
+
+	selector := bson.M{"$text": bson.M{"$search": query}, "status": ContentIndexed}
+
+	if hasArg(ctx, "path") {
+		p := formatD(string(ctx.FormValue("path")))
+
+		if folder, ok := m.FetchFolder(p); !ok {
+			return errFolderMissing.WithDetails("path", p)
+		} else if GetRightType(u, folder.Rights) < AllowedToRead {
+			return errAccessDenied
+		}
+
+		if p != "/" {
+			selector["ancestors"] = p
+		}
+	}
+
+	page, perPage := pagination(ctx)
+	score := bson.M{"$meta": "textScore"}
+
+	// Texts are only read for the page returned
+	iter := scanCapped(db.C(contentsCollection).Find(selector).Select(bson.M{"folder": 1, "name": 1, "score": score}).
+		Sort("$textScore:score"), contentScanLimit)
+
+	filter := newReadFilter(m, u)
+	results := []ContentResult{}
+	total := 0
+
+	var r struct {
+		Path   string  `bson:"_id"`
+		Folder string  `bson:"folder"`
+		Name   string  `bson:"name"`
+		Score  float64 `bson:"score"`
+	}
+
+	for iter.Next(&r) {
+		if _, ok := filter.canRead(r.Folder, true); ok {
+			if _, ok := filter.canRead(r.Path, false); ok {
+				total++
+
+				if total > (page-1)*perPage && len(results) < perPage {
+					results = append(results, ContentResult{Path: r.Path, Folder: r.Folder, Name: r.Name, Score: r.Score})
+				}
+			}
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return errFailure
+	}
+
+	terms := searchTerms(query)
+
+	for i := range results {
+		var e ContentEntry
+
+		if err := db.C(contentsCollection).FindId(results[i].Path).Select(bson.M{"text": 1}).One(&e); err != nil {
+			results[i].Snippets = []string{}
+			continue
+		}
+
+		results[i].Snippets = snippets(e.Text, terms)
+	}
+
+	res, _ := json.Marshal(ContentPage{results, total, page, perPage, iter.truncated})
+
+	ctx.SetBody(res)
+	return nil
+}
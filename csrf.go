@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+/*
+ * CSRF protection:
+ *   1. Login sets the session cookie and gives a token derived from the raw session,
+ *      in the X-CSRF-Token header and in the csrf_token cookie readable by scripts
+ *   2. Services requiring login check the X-CSRF-Token header of requests, except GET and HEAD ones
+ * Pages from other origins can make browsers send the session cookie but can neither read the token nor compute it.
+ */
+
+// Attributes of the session cookie and CSRF protection
+type SessionConfig struct {
+	// "lax", "strict", "none" or "" to leave it unset
+	SameSite string `default:"lax"`
+	// Only send cookies over HTTPS, always the case when TLS is set
+	Secure bool   `default:"false"`
+	Domain string `default:""`
+	// Check the X-CSRF-Token header on services requiring login
+	CSRF bool `default:"true"`
+}
+
+var errCSRF = NewError(fasthttp.StatusForbidden, "invalid_csrf_token", "Missing or invalid CSRF token")
+
+func sameSiteMode(s string) (fasthttp.CookieSameSite, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return fasthttp.CookieSameSiteDisabled, nil
+	case "lax":
+		return fasthttp.CookieSameSiteLaxMode, nil
+	case "strict":
+		return fasthttp.CookieSameSiteStrictMode, nil
+	case "none":
+		return fasthttp.CookieSameSiteNoneMode, nil
+	}
+
+	return fasthttp.CookieSameSiteDisabled, fmt.Errorf("Unknown SameSite mode %s", s)
+}
+
+func csrfToken(raw string) string {
+	mac := hmac.New(sha256.New, []byte(raw))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Miogo) setCookie(ctx *fasthttp.RequestCtx, key, value string, httpOnly bool) {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+
+	mode, _ := sameSiteMode(m.conf.Session.SameSite)
+
+	cookie.SetKey(key)
+	cookie.SetValue(value)
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(httpOnly)
+	cookie.SetSecure(m.conf.Session.Secure || m.conf.TLS != nil)
+	cookie.SetDomain(m.conf.Session.Domain)
+	cookie.SetSameSite(mode)
+
+	if value == "" {
+		cookie.SetExpire(fasthttp.CookieExpireDelete)
+	}
+
+	ctx.Response.Header.SetCookie(cookie)
+}
+
+func (m *Miogo) setSessionCookies(ctx *fasthttp.RequestCtx, raw string) {
+	// The cookies will have a "session" duration on the client side (until the browser is closed)
+	m.setCookie(ctx, "session", raw, true)
+	m.setCookie(ctx, "csrf_token", csrfToken(raw), false)
+	ctx.Response.Header.Set("X-CSRF-Token", csrfToken(raw))
+}
+
+func (m *Miogo) clearSessionCookies(ctx *fasthttp.RequestCtx) {
+	m.setCookie(ctx, "session", "", true)
+	m.setCookie(ctx, "csrf_token", "", false)
+}
+
+func (m *Miogo) checkCSRF(s *Service) Middleware {
+	return func(next Handler) Handler {
+		if s.Options&NoLoginCheck != 0 || !m.conf.Session.CSRF {
+			return next
+		}
+
+		return func(ctx *fasthttp.RequestCtx) error {
+			if ctx.IsGet() || ctx.IsHead() {
+				return next(ctx)
+			}
+
+			token := ctx.Request.Header.Peek("X-CSRF-Token")
+			expected := csrfToken(string(ctx.Request.Header.Cookie("session")))
+
+			if !hmac.Equal(token, []byte(expected)) {
+				return errCSRF
+			}
+
+			return next(ctx)
+		}
+	}
+}
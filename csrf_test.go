@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSessionCookies(t *testing.T) {
+	m := &Miogo{conf: &MiogoConfig{Session: SessionConfig{SameSite: "strict", Domain: "miogo.tld"}, TLS: &TLSConfig{}}}
+
+	var ctx fasthttp.RequestCtx
+	m.setSessionCookies(&ctx, "raw")
+
+	session := string(ctx.Response.Header.PeekCookie("session"))
+
+	for _, attr := range []string{"session=raw", "path=/", "domain=miogo.tld", "HttpOnly", "secure", "SameSite=Strict"} {
+		if !strings.Contains(session, attr) {
+			t.Errorf("Session cookie %s lacks %s", session, attr)
+		}
+	}
+
+	token := string(ctx.Response.Header.PeekCookie("csrf_token"))
+
+	if !strings.HasPrefix(token, "csrf_token="+csrfToken("raw")) || strings.Contains(token, "HttpOnly") {
+		t.Errorf("Wrong CSRF cookie %s", token)
+	}
+
+	if string(ctx.Response.Header.Peek("X-CSRF-Token")) != csrfToken("raw") {
+		t.Error("CSRF token not given in the header")
+	}
+
+	if _, err := sameSiteMode("sometimes"); err == nil {
+		t.Error("Unknown SameSite mode accepted")
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	m := &Miogo{conf: &MiogoConfig{Session: SessionConfig{CSRF: true}}}
+	ok := func(ctx *fasthttp.RequestCtx) error { return nil }
+	h := m.checkCSRF(&Service{})(ok)
+
+	for _, c := range []struct {
+		method, token string
+		err           error
+	}{
+		{"POST", csrfToken("raw"), nil},
+		{"POST", "", errCSRF},
+		{"POST", csrfToken("other"), errCSRF},
+		{"DELETE", "", errCSRF},
+		{"GET", "", nil},
+	} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(c.method)
+		ctx.Request.Header.SetCookie("session", "raw")
+
+		if c.token != "" {
+			ctx.Request.Header.Set("X-CSRF-Token", c.token)
+		}
+
+		if err := h(&ctx); err != c.err {
+			t.Errorf("%s with %q: got %v", c.method, c.token, err)
+		}
+	}
+
+	// Services reachable without login are not checked
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+
+	if err := m.checkCSRF(&Service{Options: NoLoginCheck})(ok)(&ctx); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -29,6 +30,35 @@ func InitDB(host, adminEmail, adminPassword string) {
 
 	if count, err := session.DB("miogo").C("users").Find(bson.M{"is_admin": true}).Count(); count == 0 && err == nil {
 		hashedAdminPassword, _ := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
-		db.C("users").Insert(bson.M{"email": adminEmail, "password": string(hashedAdminPassword), "is_admin": true})
+		db.C("users").Insert(bson.M{"email": adminEmail, "password": string(hashedAdminPassword), "is_admin": true, "created": time.Now().Unix()})
 	}
 }
+
+// cappedIter reads at most limit documents of a query, noting whether more were left unread
+type cappedIter struct {
+	iter      *mgo.Iter
+	left      int
+	truncated bool
+}
+
+func scanCapped(q *mgo.Query, limit int) *cappedIter {
+	return &cappedIter{iter: q.Limit(limit + 1).Iter(), left: limit}
+}
+
+func (c *cappedIter) Next(result interface{}) bool {
+	if !c.iter.Next(result) {
+		return false
+	}
+
+	if c.left == 0 {
+		c.truncated = true
+		return false
+	}
+
+	c.left--
+	return true
+}
+
+func (c *cappedIter) Close() error {
+	return c.iter.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+)
+
+// Error is returned by services, clients should rely on Code rather than on Message
+type Error struct {
+	Code    string            `json:"code"`
+	Status  int               `json:"-"`
+	Message string            `json:"error"`
+	Details map[string]string `json:"details,omitempty"`
+	// Response headers going with the error, e.g. Allow
+	Headers map[string]string `json:"-"`
+}
+
+func NewError(status int, code, message string) *Error {
+	return &Error{Code: code, Status: status, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetails returns a copy of the error with details given as key and value pairs
+func (e *Error) WithDetails(kv ...string) *Error {
+	c := *e
+	c.Details = make(map[string]string, len(e.Details)+len(kv)/2)
+
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		c.Details[kv[i]] = kv[i+1]
+	}
+
+	return &c
+}
+
+// WithHeader returns a copy of the error setting a response header
+func (e *Error) WithHeader(name, value string) *Error {
+	c := *e
+	c.Headers = make(map[string]string, len(e.Headers)+1)
+
+	for k, v := range e.Headers {
+		c.Headers[k] = v
+	}
+
+	c.Headers[name] = value
+
+	return &c
+}
+
+var (
+	errFailure          = NewError(fasthttp.StatusInternalServerError, "internal_error", "Failure on our side")
+	errStorageFull      = NewError(fasthttp.StatusInsufficientStorage, "insufficient_storage", "Not enough storage space")
+	errBadRequest       = NewError(fasthttp.StatusBadRequest, "bad_request", "Bad request")
+	errNotPOST          = NewError(fasthttp.StatusMethodNotAllowed, "method_not_allowed", "Please send POST requests")
+	errWrongArgs        = NewError(fasthttp.StatusBadRequest, "wrong_arguments", "Wrong arguments")
+	errBodyTooLarge     = NewError(fasthttp.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+	errNotLoggedIn      = NewError(fasthttp.StatusUnauthorized, "not_logged_in", "Not logged in")
+	errUnknownSvc       = NewError(fasthttp.StatusNotFound, "unknown_service", "Wrong service name")
+	errAccessDenied     = NewError(fasthttp.StatusForbidden, "access_denied", "Access denied")
+	errFileNotFound     = NewError(fasthttp.StatusNotFound, "file_not_found", "File does not exist")
+	errFolderMissing    = NewError(fasthttp.StatusNotFound, "folder_not_found", "Folder does not exist")
+	errFolderExists     = NewError(fasthttp.StatusConflict, "folder_exists", "Folder already exists")
+	errGroupNotFound    = NewError(fasthttp.StatusNotFound, "group_not_found", "Group does not exist")
+	errGroupExists      = NewError(fasthttp.StatusConflict, "group_exists", "Group already exists")
+	errUserExists       = NewError(fasthttp.StatusConflict, "user_exists", "User already exists")
+	errResourceNotFound = NewError(fasthttp.StatusNotFound, "resource_not_found", "Resource does not exist")
+)
+
+// isStorageFull tells whether MongoDB refused a write because of a quota or a full disk
+func isStorageFull(err error) bool {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return e.Code == 14031 || e.Code == 12501
+	case *mgo.QueryError:
+		return e.Code == 14031 || e.Code == 12501
+	}
+
+	return err != nil && strings.Contains(err.Error(), "quota exceeded")
+}
+
+func writeError(ctx *fasthttp.RequestCtx, err error) {
+	e, ok := err.(*Error)
+
+	if !ok {
+		log.Printf("Unexpected error: %s\n", err)
+		e = errFailure
+	}
+
+	b, _ := json.Marshal(e)
+
+	ctx.Response.Reset()
+	ctx.SetStatusCode(e.Status)
+
+	for k, v := range e.Headers {
+		ctx.Response.Header.Set(k, v)
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
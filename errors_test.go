@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestWriteError(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+
+	writeError(&ctx, errFolderMissing.WithDetails("path", `/a "quoted" path`))
+
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("Wrong status code %d", ctx.Response.StatusCode())
+	}
+
+	var e Error
+
+	if err := json.Unmarshal(ctx.Response.Body(), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Code != "folder_not_found" || e.Message != "Folder does not exist" || e.Details["path"] != `/a "quoted" path` {
+		t.Errorf("Wrong error body: %s", ctx.Response.Body())
+	}
+
+	if errFolderMissing.Details != nil {
+		t.Error("WithDetails modified the original error")
+	}
+
+	// Headers set before the error are dropped, except the ones of the error
+	ctx.Response.Header.Set("ETag", `"1"`)
+	writeError(&ctx, errMethodNotAllowed.WithHeader("Allow", "GET"))
+
+	if string(ctx.Response.Header.Peek("Allow")) != "GET" || len(ctx.Response.Header.Peek("ETag")) != 0 {
+		t.Errorf("Wrong headers: %s", ctx.Response.Header.String())
+	}
+
+	if errMethodNotAllowed.Headers != nil {
+		t.Error("WithHeader modified the original error")
+	}
+
+	// Errors which are not typed must not leak their message
+	writeError(&ctx, errors.New("mgo: internal details"))
+
+	if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError || string(ctx.Response.Body()) != `{"code":"internal_error","error":"Failure on our side"}` {
+		t.Errorf("Wrong fallback error: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestJSONKV(t *testing.T) {
+	var v map[string]string
+
+	if err := json.Unmarshal([]byte(jsonkv("message", `say "hi"\`)), &v); err != nil || v["message"] != `say "hi"\` {
+		t.Errorf("Value was not escaped: %s", jsonkv("message", `say "hi"\`))
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Server-Sent Events on /events:
+ *   1. A logged in user opens a stream following one or several folders
+ *   2. File services publish their events, through a capped collection when instances share the database
+ *   3. Every instance gives the events to its streams, which only send the ones the user can read
+ */
+
+const (
+	// Rights changes are only notified, they are not part of the activity feed
+	EventRights = "rights"
+
+	eventsCollectionName = "events"
+	// Events waiting for a slow client, the stream is closed beyond
+	eventsBuffer = 64
+	// Comments are sent to keep connections open, the session is checked at the same time
+	eventsKeepAlive = 30 * time.Second
+)
+
+var errShuttingDown = NewError(fasthttp.StatusServiceUnavailable, "shutting_down", "Server is shutting down")
+
+type eventStream struct {
+	events chan ActivityEvent
+}
+
+type EventHub struct {
+	sync.Mutex
+	streams map[*eventStream]struct{}
+	// Nil for a single instance
+	capped *cappedCollection
+	closed bool
+}
+
+// NewEventHub shares events with other instances through the database if capped is set
+func NewEventHub(capped *cappedCollection) *EventHub {
+	h := &EventHub{streams: make(map[*eventStream]struct{}), capped: capped}
+
+	if capped != nil {
+		go capped.tail(func(raw bson.Raw) {
+			var e ActivityEvent
+
+			if err := raw.Unmarshal(&e); err == nil {
+				h.broadcast(e)
+			}
+		}, func() {
+			logInfo("Event stream lagged behind, some events were not sent\n")
+		})
+	}
+
+	return h
+}
+
+func NewMongoEventHub(database *mgo.Database, size int) (*EventHub, error) {
+	capped, err := openCapped(database, eventsCollectionName, size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEventHub(capped), nil
+}
+
+// Publish expects events with an ID, see newActivityEvent
+func (h *EventHub) Publish(e *ActivityEvent) {
+	if h.capped == nil {
+		h.broadcast(*e)
+	} else if err := h.capped.insert(e); err != nil {
+		log.Printf("Cannot publish the %s event of %s: %s\n", e.Action, e.Actor, err)
+	}
+}
+
+func (h *EventHub) broadcast(e ActivityEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	for s := range h.streams {
+		select {
+		case s.events <- e:
+		default:
+			// Browsers reconnect by themselves, better than having them miss events silently
+			close(s.events)
+			delete(h.streams, s)
+		}
+	}
+}
+
+func (h *EventHub) subscribe() (*eventStream, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		return nil, false
+	}
+
+	s := &eventStream{events: make(chan ActivityEvent, eventsBuffer)}
+	h.streams[s] = struct{}{}
+
+	return s, true
+}
+
+func (h *EventHub) unsubscribe(s *eventStream) {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.streams[s]; ok {
+		close(s.events)
+		delete(h.streams, s)
+	}
+}
+
+// Close ends every stream, it must be called before shutting servers down as streams never end by themselves
+func (h *EventHub) Close() {
+	h.Lock()
+
+	if h.closed {
+		h.Unlock()
+		return
+	}
+
+	h.closed = true
+
+	for s := range h.streams {
+		close(s.events)
+		delete(h.streams, s)
+	}
+
+	h.Unlock()
+
+	if h.capped != nil {
+		h.capped.close()
+	}
+}
+
+func inSubtree(folder, path string) bool {
+	return folder == "/" || path == folder || strings.HasPrefix(path, folder+"/")
+}
+
+// follows tells whether the event happened in one of the folders, or moved or copied something to it
+func follows(folders []string, e *ActivityEvent) bool {
+	for _, f := range folders {
+		if inSubtree(f, e.Folder) || (e.Destination != "" && inSubtree(f, e.Destination)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamUser reloads the user of a stream with its memberships, removed users getting nothing
+func (m *Miogo) streamUser(email string) (*User, bool) {
+	u, ok := m.FetchUser(email)
+
+	if !ok {
+		return nil, false
+	}
+
+	// The cached user is shared, memberships are set on a copy
+	usr := *u
+	usr.Memberships = m.FetchMemberships(u)
+
+	return &usr, true
+}
+
+// Events streams the changes in the folders given as path arguments
+func (m *Miogo) Events(ctx *fasthttp.RequestCtx, u *User) error {
+	var folders []string
+
+	args := ctx.QueryArgs().PeekMulti("path")
+	args = append(args, ctx.PostArgs().PeekMulti("path")...)
+
+	for _, arg := range args {
+		path := formatD(string(arg))
+
+		if folder, ok := m.FetchFolder(path); !ok {
+			return errFolderMissing.WithDetails("path", path)
+		} else if GetRightType(u, folder.Rights) < AllowedToRead {
+			return errAccessDenied
+		}
+
+		folders = append(folders, path)
+	}
+
+	stream, ok := m.events.subscribe()
+
+	if !ok {
+		return errShuttingDown
+	}
+
+	raw := string(ctx.Request.Header.Cookie("session"))
+
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	// Proxies such as nginx must not buffer the stream
+	ctx.Response.Header.Set("X-Accel-Buffering", "no")
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer m.events.unsubscribe(stream)
+
+		usr := u
+
+		ticker := time.NewTicker(eventsKeepAlive)
+		defer ticker.Stop()
+
+		w.WriteString("retry: 5000\n\n")
+
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case e, ok := <-stream.events:
+				if !ok {
+					return
+				}
+
+				filter := newReadFilter(m, usr)
+
+				if !follows(folders, &e) || !filter.visible(&e) {
+					continue
+				}
+
+				b, _ := json.Marshal(e)
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Id.Hex(), e.Action, b)
+			case <-ticker.C:
+				if !m.sessionAlive(raw) {
+					return
+				}
+
+				// Groups may have changed since the stream was opened
+				reloaded, ok := m.streamUser(usr.Email)
+
+				if !ok {
+					return
+				}
+
+				usr = reloaded
+
+				w.WriteString(": keep-alive\n\n")
+			}
+		}
+	})
+
+	return nil
+}
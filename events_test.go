@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFollows(t *testing.T) {
+	tests := []struct {
+		folders  []string
+		e        ActivityEvent
+		expected bool
+	}{
+		{[]string{"/"}, ActivityEvent{Folder: "/x"}, true},
+		{[]string{"/x"}, ActivityEvent{Folder: "/x"}, true},
+		{[]string{"/x"}, ActivityEvent{Folder: "/x/y"}, true},
+		{[]string{"/x"}, ActivityEvent{Folder: "/xy"}, false},
+		{[]string{"/y", "/x"}, ActivityEvent{Folder: "/x"}, true},
+		{[]string{"/y"}, ActivityEvent{Folder: "/x", Destination: "/y/z"}, true},
+		{[]string{"/y"}, ActivityEvent{Folder: "/x"}, false},
+	}
+
+	for _, test := range tests {
+		if got := follows(test.folders, &test.e); got != test.expected {
+			t.Errorf("%v following %+v: expected %v", test.folders, test.e, test.expected)
+		}
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	h := NewEventHub(nil)
+	s, _ := h.subscribe()
+	u := &User{Email: "alice"}
+
+	h.Publish(newActivityEvent(u, ActivityUpload, "/x", []string{"a.txt"}, ""))
+
+	if e := <-s.events; e.Actor != "alice" || e.Folder != "/x" || e.Id == "" {
+		t.Errorf("Wrong event %+v", e)
+	}
+
+	// Streams too slow to read their events are closed
+	for i := 0; i <= eventsBuffer; i++ {
+		h.Publish(newActivityEvent(u, ActivityUpload, "/x", []string{"a.txt"}, ""))
+	}
+
+	for i := 0; i < eventsBuffer; i++ {
+		<-s.events
+	}
+
+	if _, ok := <-s.events; ok {
+		t.Error("Slow stream not closed")
+	}
+
+	other, _ := h.subscribe()
+	h.Close()
+
+	if _, ok := <-other.events; ok {
+		t.Error("Stream not closed with the hub")
+	}
+
+	if _, ok := h.subscribe(); ok {
+		t.Error("Stream opened on a closed hub")
+	}
+
+	h.unsubscribe(other)
+}
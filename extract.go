@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text extraction of the documents indexed for SearchContent, formats are recognized by extension
+
+const (
+	// Text kept by document, MongoDB documents being limited to 16 MB
+	maxExtractedText = 1 << 20
+	// Bytes decompressed from a single document, against zip bombs
+	maxDecompressed = 64 << 20
+)
+
+var errUnsupportedFormat = errors.New("Unsupported format")
+
+var (
+	htmlSkipped = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>|<!--.*?-->`)
+	htmlTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+func plainText(content []byte) (string, error) {
+	return string(content), nil
+}
+
+func htmlText(content []byte) (string, error) {
+	return html.UnescapeString(htmlTag.ReplaceAllString(htmlSkipped.ReplaceAllString(string(content), " "), " ")), nil
+}
+
+func ooxmlPart(part func(string) bool) func([]byte) (string, error) {
+	return func(content []byte) (string, error) {
+		return ooxmlText(content, part)
+	}
+}
+
+// Extractors by extension
+var extractors = map[string]func([]byte) (string, error){
+	"txt":      plainText,
+	"text":     plainText,
+	"md":       plainText,
+	"markdown": plainText,
+	"csv":      plainText,
+	"log":      plainText,
+	"html":     htmlText,
+	"htm":      htmlText,
+	"xhtml":    htmlText,
+	"pdf":      pdfText,
+	"docx":     ooxmlPart(func(n string) bool { return n == "word/document.xml" }),
+	"xlsx":     ooxmlPart(func(n string) bool { return n == "xl/sharedStrings.xml" }),
+	"pptx": ooxmlPart(func(n string) bool {
+		return strings.HasPrefix(n, "ppt/slides/slide") && strings.HasSuffix(n, ".xml")
+	}),
+}
+
+// extractText returns the text of a document with its whitespace collapsed
+func extractText(name string, content []byte) (string, error) {
+	extract, ok := extractors[extension(name)]
+
+	if !ok {
+		return "", errUnsupportedFormat
+	}
+
+	text, err := extract(content)
+
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, " ")), " ")
+
+	if len(text) > maxExtractedText {
+		end := maxExtractedText
+
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+
+		text = text[:end]
+	}
+
+	return text, nil
+}
+
+// ooxmlText reads the text runs of the parts selected, slides being read in order
+func ooxmlText(content []byte, part func(string) bool) (string, error) {
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+
+	if err != nil {
+		return "", err
+	}
+
+	var files []*zip.File
+	var size uint64
+
+	for _, f := range r.File {
+		if part(f.Name) {
+			files = append(files, f)
+			size += f.UncompressedSize64
+		}
+	}
+
+	if size > maxDecompressed {
+		return "", errors.New("Document too large")
+	}
+
+	// slide10.xml comes after slide9.xml
+	number := func(n string) int {
+		i, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimLeft(n, "abcdefghijklmnopqrstuvwxyz/"), ".xml"))
+		return i
+	}
+
+	sort.Slice(files, func(i, j int) bool { return number(files[i].Name) < number(files[j].Name) })
+
+	var out strings.Builder
+
+	for _, f := range files {
+		rc, err := f.Open()
+
+		if err != nil {
+			return "", err
+		}
+
+		err = xmlText(io.LimitReader(rc, maxDecompressed), &out)
+		rc.Close()
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return out.String(), nil
+}
+
+// xmlText writes the content of t elements (w:t, a:t), paragraphs and shared strings being separated
+func xmlText(r io.Reader, out *strings.Builder) error {
+	d := xml.NewDecoder(r)
+	inText := false
+
+	for {
+		tok, err := d.Token()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			inText = t.Name.Local == "t"
+
+			if t.Name.Local == "tab" || t.Name.Local == "br" {
+				out.WriteByte(' ')
+			}
+		case xml.EndElement:
+			inText = false
+
+			if t.Name.Local == "p" || t.Name.Local == "si" {
+				out.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				out.Write(t)
+			}
+		}
+	}
+}
+
+/*
+ * PDF text:
+ *   1. Streams are found between the stream and endstream keywords, Flate compressed ones being inflated
+ *   2. Only content streams are read, their dictionary having neither Type nor Subtype
+ *   3. Strings shown between BT and ET are written out, a large gap in TJ arrays being a space
+ * Fonts mapping glyphs through CMaps are not decoded, hex strings which do not look like text are skipped.
+ */
+
+func pdfText(content []byte) (string, error) {
+	if !bytes.HasPrefix(content, []byte("%PDF")) {
+		return "", errors.New("Not a PDF")
+	}
+
+	if bytes.Contains(content, []byte("/Encrypt")) {
+		return "", errors.New("Encrypted PDF")
+	}
+
+	var out strings.Builder
+	budget := int64(maxDecompressed)
+	rest := content
+	offset := 0
+
+	for {
+		i := bytes.Index(rest, []byte("stream"))
+
+		if i < 0 {
+			break
+		}
+
+		pos := offset + i
+		rest, offset = rest[i+len("stream"):], pos+len("stream")
+
+		// Already past the stream data
+		if pos > 0 && content[pos-1] == 'd' {
+			continue
+		}
+
+		dictStart := bytes.LastIndex(content[:pos], []byte("obj"))
+
+		if dictStart < 0 {
+			continue
+		}
+
+		dict := content[dictStart:pos]
+		start := offset
+
+		if bytes.HasPrefix(content[start:], []byte("\r\n")) {
+			start += 2
+		} else if bytes.HasPrefix(content[start:], []byte("\n")) {
+			start++
+		}
+
+		end := bytes.Index(content[start:], []byte("endstream"))
+
+		if end < 0 {
+			break
+		}
+
+		data := content[start : start+end]
+		rest, offset = content[start+end+len("endstream"):], start+end+len("endstream")
+
+		if bytes.Contains(dict, []byte("/Type")) || bytes.Contains(dict, []byte("/Subtype")) || bytes.Contains(dict, []byte("/Length1")) {
+			continue
+		}
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+
+			if err != nil {
+				continue
+			}
+
+			// Truncated streams still give their beginning
+			data, _ = ioutil.ReadAll(io.LimitReader(zr, budget))
+			budget -= int64(len(data))
+			zr.Close()
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+
+		pdfContentText(data, &out)
+
+		if budget <= 0 {
+			break
+		}
+	}
+
+	return out.String(), nil
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/% \t\r\n\f\x00", c) >= 0
+}
+
+// pdfContentText writes the strings shown by a content stream
+func pdfContentText(b []byte, out *strings.Builder) {
+	var shown []string
+	inText, inArray := false, false
+
+	for i := 0; i < len(b); {
+		c := b[i]
+
+		switch {
+		case c == '(':
+			s, n := pdfLiteral(b[i:])
+			shown = append(shown, s)
+			i += n
+		case c == '<' && i+1 < len(b) && b[i+1] != '<':
+			s, n := pdfHex(b[i:])
+			shown = append(shown, s)
+			i += n
+		case c == '%':
+			for i < len(b) && b[i] != '\n' && b[i] != '\r' {
+				i++
+			}
+		case c == '[':
+			inArray = true
+			i++
+		case c == ']':
+			inArray = false
+			i++
+		case c == '/':
+			i++
+
+			for i < len(b) && !isPDFDelimiter(b[i]) {
+				i++
+			}
+		case isPDFDelimiter(c):
+			i++
+		default:
+			j := i
+
+			for j < len(b) && !isPDFDelimiter(b[j]) {
+				j++
+			}
+
+			token := string(b[i:j])
+			i = j
+
+			if n, err := strconv.ParseFloat(token, 64); err == nil {
+				if inArray && n < -200 {
+					shown = append(shown, " ")
+				}
+
+				continue
+			}
+
+			switch token {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				out.WriteByte('\n')
+			case "Tj", "TJ", "'", `"`:
+				if inText {
+					if token != "Tj" && token != "TJ" {
+						out.WriteByte('\n')
+					}
+
+					for _, s := range shown {
+						out.WriteString(s)
+					}
+				}
+			case "Td", "TD", "Tm", "T*":
+				if inText {
+					out.WriteByte(' ')
+				}
+			}
+
+			shown = nil
+		}
+	}
+}
+
+// latin1 decodes PDFDocEncoding, close enough to Latin-1 for text
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+
+	return string(runes)
+}
+
+// pdfLiteral decodes a (string), it returns the text and the bytes read
+func pdfLiteral(b []byte) (string, int) {
+	var s []byte
+	depth := 0
+	i := 0
+
+	for ; i < len(b); i++ {
+		c := b[i]
+
+		switch c {
+		case '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+
+			depth++
+		case ')':
+			depth--
+
+			if depth == 0 {
+				return latin1(s), i + 1
+			}
+
+			s = append(s, c)
+		case '\\':
+			i++
+
+			if i == len(b) {
+				break
+			}
+
+			switch e := b[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+				if e == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+					i++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					n := 0
+					j := i
+
+					for ; j < len(b) && j < i+3 && b[j] >= '0' && b[j] <= '7'; j++ {
+						n = n*8 + int(b[j]-'0')
+					}
+
+					s = append(s, byte(n))
+					i = j - 1
+				} else {
+					s = append(s, e)
+				}
+			}
+		default:
+			s = append(s, c)
+		}
+	}
+
+	return latin1(s), i
+}
+
+// pdfHex decodes a <hex string>, which is skipped unless it looks like text
+func pdfHex(b []byte) (string, int) {
+	end := bytes.IndexByte(b, '>')
+
+	if end < 0 {
+		return "", len(b)
+	}
+
+	var digits []byte
+
+	for _, c := range b[1:end] {
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+	}
+
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	s := make([]byte, len(digits)/2)
+
+	for i := range s {
+		n, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		s[i] = byte(n)
+
+		if s[i] < 0x20 && s[i] != '\t' && s[i] != '\n' && s[i] != '\r' {
+			return "", end + 1
+		}
+	}
+
+	return latin1(s), end + 1
+}
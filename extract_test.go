@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func zipped(t *testing.T, files map[string]string) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+
+	for name, content := range files {
+		f, err := w.Create(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte(content))
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func pdf(streams ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n")
+
+	for i, s := range streams {
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write([]byte(s))
+		w.Close()
+
+		if i%2 == 0 {
+			b.WriteString("2 0 obj << /Length 10 /Filter /FlateDecode >>\nstream\n")
+			b.Write(z.Bytes())
+		} else {
+			b.WriteString("3 0 obj << /Length 10 >>\nstream\r\n" + s)
+		}
+
+		b.WriteString("\nendstream\nendobj\n")
+	}
+
+	// Images are not read
+	b.WriteString("4 0 obj << /Subtype /Image >>\nstream\nBT (hidden) Tj ET\nendstream\nendobj\n%%EOF")
+
+	return b.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	for name, test := range map[string]struct {
+		content  []byte
+		expected string
+	}{
+		"notes.md":  {[]byte("# Title\n\n  Some   *notes*\n"), "# Title Some *notes*"},
+		"page.html": {[]byte("<html><head><style>p {}</style><script>var a = '<b>';</script></head><body><p>Caf&eacute; &amp; <b>bar</b></p><!-- no --></body></html>"), "Café & bar"},
+		"doc.docx": {zipped(t, map[string]string{
+			"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:t xml:space="preserve"> world</w:t></w:r></w:p><w:p><w:r><w:t>Second</w:t></w:r></w:p></w:body></w:document>`,
+			"word/styles.xml":   `<w:styles xmlns:w="w"><w:t>ignored</w:t></w:styles>`,
+		}), "Hello world Second"},
+		"sheet.xlsx": {zipped(t, map[string]string{
+			"xl/sharedStrings.xml": `<sst><si><t>Name</t></si><si><r><t>Tot</t></r><r><t>al</t></r></si></sst>`,
+		}), "Name Total"},
+		"slides.pptx": {zipped(t, map[string]string{
+			"ppt/slides/slide10.xml": `<p:sld xmlns:a="a" xmlns:p="p"><a:p><a:r><a:t>Last</a:t></a:r></a:p></p:sld>`,
+			"ppt/slides/slide2.xml":  `<p:sld xmlns:a="a" xmlns:p="p"><a:p><a:r><a:t>First</a:t></a:r></a:p></p:sld>`,
+		}), "First Last"},
+		"report.pdf": {pdf(
+			"BT /F1 12 Tf 72 712 Td (Quarterly \\(Q1\\) report) Tj ET",
+			"BT [(Re) -30 (venue) -300 (up)] TJ 0 -14 Td <4F6B> Tj <0001> Tj ET",
+		), "Quarterly (Q1) report Revenue up Ok"},
+	} {
+		got, err := extractText(name, test.content)
+
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if got != test.expected {
+			t.Errorf("%s: expected %q, got %q", name, test.expected, got)
+		}
+	}
+
+	if _, err := extractText("photo.jpg", nil); err != errUnsupportedFormat {
+		t.Errorf("Expected unsupported format, got %v", err)
+	}
+
+	if _, err := extractText("broken.docx", []byte("not a zip")); err == nil {
+		t.Error("Broken document extracted")
+	}
+
+	long := strings.Repeat("é", maxExtractedText)
+
+	if got, _ := extractText("long.txt", []byte(long)); len(got) > maxExtractedText || !strings.HasPrefix(long, got) {
+		t.Errorf("Text not truncated on a character, %d bytes", len(got))
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	text := strings.Repeat("filler ", 20) + "the <Budget> for 2024 " + strings.Repeat("filler ", 20) + "budget again"
+	got := snippets(text, searchTerms(`"budget" -draft`))
+
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 snippets, got %q", got)
+	}
+
+	if !strings.Contains(got[0], "the &lt;<mark>Budget</mark>&gt; for 2024") || !strings.HasPrefix(got[0], "…") || !strings.HasSuffix(got[0], "…") {
+		t.Errorf("Wrong snippet %q", got[0])
+	}
+
+	if !strings.HasSuffix(got[1], "<mark>budget</mark> again") {
+		t.Errorf("Wrong snippet %q", got[1])
+	}
+
+	if got := searchTerms(`"annual report" -draft`); !reflect.DeepEqual(got, []string{"annual", "report"}) {
+		t.Errorf("Wrong terms %q", got)
+	}
+}
@@ -1,22 +1,130 @@
 package main
 
 import (
-	"errors"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"log"
-	"mime/multipart"
+	"mime"
+	"net/http"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Bytes read to guess the type of a file
+const sniffLength = 512
+
 type File struct {
 	Name   string        `bson:"name" json:"name"`
 	FileID bson.ObjectId `bson:"file_id" json:"-"`
 	Rights *Right        `bson:"rights,omitempty" json:"rights,omitempty"`
+	Tags   []string      `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Bytes
+	Size     int64  `bson:"size" json:"size"`
+	MimeType string `bson:"mime_type,omitempty" json:"mime_type,omitempty"`
+	// Unix time, moves and copies keep those of the source
+	Created  int64 `bson:"created,omitempty" json:"created,omitempty"`
+	Modified int64 `bson:"modified,omitempty" json:"modified,omitempty"`
+	// Emails, unknown for files uploaded before they were recorded
+	Creator  string `bson:"creator,omitempty" json:"creator,omitempty"`
+	Modifier string `bson:"modifier,omitempty" json:"modifier,omitempty"`
+}
+
+// sniffMimeType guesses the type of a file from its first bytes, then from its extension
+func sniffMimeType(name string, head []byte) string {
+	t := http.DetectContentType(head)
+
+	if t == "application/octet-stream" {
+		if byExt := mime.TypeByExtension("." + extension(name)); byExt != "" {
+			t = byExt
+		}
+	}
+
+	return t
+}
+
+// newFile returns the entry of a GridFS file created by the user, its size, type and time being those of GridFS
+func newFile(name string, id bson.ObjectId, email string) File {
+	f := File{Name: name, FileID: id, Creator: email, Modifier: email}
+
+	var gf struct {
+		Length      int64     `bson:"length"`
+		ContentType string    `bson:"contentType"`
+		UploadDate  time.Time `bson:"uploadDate"`
+	}
+
+	if err := db.C("fs.files").FindId(id).One(&gf); err == nil {
+		f.Size, f.MimeType, f.Created = gf.Length, gf.ContentType, gf.UploadDate.Unix()
+	} else {
+		f.Created = time.Now().Unix()
+	}
+
+	f.Modified = f.Created
+
+	return f
+}
+
+// ensureFileMetadata fills in the metadata of files stored before it was recorded
+func ensureFileMetadata() {
+	iter := db.C("folders").Find(bson.M{"files": bson.M{"$elemMatch": bson.M{"created": bson.M{"$exists": false}}}}).Iter()
+	var folder Folder
+	filled := 0
+
+	for iter.Next(&folder) {
+		for _, f := range folder.Files {
+			if f.Created != 0 {
+				continue
+			}
+
+			e := newFile(f.Name, f.FileID, "")
+
+			// GridFS did not record types either
+			if e.MimeType == "" {
+				if gf, err := db.GridFS("fs").OpenId(f.FileID); err == nil {
+					head := make([]byte, sniffLength)
+					read, _ := io.ReadFull(gf, head)
+					e.MimeType = sniffMimeType(f.Name, head[:read])
+					gf.Close()
+				}
+			}
+
+			var s SearchEntry
+
+			if err := db.C(searchCollection).FindId(newSearchEntry(folder.Path, f.Name).Path).One(&s); err == nil {
+				e.Creator, e.Modifier = s.Uploader, s.Uploader
+			}
+
+			update := bson.M{
+				"files.$.size":      e.Size,
+				"files.$.mime_type": e.MimeType,
+				"files.$.created":   e.Created,
+				"files.$.modified":  e.Modified,
+			}
+
+			if e.Creator != "" {
+				update["files.$.creator"], update["files.$.modifier"] = e.Creator, e.Modifier
+			}
+
+			if err := db.C("folders").Update(bson.M{"path": folder.Path, "files.name": f.Name}, bson.M{"$set": update}); err != nil {
+				log.Printf("Cannot fill in the metadata of %s: %s\n", f.Name, err)
+				continue
+			}
+
+			filled++
+		}
+
+		folder = Folder{}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.Printf("Cannot fill in the metadata of files: %s\n", err)
+	} else if filled > 0 {
+		logInfo("Metadata filled in for %d files\n", filled)
+	}
 }
 
-func (m *Miogo) CreateGFSFile(name string, file multipart.File) (bson.ObjectId, error) {
+func (m *Miogo) CreateGFSFile(name string, file io.Reader) (bson.ObjectId, error) {
 	gf, err := db.GridFS("fs").Create(name)
 
 	if err != nil {
@@ -24,8 +132,27 @@ func (m *Miogo) CreateGFSFile(name string, file multipart.File) (bson.ObjectId,
 		return bson.NewObjectId(), err
 	}
 
-	_, err = io.Copy(gf, file)
-	gf.Close()
+	head := make([]byte, sniffLength)
+	read, err := io.ReadFull(file, head)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	gf.SetContentType(sniffMimeType(name, head[:read]))
+
+	var n int64
+
+	if err == nil {
+		n, err = io.Copy(gf, io.MultiReader(bytes.NewReader(head[:read]), file))
+	}
+
+	// Chunks are flushed on close, which can fail as well
+	if cerr := gf.Close(); err == nil {
+		err = cerr
+	}
+
+	m.metrics.AddGridFSWritten(n)
 
 	gfId := gf.Id().(bson.ObjectId)
 	db.C("fs.files").Update(bson.M{"_id": gfId}, bson.M{"$set": bson.M{"links": 1}})
@@ -40,60 +167,68 @@ func (m *Miogo) CreateGFSFile(name string, file multipart.File) (bson.ObjectId,
 func (m *Miogo) FetchFile(path string) (*File, bool) {
 	path = formatD(path)
 
-	if val, ok := m.filesCache.Get(path); ok {
-		return val.(*File), true
-	}
+	val, _ := m.filesCache.GetOrLoad(path, func() (interface{}, error) {
+		d, f := formatF(path)
+		query := db.C("folders").Find(bson.M{"path": d, "files.name": f}).
+			Select(bson.M{"files": bson.M{"$elemMatch": bson.M{"name": f}}})
 
-	d, f := formatF(path)
-	query := db.C("folders").Find(bson.M{"path": d, "files.name": f}).
-		Select(bson.M{"files": bson.M{"$elemMatch": bson.M{"name": f}}})
+		if count, err := query.Count(); count > 0 && err == nil {
+			var folder Folder
+			query.One(&folder)
 
-	if count, err := query.Count(); count > 0 && err == nil {
-		var folder Folder
-		query.One(&folder)
+			return &folder.Files[0], nil
+		}
 
-		m.filesCache.Set(path, &folder.Files[0])
+		return nil, nil
+	})
 
-		return &folder.Files[0], true
+	if val == nil {
+		return nil, false
 	}
 
-	return nil, false
+	return val.(*File), true
 }
 
 func (m *Miogo) FetchFileContent(path string, destination io.Writer, user *User) error {
 	if file, ok := m.FetchFile(path); ok {
 		if GetRightType(user, file.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 
-		if val, ok := m.filesContentCache.Get(path); ok {
-			_, err := destination.Write(val.([]byte))
-			return err
-		}
+		// Small files are buffered once for every concurrent request, big ones are streamed to each of them
+		val, err := m.filesContentCache.GetOrLoad(path, func() (interface{}, error) {
+			gfsfile, err := db.GridFS("fs").OpenId(file.FileID)
 
-		gfsfile, err := db.GridFS("fs").OpenId(file.FileID)
+			if err != nil {
+				log.Printf("Cannot get file from GridFS (%s): %s\n", file.FileID.String(), err)
+				return nil, err
+			}
 
-		if err != nil {
-			log.Printf("Cannot get file from GridFS (%s): %s\n", file.FileID.String(), err)
-			return err
-		}
+			defer gfsfile.Close()
 
-		defer gfsfile.Close()
+			if gfsfile.Size() >= megabytes(m.conf.Limits.ContentBufferSize) {
+				return nil, nil
+			}
 
-		// If the file is too big, use a buffer
-		if gfsfile.Size() < 64<<20 {
 			b, err := ioutil.ReadAll(gfsfile)
+			m.metrics.AddGridFSRead(int64(len(b)))
 
 			if err != nil {
 				log.Printf("Cannot read from GridFS: %s\n", err)
-				return err
+				return nil, err
 			}
 
-			m.filesContentCache.Set(path, b)
+			return b, nil
+		})
+
+		if err != nil {
+			return err
+		}
 
-			_, err = destination.Write(b)
+		if val != nil {
+			_, err = destination.Write(val.([]byte))
 		} else {
-			_, err = io.Copy(destination, gfsfile)
+			err = m.streamGFSFile(file.FileID, destination)
 		}
 
 		if err != nil {
@@ -103,7 +238,23 @@ func (m *Miogo) FetchFileContent(path string, destination io.Writer, user *User)
 		return err
 	}
 
-	return errors.New("File not found")
+	return errFileNotFound
+}
+
+func (m *Miogo) streamGFSFile(id bson.ObjectId, destination io.Writer) error {
+	gfsfile, err := db.GridFS("fs").OpenId(id)
+
+	if err != nil {
+		log.Printf("Cannot get file from GridFS (%s): %s\n", id.String(), err)
+		return err
+	}
+
+	defer gfsfile.Close()
+
+	n, err := io.Copy(destination, gfsfile)
+	m.metrics.AddGridFSRead(n)
+
+	return err
 }
 
 func (m *Miogo) RemoveFile(path string) error {
@@ -116,22 +267,23 @@ func (m *Miogo) RemoveFile(path string) error {
 		if linksNumber["links"] == 0 {
 			if err := db.GridFS("fs").RemoveId(file.FileID); err != nil {
 				log.Printf("RemoveId (GridFS) failed for FileID '%s' (%s)\n", file.FileID.String(), path)
-				return errors.New("Error when removing file")
+				return errFailure
 			}
 		}
 
 		d, f := formatF(path)
 		if err := db.C("folders").Update(bson.M{"path": d}, bson.M{"$pull": bson.M{"files": bson.M{"name": f}}}); err != nil {
-			return errors.New("Error when removing file")
+			return errFailure
 		}
 
 		m.filesCache.Invalidate(path)
 		m.filesContentCache.Invalidate(path)
 		m.foldersCache.Invalidate(d)
+		unindexFile(path)
 
 		return nil
 	} else {
-		return errors.New("File does not exist")
+		return errFileNotFound
 	}
 
 	return nil
@@ -143,19 +295,19 @@ func (m *Miogo) CopyFile(path, dest, destFilename string, u *User) error {
 	var parentFolderPath = parentD(dest)
 	if parentFolder, ok := m.FetchFolder(parentFolderPath); ok {
 		if GetRightType(u, parentFolder.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 	} else {
-		return errors.New("Destination folder does not exist")
+		return errFolderMissing.WithDetails("path", parentFolderPath)
 	}
 	var ok bool
 	var sourceFile *File
 	if sourceFile, ok = m.FetchFile(path); ok {
 		if GetRightType(u, sourceFile.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 	} else {
-		return errors.New("Source file does not exist")
+		return errFileNotFound
 	}
 
 	gfId := sourceFile.FileID
@@ -165,10 +317,14 @@ func (m *Miogo) CopyFile(path, dest, destFilename string, u *User) error {
 	if _, ok := m.FetchFile(dest + "/" + destFilename); ok {
 		destFilename = destFilename + "(DUPLICATE)"
 	}
-	err := db.C("folders").Update(bson.M{"path": dest}, bson.M{"$push": bson.M{"files": bson.M{"name": destFilename, "file_id": gfId}}})
+	// Copies keep the metadata and tags of their source, but not its rights
+	entry := *sourceFile
+	entry.Name, entry.Rights = destFilename, nil
+	err := db.C("folders").Update(bson.M{"path": dest}, bson.M{"$push": bson.M{"files": entry}})
 	if err == nil {
 		db.C("fs.files").Update(bson.M{"_id": gfId}, bson.M{"$inc": bson.M{"links": 1}})
+		copyIndexEntry(path, dest, destFilename, gfId)
 		return nil
 	}
-	return errors.New("Error when copying file")
+	return errFailure
 }
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 
 	"github.com/valyala/fasthttp"
 	"gopkg.in/mgo.v2/bson"
@@ -10,23 +10,120 @@ import (
 
 func (m *Miogo) GetFile(ctx *fasthttp.RequestCtx, u *User) error {
 	path := formatD(string(ctx.FormValue("path")))
+
+	// Content never changes for a given GridFS file, let browsers and proxies revalidate with its ID
+	if file, ok := m.FetchFile(path); ok && GetRightType(u, file.Rights) >= AllowedToRead {
+		etag := `"` + file.FileID.Hex() + `"`
+		ctx.Response.Header.Set("ETag", etag)
+		ctx.Response.Header.Set("Cache-Control", "private, no-cache")
+
+		if string(ctx.Request.Header.Peek("If-None-Match")) == etag {
+			ctx.SetStatusCode(fasthttp.StatusNotModified)
+			return nil
+		}
+	}
+
 	return m.FetchFileContent(path, ctx.Response.BodyWriter(), u)
 }
 
+// PutFile stores the request body as the file at path, replacing its content if it exists
+func (m *Miogo) PutFile(ctx *fasthttp.RequestCtx, u *User) error {
+	path := formatD(string(ctx.FormValue("path")))
+	dir, name := formatF(path)
+
+	if folder, ok := m.FetchFolder(dir); !ok {
+		return errFolderMissing.WithDetails("path", dir)
+	} else if GetRightType(u, folder.Rights) < AllowedToWrite {
+		return errAccessDenied
+	}
+
+	if _, ok := m.FetchFolder(path); ok || name == "" {
+		return errFolderExists
+	}
+
+	existing, replace := m.FetchFile(path)
+
+	if replace && GetRightType(u, existing.Rights) < AllowedToWrite {
+		return errAccessDenied
+	}
+
+	id, err := m.CreateGFSFile(name, bytes.NewReader(ctx.Request.Body()))
+
+	if err != nil {
+		db.GridFS("fs").RemoveId(id)
+
+		if isStorageFull(err) {
+			return errStorageFull
+		}
+
+		return errFailure
+	}
+
+	entry := newFile(name, id, u.Email)
+
+	if replace {
+		if err := m.RemoveFile(path); err != nil {
+			db.GridFS("fs").RemoveId(id)
+			return err
+		}
+
+		// Only the content changes
+		entry.Rights, entry.Tags = existing.Rights, existing.Tags
+
+		if existing.Created != 0 {
+			entry.Created, entry.Creator = existing.Created, existing.Creator
+		}
+	}
+
+	if err := db.C("folders").Update(bson.M{"path": dir}, bson.M{"$push": bson.M{"files": entry}}); err != nil {
+		db.GridFS("fs").RemoveId(id)
+		return errFailure
+	}
+
+	m.foldersCache.Invalidate(dir)
+
+	if replace {
+		indexFile(dir, name, id, u.Email, existing.Tags)
+		m.recordActivity(u, ActivityUpdate, dir, []string{name}, "")
+	} else {
+		indexFile(dir, name, id, u.Email, nil)
+		m.recordActivity(u, ActivityUpload, dir, []string{name}, "")
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+	}
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
 func (m *Miogo) Move(ctx *fasthttp.RequestCtx, u *User) error {
-	err := m.Copy(ctx, u)
+	err := m.copy(ctx, u)
 	if err != nil {
 		return err
 	}
-	err = m.Remove(ctx, u)
+	err = m.remove(ctx, u)
 	if err != nil {
 		return err
 	}
+	m.recordCopy(ctx, u, ActivityMove)
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
 
 func (m *Miogo) Copy(ctx *fasthttp.RequestCtx, u *User) error {
+	if err := m.copy(ctx, u); err != nil {
+		return err
+	}
+	m.recordCopy(ctx, u, ActivityCopy)
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+func (m *Miogo) recordCopy(ctx *fasthttp.RequestCtx, u *User, action string) {
+	dir, name := formatF(string(ctx.FormValue("path")))
+	m.recordActivity(u, action, dir, []string{name}, formatD(string(ctx.FormValue("destination"))))
+}
+
+func (m *Miogo) copy(ctx *fasthttp.RequestCtx, u *User) error {
 	path := formatD(string(ctx.FormValue("path")))
 	dest := formatD(string(ctx.FormValue("destination")))
 	destFilename := formatD(string(ctx.FormValue("destFilename")))
@@ -40,7 +137,7 @@ func (m *Miogo) Copy(ctx *fasthttp.RequestCtx, u *User) error {
 	var err error
 	if folder, ok := m.FetchFolder(path); ok {
 		if GetRightType(u, folder.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 		if destFilename == "/" {
 			_, destFilename = formatF(path)
@@ -48,41 +145,47 @@ func (m *Miogo) Copy(ctx *fasthttp.RequestCtx, u *User) error {
 		err = m.CopyFolder(path, dest, destFilename, u)
 	} else if file, okf := m.FetchFile(path); okf {
 		if GetRightType(u, file.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 		err = m.CopyFile(path, dest, destFilename, u)
+	} else {
+		err = errResourceNotFound
 	}
-	if err != nil {
+	return err
+}
+
+func (m *Miogo) Remove(ctx *fasthttp.RequestCtx, u *User) error {
+	if err := m.remove(ctx, u); err != nil {
 		return err
 	}
+	dir, name := formatF(string(ctx.FormValue("path")))
+	m.recordActivity(u, ActivityRemove, dir, []string{name}, "")
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
 
-func (m *Miogo) Remove(ctx *fasthttp.RequestCtx, u *User) error {
+func (m *Miogo) remove(ctx *fasthttp.RequestCtx, u *User) error {
 	path := formatD(string(ctx.FormValue("path")))
 	var err error
 	if folder, ok := m.FetchFolder(path); ok {
 		if GetRightType(u, folder.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 		err = m.RemoveFolder(path, u)
 	} else if file, okf := m.FetchFile(path); okf {
 		if GetRightType(u, file.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 		parentFolderPath, _ := formatF(path)
 		parentFolder, _ := m.FetchFolder(parentFolderPath)
 		if GetRightType(u, parentFolder.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 		err = m.RemoveFile(path)
+	} else {
+		err = errResourceNotFound
 	}
-	if err != nil {
-		return err
-	}
-	ctx.SetBodyString(jsonkv("success", "true"))
-	return nil
+	return err
 }
 
 func (m *Miogo) GetFolder(ctx *fasthttp.RequestCtx, u *User) error {
@@ -90,7 +193,14 @@ func (m *Miogo) GetFolder(ctx *fasthttp.RequestCtx, u *User) error {
 
 	if folder, ok := m.FetchFolder(path); ok {
 		if GetRightType(u, folder.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
+		}
+
+		// Listing children can be skipped, the cached folder is shared so it is copied
+		if string(ctx.FormValue("children")) == "false" {
+			f := *folder
+			f.Files, f.Folders = nil, nil
+			folder = &f
 		}
 
 		res, _ := json.Marshal(folder)
@@ -98,7 +208,7 @@ func (m *Miogo) GetFolder(ctx *fasthttp.RequestCtx, u *User) error {
 		return nil
 	}
 
-	return errors.New("Folder does not exist")
+	return errFolderMissing
 }
 
 func (m *Miogo) NewFolder(ctx *fasthttp.RequestCtx, u *User) error {
@@ -106,20 +216,23 @@ func (m *Miogo) NewFolder(ctx *fasthttp.RequestCtx, u *User) error {
 
 	if folder, ok := m.FetchFolder(parentD(path)); ok {
 		if GetRightType(u, folder.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 	} else {
-		return errors.New("Bad folder name")
+		return NewError(fasthttp.StatusBadRequest, "bad_folder_name", "Bad folder name")
 	}
 
 	if _, exists := m.FetchFolder(path); exists {
-		return errors.New("Folder already exists")
+		return errFolderExists
 	}
 
 	m.foldersCache.Invalidate(parentD(path))
 
 	db.C("folders").Insert(bson.M{"path": path})
 
+	dir, name := formatF(path)
+	m.recordActivity(u, ActivityNewFolder, dir, []string{name}, "")
+
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
@@ -128,39 +241,48 @@ func (m *Miogo) Upload(ctx *fasthttp.RequestCtx, u *User) error {
 	form, err := ctx.MultipartForm()
 
 	if err != nil {
-		return errors.New("Bad request")
+		return errBadRequest
 	}
 
-	path := formatD(form.Value["path"][0])
+	path := formatD(string(ctx.FormValue("path")))
 
 	if folder, ok := m.FetchFolder(path); ok {
 		if GetRightType(u, folder.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 	} else {
-		return errors.New("Wrong path")
+		return errFolderMissing.WithDetails("path", path)
 	}
 
 	fb := NewFilesBulk(path)
+	fb.Uploader = u.Email
+	var names []string
 
 	for _, header := range form.File["file"] {
 		file, err := header.Open()
 
 		if err != nil {
-			return errors.New("Bad file header")
+			return errBadRequest
 		}
 
 		id, err := m.CreateGFSFile(header.Filename, file)
 
 		if err != nil {
 			fb.Revert()
-			return errors.New("Failure on our side")
+
+			if isStorageFull(err) {
+				return errStorageFull
+			}
+
+			return errFailure
 		}
 
 		fb.AddFile(id, header.Filename)
+		names = append(names, header.Filename)
 	}
 
 	m.PushFilesBulk(fb)
+	m.recordActivity(u, ActivityUpload, path, names, "")
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
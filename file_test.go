@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSniffMimeType(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		head     string
+		expected string
+	}{
+		{"notes.txt", "hello", "text/plain; charset=utf-8"},
+		{"page.html", "<!DOCTYPE html><html>", "text/html; charset=utf-8"},
+		{"report", "%PDF-1.4\n", "application/pdf"},
+		{"image.jpg", "\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+		{"doc.pdf", "\x00\x01\x02\x03", "application/pdf"},
+		{"unknown", "\x00\x01\x02\x03", "application/octet-stream"},
+		{"empty.txt", "", "text/plain; charset=utf-8"},
+	} {
+		if got := sniffMimeType(test.name, []byte(test.head)); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, got)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import "gopkg.in/mgo.v2/bson"
 type FilesBulk struct {
 	Files map[bson.ObjectId]string
 	Path  string
+	// Email recorded as the creator of the files and in the search index
+	Uploader string
 }
 
 func NewFilesBulk(path string) *FilesBulk {
@@ -26,9 +28,13 @@ func (m *Miogo) PushFilesBulk(fb *FilesBulk) {
 	bulk.Unordered()
 
 	for id, filename := range fb.Files {
-		bulk.Update(bson.M{"path": fb.Path}, bson.M{"$push": bson.M{"files": bson.M{"name": filename, "file_id": id}}})
+		bulk.Update(bson.M{"path": fb.Path}, bson.M{"$push": bson.M{"files": newFile(filename, id, fb.Uploader)}})
 	}
 
 	bulk.Run()
 	m.foldersCache.Invalidate(fb.Path)
+
+	for id, filename := range fb.Files {
+		indexFile(fb.Path, filename, id, fb.Uploader, nil)
+	}
 }
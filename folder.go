@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"regexp"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -14,26 +14,28 @@ type Folder struct {
 }
 
 func (m *Miogo) FetchFolder(path string) (*Folder, bool) {
-	if val, ok := m.foldersCache.Get(path); ok {
-		return val.(*Folder), ok
-	}
+	val, _ := m.foldersCache.GetOrLoad(path, func() (interface{}, error) {
+		query := db.C("folders").Find(bson.M{"path": path})
 
-	query := db.C("folders").Find(bson.M{"path": path})
+		if count, err := query.Count(); count > 0 && err == nil {
+			var folder Folder
+			query.One(&folder)
 
-	if count, err := query.Count(); count > 0 && err == nil {
-		var folder Folder
-		query.One(&folder)
+			var subfolders []Folder
+			db.C("folders").Find(bson.M{"path": bson.RegEx{"^" + path + "/*[^/]+$", ""}}).Select(bson.M{"path": 1}).All(&subfolders)
+			folder.Folders = append(folder.Folders, subfolders...)
 
-		var subfolders []Folder
-		db.C("folders").Find(bson.M{"path": bson.RegEx{"^" + path + "/*[^/]+$", ""}}).Select(bson.M{"path": 1}).All(&subfolders)
-		folder.Folders = append(folder.Folders, subfolders...)
+			return &folder, nil
+		}
 
-		m.foldersCache.Set(path, &folder)
+		return nil, nil
+	})
 
-		return &folder, true
+	if val == nil {
+		return nil, false
 	}
 
-	return nil, false
+	return val.(*Folder), true
 }
 
 func (m *Miogo) RemoveFolder(path string, u *User) error {
@@ -41,16 +43,16 @@ func (m *Miogo) RemoveFolder(path string, u *User) error {
 	var ok bool
 
 	if folder, ok = m.FetchFolder(path); !ok {
-		return errors.New("Folder to remove doesn't exist")
+		return errFolderMissing
 	}
 
 	if GetRightType(u, folder.Rights) < AllowedToWrite {
-		return errors.New("Access denied")
+		return errAccessDenied
 	}
 
 	for _, file := range folder.Files {
 		if GetRightType(u, file.Rights) < AllowedToWrite {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 
 		if err := m.RemoveFile(folder.Path + "/" + file.Name); err != nil {
@@ -66,14 +68,14 @@ func (m *Miogo) RemoveFolder(path string, u *User) error {
 		err := m.RemoveFolder(subFolder.Path, u)
 
 		if err != nil {
-			return errors.New("Cannot remove folder")
+			return errFailure
 		}
 
 		m.foldersCache.Invalidate(folder.Path)
 	}
 
 	if err := db.C("folders").Remove(bson.M{"path": path}); err != nil {
-		return errors.New("Cannot remove folder")
+		return errFailure
 	}
 
 	m.foldersCache.Invalidate(path)
@@ -97,10 +99,10 @@ func (m *Miogo) CopyFolder(path, dest, destFoldername string, u *User) error {
 
 	if sourceFolder, ok = m.FetchFolder(path); ok {
 		if GetRightType(u, sourceFolder.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 	} else {
-		return errors.New("Source folder does not exist")
+		return errFolderMissing.WithDetails("path", path)
 	}
 
 	if _, ok := m.FetchFolder(dest); ok {
@@ -108,12 +110,12 @@ func (m *Miogo) CopyFolder(path, dest, destFoldername string, u *User) error {
 			db.C("folders").Insert(bson.M{"path": destinationFolder})
 		}
 	} else {
-		return errors.New("Destination folder does not exist")
+		return errFolderMissing.WithDetails("path", dest)
 	}
 
 	for _, file := range sourceFolder.Files {
 		if GetRightType(u, file.Rights) < AllowedToRead {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 		m.CopyFile(sourceFolder.Path+"/"+file.Name, destinationFolder, file.Name, u)
 	}
@@ -133,3 +135,15 @@ func (m *Miogo) CopyFolder(path, dest, destFoldername string, u *User) error {
 
 	return nil
 }
+
+// subtree selects the documents whose field is the path or below it, nil meaning everything
+func subtree(field, path string) []bson.M {
+	if path == "/" {
+		return nil
+	}
+
+	return []bson.M{
+		{field: path},
+		{field: bson.RegEx{Pattern: "^" + regexp.QuoteMeta(path) + "/"}},
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
+	"regexp"
 	"strings"
 
 	"github.com/valyala/fasthttp"
@@ -9,34 +10,109 @@ import (
 )
 
 type Group struct {
-	Id     string `bson:"_id,omitempty" json:"id"`
-	Admins []User `bson:"admins" json:"admins,omitempty"`
+	Name   string   `bson:"_id" json:"name"`
+	Admins []string `bson:"admins,omitempty" json:"admins,omitempty"`
+	Groups []string `bson:"groups,omitempty" json:"groups,omitempty"`
 }
 
-func (m *Miogo) FetchGroup(name string) (*Group, bool) {
-	if val, ok := m.groupsCache.Get(name); ok {
-		return val.(*Group), ok
+/*
+ * Nested groups:
+ *   - A group belongs to the groups listed in Group.Groups, as a user does with User.Groups
+ *   - Memberships of a user are resolved transitively and cached in usersCache
+ *   - Any change of the hierarchy invalidates every cached membership
+ */
+
+const membershipsPrefix = "\x00memberships:"
+
+// expandGroups returns the given groups and every group they belong to
+func (m *Miogo) expandGroups(groups []string) []string {
+	visited := make(map[string]bool)
+	queue := append([]string{}, groups...)
+	var res []string
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		// Cycles cannot be created through AddGroupToGroup, but stay safe
+		if visited[name] {
+			continue
+		}
+
+		visited[name] = true
+		res = append(res, name)
+
+		if g, ok := m.FetchGroup(name); ok {
+			queue = append(queue, g.Groups...)
+		}
 	}
 
-	query := db.C("groups").Find(bson.M{"_id": name})
+	return res
+}
 
-	if count, err := query.Count(); count > 0 && err == nil {
-		var group Group
-		query.One(&group)
+func (m *Miogo) FetchMemberships(u *User) []string {
+	if val, ok := m.usersCache.Get(membershipsPrefix + u.Email); ok {
+		return val.([]string)
+	}
 
-		m.groupsCache.Set(name, &group)
+	memberships := m.expandGroups(u.Groups)
+	m.usersCache.Set(membershipsPrefix+u.Email, memberships)
+
+	return memberships
+}
 
-		return &group, true
+func (m *Miogo) invalidateMemberships(emails ...string) {
+	for _, email := range emails {
+		m.usersCache.Invalidate(membershipsPrefix + email)
+	}
+}
+
+// invalidateHierarchy must be called when a group is added to or removed from another one
+func (m *Miogo) invalidateHierarchy() {
+	m.groupsCache.InvalidateStartWith("")
+	m.usersCache.InvalidateStartWith(membershipsPrefix)
+}
+
+func canManageGroup(u *User, g *Group) bool {
+	if isAdmin(u) {
+		return true
 	}
 
-	return nil, false
+	for _, admin := range g.Admins {
+		if admin == u.Email {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Miogo) FetchGroup(name string) (*Group, bool) {
+	val, _ := m.groupsCache.GetOrLoad(name, func() (interface{}, error) {
+		query := db.C("groups").Find(bson.M{"_id": name})
+
+		if count, err := query.Count(); count > 0 && err == nil {
+			var group Group
+			query.One(&group)
+
+			return &group, nil
+		}
+
+		return nil, nil
+	})
+
+	if val == nil {
+		return nil, false
+	}
+
+	return val.(*Group), true
 }
 
 func (m *Miogo) NewGroup(ctx *fasthttp.RequestCtx, u *User) error {
 	name := strings.TrimSpace(string(ctx.FormValue("name")))
 
 	if _, exists := m.FetchGroup(name); exists {
-		return errors.New("Group already exists")
+		return errGroupExists
 	}
 
 	db.C("groups").Insert(bson.M{"_id": name})
@@ -47,9 +123,14 @@ func (m *Miogo) NewGroup(ctx *fasthttp.RequestCtx, u *User) error {
 
 func (m *Miogo) RemoveGroup(ctx *fasthttp.RequestCtx, u *User) error {
 	name := strings.TrimSpace(string(ctx.FormValue("name")))
+	g, exists := m.FetchGroup(name)
+
+	if !exists {
+		return errGroupNotFound
+	}
 
-	if _, exists := m.FetchGroup(name); !exists {
-		return errors.New("Group does not exist")
+	if !canManageGroup(u, g) {
+		return errAccessDenied
 	}
 
 	// Store users belonging to the group
@@ -65,8 +146,9 @@ func (m *Miogo) RemoveGroup(ctx *fasthttp.RequestCtx, u *User) error {
 	}
 	m.usersCache.Invalidate(ukeys...)
 
+	db.C("groups").UpdateAll(bson.M{"groups": name}, bson.M{"$pull": bson.M{"groups": name}})
 	db.C("groups").RemoveId(name)
-	m.groupsCache.Invalidate(name)
+	m.invalidateHierarchy()
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
@@ -77,17 +159,24 @@ func (m *Miogo) AddUserToGroup(ctx *fasthttp.RequestCtx, u *User) error {
 	user := strings.TrimSpace(string(ctx.FormValue("user")))
 	group := strings.TrimSpace(string(ctx.FormValue("group")))
 
-	if _, exists := m.FetchUser(user); !exists {
-		return errors.New("User does not exist")
+	g, exists := m.FetchGroup(group)
+
+	if !exists {
+		return errGroupNotFound
 	}
 
-	if _, exists := m.FetchGroup(group); !exists {
-		return errors.New("Group does not exist")
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	if _, exists := m.FetchUser(user); !exists {
+		return errUnknownUser
 	}
 
 	db.C("users").Update(bson.M{"email": user}, bson.M{"$addToSet": bson.M{"groups": group}})
 
 	m.usersCache.Invalidate(user)
+	m.invalidateMemberships(user)
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
@@ -97,17 +186,24 @@ func (m *Miogo) RemoveUserFromGroup(ctx *fasthttp.RequestCtx, u *User) error {
 	user := strings.TrimSpace(string(ctx.FormValue("user")))
 	group := strings.TrimSpace(string(ctx.FormValue("group")))
 
-	if _, exists := m.FetchUser(user); !exists {
-		return errors.New("User does not exist")
+	g, exists := m.FetchGroup(group)
+
+	if !exists {
+		return errGroupNotFound
 	}
 
-	if _, exists := m.FetchGroup(group); !exists {
-		return errors.New("Group does not exist")
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	if _, exists := m.FetchUser(user); !exists {
+		return errUnknownUser
 	}
 
 	db.C("users").Update(bson.M{"email": user}, bson.M{"$pull": bson.M{"groups": group}})
 
 	m.usersCache.Invalidate(user)
+	m.invalidateMemberships(user)
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
@@ -117,15 +213,264 @@ func (m *Miogo) SetGroupAdmin(ctx *fasthttp.RequestCtx, u *User) error {
 	user := strings.TrimSpace(string(ctx.FormValue("user")))
 	group := strings.TrimSpace(string(ctx.FormValue("group")))
 
-	if _, exists := m.FetchUser(user); !exists {
-		return errors.New("User does not exist")
+	g, exists := m.FetchGroup(group)
+
+	if !exists {
+		return errGroupNotFound
 	}
 
-	if _, exists := m.FetchGroup(group); !exists {
-		return errors.New("Group does not exist")
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	if _, exists := m.FetchUser(user); !exists {
+		return errUnknownUser
 	}
 
 	db.C("groups").Update(bson.M{"_id": group}, bson.M{"$addToSet": bson.M{"admins": user}})
+	m.groupsCache.Invalidate(group)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+func (m *Miogo) RemoveGroupAdmin(ctx *fasthttp.RequestCtx, u *User) error {
+	user := strings.TrimSpace(string(ctx.FormValue("user")))
+	group := strings.TrimSpace(string(ctx.FormValue("group")))
+
+	g, exists := m.FetchGroup(group)
+
+	if !exists {
+		return errGroupNotFound
+	}
+
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	if err := db.C("groups").Update(bson.M{"_id": group, "admins": user}, bson.M{"$pull": bson.M{"admins": user}}); err != nil {
+		return NewError(fasthttp.StatusConflict, "not_group_admin", "User is not an admin of the group")
+	}
+
+	m.groupsCache.Invalidate(group)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+func (m *Miogo) ListGroups(ctx *fasthttp.RequestCtx, u *User) error {
+	selector := bson.M{}
+
+	if search := strings.TrimSpace(string(ctx.FormValue("search"))); search != "" {
+		selector["_id"] = bson.RegEx{Pattern: regexp.QuoteMeta(search), Options: "i"}
+	}
+
+	page, perPage := pagination(ctx)
+	query := db.C("groups").Find(selector)
+	total, err := query.Count()
+
+	if err != nil {
+		return errFailure
+	}
+
+	groups := []Group{}
+	query.Sort("_id").Skip((page - 1) * perPage).Limit(perPage).All(&groups)
+
+	res, _ := json.Marshal(GroupPage{groups, total, page, perPage})
+
+	ctx.SetBody(res)
+	return nil
+}
+
+type GroupPage struct {
+	Groups  []Group `json:"groups"`
+	Total   int     `json:"total"`
+	Page    int     `json:"page"`
+	PerPage int     `json:"per_page"`
+}
+
+type GroupDetails struct {
+	*Group
+	Members   []string `json:"members"`
+	Subgroups []string `json:"subgroups"`
+}
+
+func (m *Miogo) GetGroup(ctx *fasthttp.RequestCtx, u *User) error {
+	name := strings.TrimSpace(string(ctx.FormValue("name")))
+
+	g, exists := m.FetchGroup(name)
+
+	if !exists {
+		return errGroupNotFound
+	}
+
+	var users []User
+	db.C("users").Find(bson.M{"groups": name}).Select(bson.M{"email": 1}).Sort("email").All(&users)
+
+	members := []string{}
+	for _, user := range users {
+		members = append(members, user.Email)
+	}
+
+	var groups []Group
+	db.C("groups").Find(bson.M{"groups": name}).Select(bson.M{"_id": 1}).Sort("_id").All(&groups)
+
+	subgroups := []string{}
+	for _, group := range groups {
+		subgroups = append(subgroups, group.Name)
+	}
+
+	res, _ := json.Marshal(GroupDetails{g, members, subgroups})
+
+	ctx.SetBody(res)
+	return nil
+}
+
+// renameEntityRights renames a group in a list of rights, it returns true if something changed
+func renameEntityRights(r *Right, oldName, newName string) bool {
+	if r == nil {
+		return false
+	}
+
+	changed := false
+
+	for i := range r.Groups {
+		if r.Groups[i].Name == oldName {
+			r.Groups[i].Name = newName
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (m *Miogo) RenameGroup(ctx *fasthttp.RequestCtx, u *User) error {
+	name := strings.TrimSpace(string(ctx.FormValue("name")))
+	newName := strings.TrimSpace(string(ctx.FormValue("new_name")))
+
+	g, exists := m.FetchGroup(name)
+
+	if !exists {
+		return errGroupNotFound
+	}
+
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	if newName == "" {
+		return NewError(fasthttp.StatusBadRequest, "bad_group_name", "Bad group name")
+	}
+
+	if _, exists := m.FetchGroup(newName); exists {
+		return errGroupExists
+	}
+
+	// A document ID cannot be changed, so the group is copied then removed
+	if err := db.C("groups").Insert(&Group{Name: newName, Admins: g.Admins, Groups: g.Groups}); err != nil {
+		return errGroupExists
+	}
+
+	db.C("groups").RemoveId(name)
+	db.C("groups").UpdateAll(bson.M{"groups": name}, bson.M{"$set": bson.M{"groups.$": newName}})
+	m.invalidateHierarchy()
+
+	var users []User
+	db.C("users").Find(bson.M{"groups": name}).Select(bson.M{"email": 1}).All(&users)
+	db.C("users").UpdateAll(bson.M{"groups": name}, bson.M{"$set": bson.M{"groups.$": newName}})
+
+	for _, user := range users {
+		m.usersCache.Invalidate(user.Email)
+		m.invalidateUserSessions(user.Email)
+	}
+
+	// Folder rights are renamed in place, one entry of each folder at a time
+	changed := false
+
+	for {
+		info, err := db.C("folders").UpdateAll(bson.M{"rights.groups.name": name}, bson.M{"$set": bson.M{"rights.groups.$.name": newName}})
+
+		if err != nil || info.Updated == 0 {
+			break
+		}
+
+		changed = true
+	}
+
+	// Rights of files are nested in folders, only the files changed are written so that concurrent changes are kept
+	var folders []Folder
+	db.C("folders").Find(bson.M{"files.rights.groups.name": name}).Select(bson.M{"path": 1, "files": 1}).All(&folders)
+
+	for _, folder := range folders {
+		for _, f := range folder.Files {
+			if renameEntityRights(f.Rights, name, newName) {
+				db.C("folders").Update(bson.M{"path": folder.Path, "files.name": f.Name}, bson.M{"$set": bson.M{"files.$.rights": f.Rights}})
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		m.foldersCache.InvalidateStartWith("")
+		m.filesCache.InvalidateStartWith("")
+	}
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+func (m *Miogo) AddGroupToGroup(ctx *fasthttp.RequestCtx, u *User) error {
+	subgroup := strings.TrimSpace(string(ctx.FormValue("subgroup")))
+	group := strings.TrimSpace(string(ctx.FormValue("group")))
+
+	if _, exists := m.FetchGroup(subgroup); !exists {
+		return errGroupNotFound
+	}
+
+	g, exists := m.FetchGroup(group)
+
+	if !exists {
+		return errGroupNotFound
+	}
+
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	// The subgroup must not already contain the group, even indirectly
+	for _, ancestor := range m.expandGroups([]string{group}) {
+		if ancestor == subgroup {
+			return NewError(fasthttp.StatusConflict, "group_cycle", "Groups cannot contain each other")
+		}
+	}
+
+	db.C("groups").Update(bson.M{"_id": subgroup}, bson.M{"$addToSet": bson.M{"groups": group}})
+	m.invalidateHierarchy()
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+func (m *Miogo) RemoveGroupFromGroup(ctx *fasthttp.RequestCtx, u *User) error {
+	subgroup := strings.TrimSpace(string(ctx.FormValue("subgroup")))
+	group := strings.TrimSpace(string(ctx.FormValue("group")))
+
+	if _, exists := m.FetchGroup(subgroup); !exists {
+		return errGroupNotFound
+	}
+
+	g, exists := m.FetchGroup(group)
+
+	if !exists {
+		return errGroupNotFound
+	}
+
+	if !canManageGroup(u, g) {
+		return errAccessDenied
+	}
+
+	db.C("groups").Update(bson.M{"_id": subgroup}, bson.M{"$pull": bson.M{"groups": group}})
+	m.invalidateHierarchy()
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/valyala/fasthttp"
+)
+
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	UserBaseDN         string
+	UserFilter         string
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupAttribute     string
+}
+
+var errLDAPUnavailable = NewError(fasthttp.StatusServiceUnavailable, "auth_unavailable", "Authentication backend unavailable")
+
+// ldapAuth binds as the user found in the directory, then provisions it in the users collection.
+// Its groups are synced from the directory on every login.
+type ldapAuth struct {
+	m    *Miogo
+	conf *LDAPConfig
+}
+
+func (l *ldapAuth) Authenticate(email, password string) (*User, error) {
+	groups, err := l.lookup(email, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return l.m.provisionUser(email, "ldap", groups)
+}
+
+func (l *ldapAuth) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(l.conf.URL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: l.conf.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(l.conf.URL, ldap.DialWithTLSConfig(tlsConfig))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if l.conf.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *ldapAuth) bindService(conn *ldap.Conn) error {
+	if l.conf.BindDN == "" {
+		return nil
+	}
+
+	return conn.Bind(l.conf.BindDN, l.conf.BindPassword)
+}
+
+// lookup checks the credentials against the directory and returns the groups of the user
+func (l *ldapAuth) lookup(email, password string) ([]string, error) {
+	// An empty password would be an unauthenticated bind, which always succeeds
+	if password == "" {
+		return nil, errWrongPassword
+	}
+
+	conn, err := l.dial()
+
+	if err != nil {
+		log.Printf("Cannot connect to LDAP server: %s\n", err)
+		return nil, errLDAPUnavailable
+	}
+
+	defer conn.Close()
+
+	if err := l.bindService(conn); err != nil {
+		log.Printf("Cannot bind to LDAP server: %s\n", err)
+		return nil, errLDAPUnavailable
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.conf.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.conf.UserFilter, ldap.EscapeFilter(email)), []string{"dn"}, nil))
+
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, errUnknownUser
+		}
+
+		log.Printf("LDAP user search failed: %s\n", err)
+		return nil, errLDAPUnavailable
+	}
+
+	if len(res.Entries) != 1 {
+		if len(res.Entries) > 1 {
+			log.Printf("LDAP user search is ambiguous for %s\n", email)
+		}
+
+		return nil, errUnknownUser
+	}
+
+	userDN := res.Entries[0].DN
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errWrongPassword
+		}
+
+		log.Printf("LDAP user bind failed: %s\n", err)
+		return nil, errLDAPUnavailable
+	}
+
+	// Groups given in Miogo are left as they are
+	if l.conf.GroupBaseDN == "" {
+		return nil, nil
+	}
+
+	groups := []string{}
+
+	if err := l.bindService(conn); err != nil {
+		log.Printf("Cannot bind to LDAP server: %s\n", err)
+		return nil, errLDAPUnavailable
+	}
+
+	res, err = conn.Search(ldap.NewSearchRequest(
+		l.conf.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(l.conf.GroupFilter, ldap.EscapeFilter(userDN)), []string{l.conf.GroupAttribute}, nil))
+
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		log.Printf("LDAP group search failed: %s\n", err)
+		return nil, errLDAPUnavailable
+	}
+
+	if res != nil {
+		for _, entry := range res.Entries {
+			if name := entry.GetAttributeValue(l.conf.GroupAttribute); name != "" {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	return groups, nil
+}
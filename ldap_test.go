@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/jimlambrt/gldap"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ldapPeople = "ou=people,dc=miogo,dc=tld"
+	ldapGroups = "ou=groups,dc=miogo,dc=tld"
+)
+
+// ldapEntry is a directory entry of the in-process test server
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+var (
+	ldapEntries = []ldapEntry{
+		{"cn=alice," + ldapPeople, map[string][]string{"mail": {"alice@miogo.tld"}, "userPassword": {"alice"}}},
+		{"cn=bob," + ldapPeople, map[string][]string{"mail": {"bob@miogo.tld"}, "userPassword": {"bob"}}},
+		{"cn=frank," + ldapPeople, map[string][]string{"mail": {"frank@miogo.tld"}, "userPassword": {"frank"}}},
+		{"cn=developers," + ldapGroups, map[string][]string{"cn": {"developers"}, "member": {"cn=alice," + ldapPeople, "cn=bob," + ldapPeople}}},
+		{"cn=managers," + ldapGroups, map[string][]string{"cn": {"managers"}, "member": {"cn=alice," + ldapPeople}}},
+	}
+
+	ldapEqualityFilter = regexp.MustCompile(`^\(([a-zA-Z]+)=(.*)\)$`)
+)
+
+func (e *ldapEntry) matches(filter string) bool {
+	sm := ldapEqualityFilter.FindStringSubmatch(filter)
+
+	if sm == nil {
+		return false
+	}
+
+	for _, v := range e.attrs[sm[1]] {
+		if v == sm[2] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startLDAPServer runs a directory only supporting simple binds and equality filters
+func startLDAPServer(t *testing.T) *LDAPConfig {
+	s, err := gldap.NewServer()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux, _ := gldap.NewMux()
+
+	mux.Bind(func(w *gldap.ResponseWriter, r *gldap.Request) {
+		resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+		defer w.Write(resp)
+
+		m, err := r.GetSimpleBindMessage()
+
+		if err != nil {
+			return
+		}
+
+		for _, e := range ldapEntries {
+			if e.dn == m.UserName && len(e.attrs["userPassword"]) > 0 && e.attrs["userPassword"][0] == string(m.Password) {
+				resp.SetResultCode(gldap.ResultSuccess)
+			}
+		}
+	})
+
+	mux.Search(func(w *gldap.ResponseWriter, r *gldap.Request) {
+		resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+		defer w.Write(resp)
+
+		m, err := r.GetSearchMessage()
+
+		if err != nil {
+			resp.SetResultCode(gldap.ResultOperationsError)
+			return
+		}
+
+		for _, e := range ldapEntries {
+			if len(e.dn) > len(m.BaseDN) && e.dn[len(e.dn)-len(m.BaseDN):] == m.BaseDN && e.matches(m.Filter) {
+				entry := r.NewSearchResponseEntry(e.dn)
+
+				for k, v := range e.attrs {
+					entry.AddAttribute(k, v)
+				}
+
+				w.Write(entry)
+			}
+		}
+	})
+
+	s.Router(mux)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	go s.Run("127.0.0.1:" + strconv.Itoa(port))
+
+	for !s.Ready() {
+	}
+
+	t.Cleanup(func() { s.Stop() })
+
+	return &LDAPConfig{
+		URL:            fmt.Sprintf("ldap://127.0.0.1:%d", port),
+		UserBaseDN:     ldapPeople,
+		UserFilter:     "(mail=%s)",
+		GroupBaseDN:    ldapGroups,
+		GroupFilter:    "(member=%s)",
+		GroupAttribute: "cn",
+	}
+}
+
+func TestLDAPLookup(t *testing.T) {
+	l := &ldapAuth{conf: startLDAPServer(t)}
+
+	groups, err := l.lookup("alice@miogo.tld", "alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 2 || groups[0] != "developers" || groups[1] != "managers" {
+		t.Errorf("Wrong groups: %v", groups)
+	}
+
+	if _, err := l.lookup("alice@miogo.tld", "bob"); err != errWrongPassword {
+		t.Errorf("Expected wrong password, got %v", err)
+	}
+
+	if _, err := l.lookup("alice@miogo.tld", ""); err != errWrongPassword {
+		t.Errorf("Expected wrong password, got %v", err)
+	}
+
+	if _, err := l.lookup("carol@miogo.tld", "carol"); err != errUnknownUser {
+		t.Errorf("Expected unknown user, got %v", err)
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	conf := startLDAPServer(t)
+	providers := miogo.authProviders
+	miogo.RegisterAuthProvider(&ldapAuth{miogo, conf})
+
+	defer func() { miogo.authProviders = providers }()
+
+	usr, err := miogo.authenticate("bob@miogo.tld", "bob")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usr.Source != "ldap" || len(usr.Groups) != 1 || usr.Groups[0] != "developers" {
+		t.Errorf("Wrong provisioned user: %+v", usr)
+	}
+
+	if _, ok := miogo.FetchGroup("developers"); !ok {
+		t.Error("LDAP group has not been created")
+	}
+
+	if _, err := miogo.authenticate("bob@miogo.tld", "alice"); err != errWrongPassword {
+		t.Errorf("Expected wrong password, got %v", err)
+	}
+
+	// Groups given in Miogo are kept
+	db.C("users").Update(bson.M{"email": "bob@miogo.tld"}, bson.M{"$addToSet": bson.M{"groups": "local"}})
+	miogo.usersCache.Invalidate("bob@miogo.tld")
+
+	if usr, err := miogo.authenticate("bob@miogo.tld", "bob"); err != nil || !contains(usr.Groups, "local") || !contains(usr.Groups, "developers") {
+		t.Errorf("Wrong groups after a new login: %+v %v", usr, err)
+	}
+
+	// Without provider groups, a login and its session keep the ones given in Miogo
+	usr, err = miogo.authenticate("frank@miogo.tld", "frank")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	miogo.newUserSession(usr, &fasthttp.RequestCtx{})
+	db.C("users").Update(bson.M{"email": "frank@miogo.tld"}, bson.M{"$addToSet": bson.M{"groups": "local"}})
+	miogo.usersCache.Invalidate("frank@miogo.tld")
+
+	if usr, err := miogo.authenticate("frank@miogo.tld", "frank"); err != nil || len(usr.Groups) != 1 || usr.Groups[0] != "local" {
+		t.Errorf("Wrong groups after a new login: %+v %v", usr, err)
+	}
+
+	// Local accounts are not taken over
+	db.C("users").Insert(bson.M{"email": "alice@miogo.tld", "password": "", "created": 1})
+	defer db.C("users").Remove(bson.M{"email": "alice@miogo.tld"})
+
+	if _, err := (&ldapAuth{miogo, conf}).Authenticate("alice@miogo.tld", "alice"); err != errAccountConflict {
+		t.Errorf("Expected an account conflict, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Errors are always logged with log.Printf, these helpers are for messages which can be silenced
+
+const (
+	LogError int32 = iota
+	LogInfo
+	LogDebug
+)
+
+var logLevel = LogInfo
+
+func parseLogLevel(s string) (int32, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return LogError, nil
+	case "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	}
+
+	return LogInfo, fmt.Errorf("Unknown log level %s", s)
+}
+
+func setLogLevel(level int32) {
+	atomic.StoreInt32(&logLevel, level)
+}
+
+func logAt(level int32, format string, v ...interface{}) {
+	if atomic.LoadInt32(&logLevel) >= level {
+		log.Printf(format, v...)
+	}
+}
+
+func logInfo(format string, v ...interface{}) {
+	logAt(LogInfo, format, v...)
+}
+
+func logDebug(format string, v ...interface{}) {
+	logAt(LogDebug, format, v...)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer setLogLevel(LogInfo)
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("Unknown log level was accepted")
+	}
+
+	level, _ := parseLogLevel("ERROR")
+	setLogLevel(level)
+	logInfo("info")
+
+	if buf.Len() != 0 {
+		t.Error("Info message was logged at error level")
+	}
+
+	level, _ = parseLogLevel("debug")
+	setLogLevel(level)
+	logInfo("info")
+	logDebug("debug")
+
+	if out := buf.String(); !strings.Contains(out, "info") || !strings.Contains(out, "debug") {
+		t.Errorf("Messages were not logged at debug level: %q", out)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MailConfig struct {
+	SMTPHost string
+	SMTPPort int
+	Username string
+	Password string
+	From     string
+	ResetURL string
+}
+
+func (m *Miogo) SendMail(to, subject, body string) error {
+	mc := m.conf.Mail
+
+	if mc == nil {
+		return errors.New("Mail is not configured")
+	}
+
+	// Refuse header injection through user-provided values
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("Invalid mail header")
+	}
+
+	var auth smtp.Auth
+
+	if mc.Username != "" {
+		auth = smtp.PlainAuth("", mc.Username, mc.Password, mc.SMTPHost)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		mc.From, to, subject, time.Now().Format(time.RFC1123Z), body)
+
+	addr := net.JoinHostPort(mc.SMTPHost, strconv.Itoa(mc.SMTPPort))
+
+	return smtp.SendMail(addr, auth, mc.From, []string{to}, []byte(msg))
+}
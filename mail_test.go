@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server accepting every message it receives
+type fakeSMTP struct {
+	listener net.Listener
+	Messages chan string
+}
+
+func newFakeSMTP() (*fakeSMTP, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeSMTP{listener: l, Messages: make(chan string, 16)}
+	go f.serve()
+
+	return f, nil
+}
+
+func (f *fakeSMTP) Config() *MailConfig {
+	addr := f.listener.Addr().(*net.TCPAddr)
+
+	return &MailConfig{
+		SMTPHost: addr.IP.String(),
+		SMTPPort: addr.Port,
+		From:     "miogo@miogo.tld",
+		ResetURL: "http://localhost:8080/reset",
+	}
+}
+
+func (f *fakeSMTP) Close() {
+	f.listener.Close()
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		f.handle(conn)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 localhost fake SMTP")
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			var msg []string
+
+			for {
+				l, err := r.ReadString('\n')
+
+				if err != nil {
+					return
+				}
+
+				if l = strings.TrimRight(l, "\r\n"); l == "." {
+					break
+				}
+
+				msg = append(msg, l)
+			}
+
+			f.Messages <- strings.Join(msg, "\n")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (f *fakeSMTP) Receive() (string, bool) {
+	select {
+	case msg := <-f.Messages:
+		return msg, true
+	case <-time.After(5 * time.Second):
+		return "", false
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	f, err := newFakeSMTP()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	m := &Miogo{conf: &MiogoConfig{Mail: f.Config()}}
+
+	if err := m.SendMail("user@miogo.tld", "Hello", "World"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok := f.Receive()
+
+	if !ok {
+		t.Fatal("No mail has been received")
+	}
+
+	if !strings.Contains(msg, "Subject: Hello") || !strings.Contains(msg, "World") {
+		t.Error("Received mail does not match: " + strconv.Quote(msg))
+	}
+
+	if err := m.SendMail("user@miogo.tld\r\nBcc: evil@miogo.tld", "Hello", "World"); err == nil {
+		t.Error("Header injection should have been refused")
+	}
+}
@@ -1,12 +1,114 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
+type listener struct {
+	server *fasthttp.Server
+	addr   string
+	tls    bool
+}
+
 func main() {
-	miogo := NewMiogo()
-	log.Fatal(fasthttp.ListenAndServe(":8080", miogo.GetHandler()))
+	conf, err := LoadConfig(os.Args[1:])
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	miogo := NewMiogo(conf)
+	handler := miogo.GetHandler()
+	var listeners []listener
+
+	if mc := conf.Metrics; mc != nil && mc.Listen != "" {
+		listeners = append(listeners, listener{&fasthttp.Server{Handler: miogo.MetricsHandler()}, mc.Listen, false})
+	}
+
+	// Plain HTTP only redirects when HTTPS is enabled
+	if conf.TLS != nil {
+		_, port, _ := net.SplitHostPort(conf.TLS.Listen[0])
+
+		for _, addr := range conf.TLS.Listen {
+			listeners = append(listeners, listener{miogo.NewServer(handler), addr, true})
+		}
+
+		handler = redirectToHTTPS(port)
+	}
+
+	for _, addr := range conf.Listen {
+		listeners = append(listeners, listener{miogo.NewServer(handler), addr, false})
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		go func(l listener) {
+			if l.tls {
+				errs <- l.server.ListenAndServeTLS(l.addr, conf.TLS.Cert, conf.TLS.Key)
+			} else {
+				errs <- l.server.ListenAndServe(l.addr)
+			}
+		}(l)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if conf, err := LoadConfig(os.Args[1:]); err != nil {
+					log.Printf("Cannot reload configuration: %s\n", err)
+				} else if err := miogo.Reload(conf); err != nil {
+					log.Printf("Cannot reload configuration: %s\n", err)
+				} else {
+					logInfo("Configuration reloaded\n")
+				}
+
+				continue
+			}
+
+			logInfo("Shutting down, waiting for in-flight requests\n")
+			// Event streams would hold their connections until the timeout
+			miogo.events.Close()
+			shutdown(listeners, time.Duration(conf.ShutdownTimeout)*time.Second)
+			miogo.Close()
+
+			return
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits for in-flight requests until the timeout
+func shutdown(listeners []listener, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{}, len(listeners))
+
+	for _, l := range listeners {
+		go func(s *fasthttp.Server) {
+			if err := s.ShutdownWithContext(ctx); err != nil {
+				log.Printf("Shutdown did not complete: %s\n", err)
+			}
+
+			done <- struct{}{}
+		}(l.server)
+	}
+
+	for range listeners {
+		<-done
+	}
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Metrics are exposed in the Prometheus text format
+
+type MetricsConfig struct {
+	// Serve metrics on their own address instead of the main one
+	Listen string
+	// If set, requests must have an "Authorization: Bearer <Token>" header
+	Token string
+}
+
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type serviceMetrics struct {
+	requests uint64
+	errors   uint64
+	sum      float64
+	buckets  []uint64
+}
+
+type Metrics struct {
+	sync.Mutex
+	services      map[string]*serviceMetrics
+	gridFSRead    uint64
+	gridFSWritten uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{services: make(map[string]*serviceMetrics)}
+}
+
+func (mt *Metrics) ObserveService(name string, d time.Duration, failed bool) {
+	mt.Lock()
+	defer mt.Unlock()
+
+	sm, ok := mt.services[name]
+
+	if !ok {
+		sm = &serviceMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		mt.services[name] = sm
+	}
+
+	sm.requests++
+	sm.sum += d.Seconds()
+
+	if failed {
+		sm.errors++
+	}
+
+	for i, b := range latencyBuckets {
+		if d.Seconds() <= b {
+			sm.buckets[i]++
+		}
+	}
+}
+
+func (mt *Metrics) AddGridFSRead(n int64) {
+	atomic.AddUint64(&mt.gridFSRead, uint64(n))
+}
+
+func (mt *Metrics) AddGridFSWritten(n int64) {
+	atomic.AddUint64(&mt.gridFSWritten, uint64(n))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetric(w io.Writer, name, kind, help string, values map[string]interface{}, label string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	keys := make([]string, 0, len(values))
+
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if label == "" {
+			fmt.Fprintf(w, "%s %v\n", name, values[k])
+		} else {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %v\n", name, label, labelEscaper.Replace(k), values[k])
+		}
+	}
+}
+
+func (mt *Metrics) WriteTo(w io.Writer, caches map[string]*Cache) {
+	stats := make(map[string]CacheStats)
+
+	for name, c := range caches {
+		stats[name] = c.Stats()
+	}
+
+	cacheMetric := func(name, kind, help string, f func(CacheStats) interface{}) {
+		values := make(map[string]interface{})
+
+		for k, s := range stats {
+			values[k] = f(s)
+		}
+
+		writeMetric(w, name, kind, help, values, "cache")
+	}
+
+	cacheMetric("miogo_cache_hits_total", "counter", "Cache hits.", func(s CacheStats) interface{} { return s.Hits })
+	cacheMetric("miogo_cache_misses_total", "counter", "Cache misses.", func(s CacheStats) interface{} { return s.Misses })
+	cacheMetric("miogo_cache_evictions_total", "counter", "Entries evicted because of the memory limit or expiration.", func(s CacheStats) interface{} { return s.Evictions })
+	cacheMetric("miogo_cache_entries", "gauge", "Number of cached entries.", func(s CacheStats) interface{} { return s.Entries })
+	cacheMetric("miogo_cache_size_bytes", "gauge", "Estimated memory used by cached entries.", func(s CacheStats) interface{} { return s.Size })
+
+	mt.Lock()
+
+	requests := make(map[string]interface{})
+	errors := make(map[string]interface{})
+	names := make([]string, 0, len(mt.services))
+
+	for name, sm := range mt.services {
+		requests[name] = sm.requests
+		errors[name] = sm.errors
+		names = append(names, name)
+	}
+
+	writeMetric(w, "miogo_service_requests_total", "counter", "Requests handled by service.", requests, "service")
+	writeMetric(w, "miogo_service_errors_total", "counter", "Requests which failed by service.", errors, "service")
+
+	sort.Strings(names)
+
+	fmt.Fprint(w, "# HELP miogo_service_duration_seconds Time spent handling requests by service.\n# TYPE miogo_service_duration_seconds histogram\n")
+
+	for _, name := range names {
+		sm := mt.services[name]
+		l := labelEscaper.Replace(name)
+
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "miogo_service_duration_seconds_bucket{service=\"%s\",le=\"%g\"} %d\n", l, b, sm.buckets[i])
+		}
+
+		fmt.Fprintf(w, "miogo_service_duration_seconds_bucket{service=\"%s\",le=\"+Inf\"} %d\n", l, sm.requests)
+		fmt.Fprintf(w, "miogo_service_duration_seconds_sum{service=\"%s\"} %g\n", l, sm.sum)
+		fmt.Fprintf(w, "miogo_service_duration_seconds_count{service=\"%s\"} %d\n", l, sm.requests)
+	}
+
+	mt.Unlock()
+
+	writeMetric(w, "miogo_gridfs_read_bytes_total", "counter", "Bytes read from GridFS.",
+		map[string]interface{}{"": atomic.LoadUint64(&mt.gridFSRead)}, "")
+	writeMetric(w, "miogo_gridfs_written_bytes_total", "counter", "Bytes written to GridFS.",
+		map[string]interface{}{"": atomic.LoadUint64(&mt.gridFSWritten)}, "")
+}
+
+func (m *Miogo) caches() map[string]*Cache {
+	return map[string]*Cache{
+		"folders":      m.foldersCache,
+		"files":        m.filesCache,
+		"filesContent": m.filesContentCache,
+		"sessions":     m.sessionsCache,
+		"users":        m.usersCache,
+		"groups":       m.groupsCache,
+		"webhooks":     m.webhooksCache,
+	}
+}
+
+func (m *Miogo) ServeMetrics(ctx *fasthttp.RequestCtx) error {
+	if token := m.conf.Metrics.Token; token != "" {
+		given := strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+			return nil
+		}
+	}
+
+	ctx.SetContentType("text/plain; version=0.0.4")
+
+	w := bufio.NewWriter(ctx)
+	m.metrics.WriteTo(w, m.caches())
+	w.Flush()
+
+	return nil
+}
+
+// MetricsHandler serves metrics alone, to be bound to a separate address
+func (m *Miogo) MetricsHandler() fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != "/metrics" {
+			ctx.Error("Not found", fasthttp.StatusNotFound)
+			return
+		}
+
+		m.ServeMetrics(ctx)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsOutput(t *testing.T) {
+	mt := NewMetrics()
+	c := NewCache(0)
+
+	c.Set("/", nil)
+	c.Get("/")
+	c.Get("/missing")
+
+	mt.ObserveService("GetFolder", 2*time.Millisecond, false)
+	mt.ObserveService("GetFolder", 2*time.Second, true)
+	mt.AddGridFSRead(42)
+	mt.AddGridFSWritten(7)
+
+	var b bytes.Buffer
+	mt.WriteTo(&b, map[string]*Cache{"folders": c})
+	out := b.String()
+
+	for _, expected := range []string{
+		"# TYPE miogo_cache_hits_total counter\n",
+		`miogo_cache_hits_total{cache="folders"} 1` + "\n",
+		`miogo_cache_misses_total{cache="folders"} 1` + "\n",
+		`miogo_cache_entries{cache="folders"} 1` + "\n",
+		`miogo_service_requests_total{service="GetFolder"} 2` + "\n",
+		`miogo_service_errors_total{service="GetFolder"} 1` + "\n",
+		`miogo_service_duration_seconds_bucket{service="GetFolder",le="0.005"} 1` + "\n",
+		`miogo_service_duration_seconds_bucket{service="GetFolder",le="+Inf"} 2` + "\n",
+		"miogo_gridfs_read_bytes_total 42\n",
+		"miogo_gridfs_written_bytes_total 7\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in metrics output", expected)
+		}
+	}
+}
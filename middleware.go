@@ -0,0 +1,352 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+/*
+ * Requests go through two chains of middlewares:
+ *   1. Request middlewares wrap every request, whatever the service or route reached, see Use
+ *   2. Service middlewares wrap a service once its arguments are parsed and its user is known,
+ *      see UseForServices and Service.Middlewares
+ * Middlewares must be added before GetHandler is called.
+ */
+
+// Handler serves a request, its error is written as the response
+type Handler func(*fasthttp.RequestCtx) error
+
+// Middleware wraps a handler, it can act before and after calling next, or answer without calling it
+type Middleware func(next Handler) Handler
+
+type ctxKey int
+
+const (
+	serviceKey ctxKey = iota
+	userKey
+	requestIDKey
+	auditKey
+)
+
+type CORSConfig struct {
+	// Origins allowed to call Miogo from a browser, "*" allows any origin
+	AllowedOrigins []string
+	// Send cookies with cross-origin requests, not allowed with "*"
+	AllowCredentials bool
+	// Seconds browsers can cache preflight responses
+	MaxAge int `default:"600"`
+}
+
+// Use adds middlewares around every request, the first one given being the outermost
+func (m *Miogo) Use(mw ...Middleware) {
+	m.middlewares = append(m.middlewares, mw...)
+}
+
+// UseForServices adds middlewares around every service, after its own options are checked
+func (m *Miogo) UseForServices(mw ...Middleware) {
+	m.serviceMiddlewares = append(m.serviceMiddlewares, mw...)
+}
+
+func chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
+
+// compile builds the chains once every middleware is known
+func (m *Miogo) compile() {
+	m.chains = make(map[string]Handler, len(m.registry))
+
+	for name, s := range m.registry {
+		m.chains[name] = m.serviceChain(s)
+	}
+
+	m.handler = chain(m.dispatch, m.middlewares...)
+}
+
+func (m *Miogo) serviceChain(s *Service) Handler {
+	mw := []Middleware{
+		m.observe(s), m.audit(s), m.limitRate(s, false), m.limitBody(s), decodeArgs(s), validate(s),
+		m.requireLogin(s), m.checkCSRF(s), m.limitRate(s, true),
+	}
+	mw = append(mw, m.serviceMiddlewares...)
+	mw = append(mw, s.Middlewares...)
+	mw = append(mw, contentType(s))
+
+	return chain(func(ctx *fasthttp.RequestCtx) error {
+		return s.Handler(ctx, CurrentUser(ctx))
+	}, mw...)
+}
+
+// dispatch finds the service of the request, its error is written so that outer middlewares see the response
+func (m *Miogo) dispatch(ctx *fasthttp.RequestCtx) error {
+	var err error
+
+	if f, ok := m.services[string(ctx.Path())]; ok {
+		err = f(ctx)
+	} else if ok, rerr := m.route(ctx); !ok {
+		err = errUnknownSvc
+	} else {
+		err = rerr
+	}
+
+	if err != nil {
+		writeError(ctx, err)
+	}
+
+	return nil
+}
+
+// respond calls next and writes its error, headers set afterwards are then kept
+func respond(next Handler, ctx *fasthttp.RequestCtx) {
+	if err := next(ctx); err != nil {
+		writeError(ctx, err)
+	}
+}
+
+// CurrentService returns the service being run, nil in request middlewares
+func CurrentService(ctx *fasthttp.RequestCtx) *Service {
+	s, _ := ctx.UserValue(serviceKey).(*Service)
+	return s
+}
+
+// CurrentUser returns the logged in user, nil before authentication and for NoLoginCheck services
+func CurrentUser(ctx *fasthttp.RequestCtx) *User {
+	u, _ := ctx.UserValue(userKey).(*User)
+	return u
+}
+
+func RequestID(ctx *fasthttp.RequestCtx) string {
+	id, _ := ctx.UserValue(requestIDKey).(string)
+	return id
+}
+
+// clientIP is the address of the client, given by a proxy if ClientIPHeader is set
+func (m *Miogo) clientIP(ctx *fasthttp.RequestCtx) string {
+	if h := m.conf.ClientIPHeader; h != "" {
+		// Proxies append the address they received the request from
+		if v := string(ctx.Request.Header.Peek(h)); v != "" {
+			return strings.TrimSpace(v[strings.LastIndex(v, ",")+1:])
+		}
+	}
+
+	return ctx.RemoteIP().String()
+}
+
+/*
+ * Request middlewares
+ */
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestIDMiddleware keeps the X-Request-ID of proxies or generates one, it is sent back in the response
+func RequestIDMiddleware(next Handler) Handler {
+	return func(ctx *fasthttp.RequestCtx) error {
+		id := string(ctx.Request.Header.Peek("X-Request-ID"))
+
+		if !validRequestID(id) {
+			id = randomHex(8)
+		}
+
+		ctx.SetUserValue(requestIDKey, id)
+		respond(next, ctx)
+		ctx.Response.Header.Set("X-Request-ID", id)
+
+		return nil
+	}
+}
+
+// AccessLogMiddleware logs every request at the debug level
+func AccessLogMiddleware(next Handler) Handler {
+	return func(ctx *fasthttp.RequestCtx) error {
+		start := time.Now()
+		respond(next, ctx)
+		logDebug("%s %s %s %s %d %s\n", RequestID(ctx), ctx.RemoteIP(), ctx.Method(), ctx.Path(), ctx.Response.StatusCode(), time.Since(start))
+
+		return nil
+	}
+}
+
+// RecoverMiddleware turns panics into internal errors instead of dropping the connection
+func RecoverMiddleware(next Handler) Handler {
+	return func(ctx *fasthttp.RequestCtx) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic serving %s: %v\n%s", ctx.Path(), r, debug.Stack())
+				err = errFailure
+			}
+		}()
+
+		return next(ctx)
+	}
+}
+
+// CORSMiddleware answers preflight requests and allows the configured origins
+func CORSMiddleware(conf *CORSConfig) Middleware {
+	anyOrigin := contains(conf.AllowedOrigins, "*")
+
+	return func(next Handler) Handler {
+		return func(ctx *fasthttp.RequestCtx) error {
+			origin := string(ctx.Request.Header.Peek("Origin"))
+
+			if origin == "" || !(anyOrigin || contains(conf.AllowedOrigins, origin)) {
+				return next(ctx)
+			}
+
+			preflight := ctx.IsOptions() && len(ctx.Request.Header.Peek("Access-Control-Request-Method")) > 0
+
+			if !preflight {
+				respond(next, ctx)
+			}
+
+			h := &ctx.Response.Header
+
+			// Cookies are only sent by the origins listed, any website could read the answers otherwise
+			credentials := conf.AllowCredentials && contains(conf.AllowedOrigins, origin)
+
+			if anyOrigin && !credentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Add("Vary", "Origin")
+			}
+
+			if credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				h.Set("Access-Control-Expose-Headers", "ETag, Retry-After, X-CSRF-Token, X-Request-ID")
+				return nil
+			}
+
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+
+			if requested := ctx.Request.Header.Peek("Access-Control-Request-Headers"); len(requested) > 0 {
+				h.SetBytesV("Access-Control-Allow-Headers", requested)
+			}
+
+			h.Set("Access-Control-Max-Age", strconv.Itoa(conf.MaxAge))
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+
+			return nil
+		}
+	}
+}
+
+/*
+ * Service middlewares, in their order in the chain
+ */
+
+func (m *Miogo) observe(s *Service) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *fasthttp.RequestCtx) error {
+			start := time.Now()
+			err := next(ctx)
+			m.metrics.ObserveService(s.Name, time.Since(start), err != nil || ctx.Response.StatusCode() >= 400)
+
+			return err
+		}
+	}
+}
+
+func (m *Miogo) limitBody(s *Service) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *fasthttp.RequestCtx) error {
+			limit := m.conf.Limits.MaxRequestBodySize
+
+			if s.Options&LargeBody != 0 {
+				limit = m.conf.Limits.MaxUploadSize
+			}
+
+			if len(ctx.Request.Body()) > int(megabytes(limit)) {
+				return errBodyTooLarge.WithDetails("limit", strconv.Itoa(limit)+"MB")
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+func decodeArgs(s *Service) Middleware {
+	return func(next Handler) Handler {
+		if s.Options&RawBody != 0 {
+			return next
+		}
+
+		return func(ctx *fasthttp.RequestCtx) error {
+			if err := parseJSONArgs(ctx); err != nil {
+				return err
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+func validate(s *Service) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *fasthttp.RequestCtx) error {
+			if !s.Validate(ctx) {
+				return s.argumentsError()
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+func (m *Miogo) requireLogin(s *Service) Middleware {
+	return func(next Handler) Handler {
+		if s.Options&NoLoginCheck != 0 {
+			return next
+		}
+
+		return func(ctx *fasthttp.RequestCtx) error {
+			u, ok := m.GetUserFromRequest(ctx)
+
+			if !ok {
+				return errNotLoggedIn
+			}
+
+			// The cached user is shared between requests, resolve nested groups on a copy
+			usr := *u
+			usr.Memberships = m.FetchMemberships(u)
+			ctx.SetUserValue(userKey, &usr)
+
+			return next(ctx)
+		}
+	}
+}
+
+func contentType(s *Service) Middleware {
+	return func(next Handler) Handler {
+		if s.Options&NoJSON != 0 {
+			return next
+		}
+
+		return func(ctx *fasthttp.RequestCtx) error {
+			ctx.SetContentType("application/json")
+			return next(ctx)
+		}
+	}
+}
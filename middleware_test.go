@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx *fasthttp.RequestCtx) error {
+				calls = append(calls, name)
+				return next(ctx)
+			}
+		}
+	}
+
+	h := chain(func(ctx *fasthttp.RequestCtx) error {
+		calls = append(calls, "handler")
+		return nil
+	}, mark("a"), mark("b"))
+
+	h(&fasthttp.RequestCtx{})
+
+	if strings.Join(calls, ",") != "a,b,handler" {
+		t.Errorf("Wrong order: %v", calls)
+	}
+}
+
+func TestServiceMiddlewares(t *testing.T) {
+	m := newTestRegistry()
+	var seen []string
+
+	m.RegisterService(&Service{
+		Name:    "Panic",
+		Handler: func(ctx *fasthttp.RequestCtx, u *User) error { panic("oops") },
+		Options: NoLoginCheck,
+		Middlewares: []Middleware{func(next Handler) Handler {
+			return func(ctx *fasthttp.RequestCtx) error {
+				seen = append(seen, "service "+CurrentService(ctx).Name)
+				return next(ctx)
+			}
+		}},
+	})
+
+	m.UseForServices(func(next Handler) Handler {
+		return func(ctx *fasthttp.RequestCtx) error {
+			seen = append(seen, "all")
+			return next(ctx)
+		}
+	})
+
+	m.Use(RequestIDMiddleware, RecoverMiddleware)
+	handler := m.GetHandler()
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/Panic")
+	ctx.Request.Header.Set("X-Request-ID", "from-proxy")
+	handler(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+		t.Errorf("Panic was not recovered: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	if strings.Join(seen, ",") != "all,service Panic" {
+		t.Errorf("Wrong middlewares run: %v", seen)
+	}
+
+	if string(ctx.Response.Header.Peek("X-Request-ID")) != "from-proxy" {
+		t.Errorf("Request ID was not kept: %s", ctx.Response.Header.Peek("X-Request-ID"))
+	}
+
+	// Invalid IDs are replaced
+	ctx.Request.Header.Set("X-Request-ID", "bad id\n")
+	handler(&ctx)
+
+	if id := string(ctx.Response.Header.Peek("X-Request-ID")); len(id) != 16 {
+		t.Errorf("Wrong generated request ID %q", id)
+	}
+
+	// Errors of services are written before request middlewares see the response
+	ctx.Request.SetRequestURI("/Unknown")
+	handler(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusNotFound || len(ctx.Response.Header.Peek("X-Request-ID")) == 0 {
+		t.Errorf("Wrong response to an unknown service: %d %s", ctx.Response.StatusCode(), ctx.Response.Header.String())
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	called := false
+	h := CORSMiddleware(&CORSConfig{AllowedOrigins: []string{"https://app.tld"}, AllowCredentials: true, MaxAge: 600})(func(ctx *fasthttp.RequestCtx) error {
+		called = true
+		return errNotLoggedIn
+	})
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("OPTIONS")
+	ctx.Request.Header.Set("Origin", "https://app.tld")
+	ctx.Request.Header.Set("Access-Control-Request-Method", "DELETE")
+	ctx.Request.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	h(&ctx)
+
+	if called || ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Errorf("Preflight was not answered: %d", ctx.Response.StatusCode())
+	}
+
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.tld",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Headers":     "Content-Type",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if got := string(ctx.Response.Header.Peek(k)); got != v {
+			t.Errorf("%s: expected %s, got %s", k, v, got)
+		}
+	}
+
+	// Headers are kept on errors
+	ctx.Response.Reset()
+	ctx.Request.Header.SetMethod("POST")
+	h(&ctx)
+
+	if !called || ctx.Response.StatusCode() != fasthttp.StatusUnauthorized || string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "https://app.tld" {
+		t.Errorf("Wrong response: %d %s", ctx.Response.StatusCode(), ctx.Response.Header.String())
+	}
+
+	// Other origins get no CORS header
+	ctx.Response.Reset()
+	ctx.Request.Header.Set("Origin", "https://evil.tld")
+	h(&ctx)
+
+	if len(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != 0 {
+		t.Error("Unknown origin was allowed")
+	}
+
+	// Any origin never gets credentials
+	ctx.Response.Reset()
+	h = CORSMiddleware(&CORSConfig{AllowedOrigins: []string{"*", "https://app.tld"}, AllowCredentials: true})(func(ctx *fasthttp.RequestCtx) error {
+		return nil
+	})
+	h(&ctx)
+
+	if string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "*" || len(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")) != 0 {
+		t.Errorf("Credentials allowed for any origin: %s", ctx.Response.Header.String())
+	}
+}
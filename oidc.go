@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/oauth2"
+)
+
+/*
+ * OpenID Connect login (authorization code flow with PKCE):
+ *   1. /oidc/login stores a state, a nonce and a PKCE verifier then redirects to the provider
+ *   2. The provider redirects the browser to /oidc/callback with a code and the state
+ *   3. The code is exchanged for an ID token, which is checked against the provider's JWKS
+ *   4. Claims are mapped to the user, a session is created as with Login
+ */
+
+type OIDCConfig struct {
+	Issuer          string
+	ClientID        string
+	ClientSecret    string
+	RedirectURL     string
+	Scopes          []string
+	EmailClaim      string
+	GroupsClaim     string
+	AutoCreateUsers bool
+	LoginRedirect   string
+}
+
+const oidcStateDuration = 10 * time.Minute
+
+type oidcState struct {
+	verifier string
+	nonce    string
+}
+
+type oidcAuth struct {
+	sync.Mutex
+	m        *Miogo
+	conf     *OIDCConfig
+	provider *oidc.Provider
+	states   *Cache
+}
+
+func newOIDCAuth(m *Miogo, conf *OIDCConfig) *oidcAuth {
+	if conf.EmailClaim == "" {
+		conf.EmailClaim = "email"
+	}
+
+	if conf.LoginRedirect == "" {
+		conf.LoginRedirect = "/"
+	}
+
+	return &oidcAuth{m: m, conf: conf, states: NewCache(0)}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("Cannot read crypto secure bytes: %s\n", err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// The provider is discovered on first use so that Miogo can start while it is unreachable
+func (o *oidcAuth) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.provider == nil {
+		p, err := oidc.NewProvider(ctx, o.conf.Issuer)
+
+		if err != nil {
+			return nil, err
+		}
+
+		o.provider = p
+	}
+
+	return o.provider, nil
+}
+
+func (o *oidcAuth) oauth2Config(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.conf.ClientID,
+		ClientSecret: o.conf.ClientSecret,
+		RedirectURL:  o.conf.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID, "email"}, o.conf.Scopes...),
+	}
+}
+
+func (o *oidcAuth) Login(ctx *fasthttp.RequestCtx) error {
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p, err := o.getProvider(c)
+
+	if err != nil {
+		log.Printf("Cannot discover OpenID provider: %s\n", err)
+		return NewError(fasthttp.StatusServiceUnavailable, "auth_unavailable", "Identity provider unavailable")
+	}
+
+	state := randomHex(16)
+	s := &oidcState{verifier: oauth2.GenerateVerifier(), nonce: randomHex(16)}
+	o.states.SetWithTTL(state, s, oidcStateDuration)
+
+	// The state is also bound to the browser to prevent login CSRF
+	cookie := fasthttp.AcquireCookie()
+	cookie.SetHTTPOnly(true)
+	cookie.SetKey("oidc_state")
+	cookie.SetValue(state)
+	cookie.SetPath("/oidc")
+	ctx.Response.Header.SetCookie(cookie)
+	fasthttp.ReleaseCookie(cookie)
+
+	ctx.Redirect(o.oauth2Config(p).AuthCodeURL(state, oidc.Nonce(s.nonce), oauth2.S256ChallengeOption(s.verifier)), fasthttp.StatusFound)
+	return nil
+}
+
+// exchange trades the authorization code for an ID token and returns the mapped claims
+func (o *oidcAuth) exchange(c context.Context, code string, s *oidcState) (string, []string, error) {
+	p, err := o.getProvider(c)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := o.oauth2Config(p).Exchange(c, code, oauth2.VerifierOption(s.verifier))
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+
+	if !ok {
+		return "", nil, errors.New("no ID token in token response")
+	}
+
+	idToken, err := p.Verifier(&oidc.Config{ClientID: o.conf.ClientID}).Verify(c, raw)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if idToken.Nonce != s.nonce {
+		return "", nil, errors.New("nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, err
+	}
+
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		return "", nil, errors.New("email is not verified")
+	}
+
+	email, _ := claims[o.conf.EmailClaim].(string)
+
+	if email == "" {
+		return "", nil, errors.New("no email claim")
+	}
+
+	var groups []string
+
+	if o.conf.GroupsClaim != "" {
+		groups = []string{}
+
+		if values, ok := claims[o.conf.GroupsClaim].([]interface{}); ok {
+			for _, v := range values {
+				if g, ok := v.(string); ok {
+					groups = append(groups, g)
+				}
+			}
+		}
+	}
+
+	return email, groups, nil
+}
+
+// Callback logs the user in, successful or not the login is audited like the Login service
+func (o *oidcAuth) Callback(ctx *fasthttp.RequestCtx) error {
+	e := o.m.newAuditEntry(ctx, "Login")
+	email, err := o.callback(ctx)
+
+	e.Actor, e.Arguments = email, map[string]string{"provider": "oidc"}
+	e.setOutcome(ctx, err)
+	writeAudit(e)
+
+	return err
+}
+
+// callback returns the email claim once known
+func (o *oidcAuth) callback(ctx *fasthttp.RequestCtx) (string, error) {
+	state := string(ctx.QueryArgs().Peek("state"))
+
+	val, ok := o.states.Get(state)
+
+	if !ok || state != string(ctx.Request.Header.Cookie("oidc_state")) {
+		return "", NewError(fasthttp.StatusBadRequest, "invalid_state", "Invalid state")
+	}
+
+	o.states.Invalidate(state)
+	ctx.Response.Header.DelClientCookie("oidc_state")
+
+	s := val.(*oidcState)
+
+	if e := ctx.QueryArgs().Peek("error"); len(e) > 0 {
+		return "", NewError(fasthttp.StatusUnauthorized, "auth_refused", "Authentication refused by the identity provider")
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	email, groups, err := o.exchange(c, string(ctx.QueryArgs().Peek("code")), s)
+
+	if err != nil {
+		log.Printf("OpenID Connect authentication failed: %s\n", err)
+		return "", NewError(fasthttp.StatusUnauthorized, "auth_failed", "Authentication failed")
+	}
+
+	if _, exists := o.m.FetchUser(email); !exists && !o.conf.AutoCreateUsers {
+		return email, errUnknownUser
+	}
+
+	// Groups are only synced when the provider sends them
+	usr, err := o.m.provisionUser(email, "oidc", groups)
+
+	if err != nil {
+		return email, err
+	}
+
+	o.m.newUserSession(usr, ctx)
+	ctx.Redirect(o.conf.LoginRedirect, fasthttp.StatusFound)
+	return email, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mockIssuer is an OpenID provider issuing ID tokens for a single user
+type mockIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	claims    map[string]interface{}
+	challenge string
+	nonce     string
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newMockIssuer(t *testing.T, claims map[string]interface{}) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mi := &mockIssuer{key: key, claims: claims}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                mi.URL,
+			"authorization_endpoint":                mi.URL + "/authorize",
+			"token_endpoint":                        mi.URL + "/token",
+			"jwks_uri":                              mi.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+
+		if r.Form.Get("code") != "code" || b64(sum[:]) != mi.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     mi.sign(t),
+		})
+	})
+
+	mi.Server = httptest.NewServer(mux)
+	t.Cleanup(mi.Close)
+
+	return mi
+}
+
+func (mi *mockIssuer) sign(t *testing.T) string {
+	claims := map[string]interface{}{
+		"iss":   mi.URL,
+		"aud":   "miogo",
+		"sub":   "1234",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": mi.nonce,
+	}
+
+	for k, v := range mi.claims {
+		claims[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, mi.key, crypto.SHA256, sum[:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+// authorize runs /oidc/login and plays the provider's part, it returns the callback request
+func (mi *mockIssuer) authorize(t *testing.T, o *oidcAuth) *fasthttp.RequestCtx {
+	var ctx fasthttp.RequestCtx
+
+	if err := o.Login(&ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := url.Parse(string(ctx.Response.Header.Peek("Location")))
+
+	if err != nil || !strings.HasPrefix(location.String(), mi.URL+"/authorize") {
+		t.Fatalf("Wrong redirection to the provider: %s", location)
+	}
+
+	q := location.Query()
+
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatal("PKCE is not used")
+	}
+
+	mi.challenge = q.Get("code_challenge")
+	mi.nonce = q.Get("nonce")
+
+	var callback fasthttp.RequestCtx
+	callback.Request.SetRequestURI("/oidc/callback?code=code&state=" + url.QueryEscape(q.Get("state")))
+	callback.Request.Header.SetCookie("oidc_state", q.Get("state"))
+
+	return &callback
+}
+
+func newTestOIDCAuth(m *Miogo, mi *mockIssuer) *oidcAuth {
+	return newOIDCAuth(m, &OIDCConfig{
+		Issuer:          mi.URL,
+		ClientID:        "miogo",
+		ClientSecret:    "secret",
+		RedirectURL:     "http://localhost:8080/oidc/callback",
+		GroupsClaim:     "groups",
+		AutoCreateUsers: true,
+	})
+}
+
+func TestOIDCExchange(t *testing.T) {
+	mi := newMockIssuer(t, map[string]interface{}{"email": "carol@miogo.tld", "groups": []string{"sso"}})
+	o := newTestOIDCAuth(nil, mi)
+	callback := mi.authorize(t, o)
+
+	val, ok := o.states.Get(string(callback.QueryArgs().Peek("state")))
+
+	if !ok {
+		t.Fatal("State has not been stored")
+	}
+
+	s := val.(*oidcState)
+
+	email, groups, err := o.exchange(context.Background(), "code", s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email != "carol@miogo.tld" || len(groups) != 1 || groups[0] != "sso" {
+		t.Errorf("Wrong claims mapping: %s %v", email, groups)
+	}
+
+	if _, _, err := o.exchange(context.Background(), "code", &oidcState{verifier: "wrong", nonce: s.nonce}); err == nil {
+		t.Error("Exchange should fail with a wrong PKCE verifier")
+	}
+
+	if _, _, err := o.exchange(context.Background(), "code", &oidcState{verifier: s.verifier, nonce: "wrong"}); err == nil {
+		t.Error("Exchange should fail with a wrong nonce")
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	mi := newMockIssuer(t, map[string]interface{}{"email": "dave@miogo.tld", "groups": []string{"sso"}})
+	o := newTestOIDCAuth(miogo, mi)
+
+	callback := mi.authorize(t, o)
+	callback.Request.Header.SetCookie("oidc_state", "forged")
+
+	if err := o.Callback(callback); err == nil {
+		t.Error("Callback should fail when the state cookie does not match")
+	}
+
+	callback = mi.authorize(t, o)
+
+	if err := o.Callback(callback); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(callback.Response.Header.PeekCookie("session")) == 0 {
+		t.Error("Session cookie has not been set")
+	}
+
+	usr, ok := miogo.FetchUser("dave@miogo.tld")
+
+	if !ok || usr.Source != "oidc" || len(usr.Groups) != 1 || usr.Groups[0] != "sso" {
+		t.Errorf("Wrong provisioned user: %+v", usr)
+	}
+
+	o.conf.AutoCreateUsers = false
+	mi.claims["email"] = "eve@miogo.tld"
+
+	if err := o.Callback(mi.authorize(t, o)); err != errUnknownUser {
+		t.Errorf("Expected unknown user, got %v", err)
+	}
+
+	// Logins through the provider are audited like the Login service
+	for actor, outcome := range map[string]string{"dave@miogo.tld": "success", "eve@miogo.tld": "user_not_found", "": "invalid_state"} {
+		selector := bson.M{"service": "Login", "actor": actor, "outcome": outcome, "arguments.provider": "oidc"}
+
+		if n, err := db.C(auditCollection).Find(selector).Count(); n == 0 || err != nil {
+			t.Errorf("Login of %q with outcome %s has not been audited", actor, outcome)
+		}
+	}
+
+	// Without automatic creation, admins create the users of the provider
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/?email=eve@miogo.tld&source=oidc")
+	admin, _ := miogo.FetchUser(miogo.conf.AdminEmail)
+
+	if err := miogo.NewUser(&ctx, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.C("users").Remove(bson.M{"email": "eve@miogo.tld"})
+
+	if err := o.Callback(mi.authorize(t, o)); err != nil {
+		t.Errorf("Created user cannot log in: %v", err)
+	}
+
+	if usr, ok := miogo.FetchUser("eve@miogo.tld"); !ok || usr.Source != "oidc" || usr.LastLogin == 0 || !contains(usr.Groups, "sso") {
+		t.Errorf("Wrong created user: %+v", usr)
+	}
+
+	if _, err := miogo.authenticate("eve@miogo.tld", ""); err != errUnknownUser {
+		t.Errorf("Expected no local login, got %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The OpenAPI 3 document is generated from the services and routes registered
+
+type object = map[string]interface{}
+
+type openAPI struct {
+	schemas object
+}
+
+func (m *Miogo) OpenAPI() object {
+	g := &openAPI{schemas: object{}}
+	paths := object{}
+
+	for name, s := range m.registry {
+		paths["/"+name] = object{"post": g.operation(s, nil)}
+	}
+
+	for _, r := range m.routes {
+		path := r.Prefix
+
+		if r.Param != "" {
+			if !strings.HasSuffix(path, "/") {
+				path += "/"
+			}
+
+			path += "{" + r.Param + "}"
+		}
+
+		if _, ok := paths[path]; !ok {
+			paths[path] = object{}
+		}
+
+		paths[path].(object)[strings.ToLower(r.Method)] = g.operation(m.registry[r.Service], r)
+	}
+
+	g.schema(reflect.TypeOf(Error{}))
+	g.schemas["Success"] = object{
+		"type":       "object",
+		"properties": object{"success": object{"type": "string", "enum": []string{"true"}}},
+		"required":   []string{"success"},
+	}
+
+	schemes := object{"session": object{"type": "apiKey", "in": "cookie", "name": "session"}}
+	security := object{"session": []string{}}
+
+	// Services needing login also require the token given with the session, see checkCSRF
+	if m.conf.Session.CSRF {
+		schemes["csrf"] = object{"type": "apiKey", "in": "header", "name": "X-CSRF-Token"}
+		security["csrf"] = []string{}
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info":    object{"title": "Miogo", "version": "1"},
+		"paths":   paths,
+		"components": object{
+			"schemas":         g.schemas,
+			"securitySchemes": schemes,
+		},
+		"security": []object{security},
+	}
+}
+
+func (m *Miogo) ServeOpenAPI(ctx *fasthttp.RequestCtx) error {
+	b, err := json.Marshal(m.OpenAPI())
+
+	if err != nil {
+		return err
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+
+	return nil
+}
+
+func ref(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func fieldSchema(f Field) object {
+	s := object{"type": f.Type, "description": f.Description}
+
+	if f.Type == "file" {
+		s["type"], s["format"] = "string", "binary"
+	}
+
+	return s
+}
+
+// operation describes a service reached directly (r is nil) or through a route
+func (g *openAPI) operation(s *Service, r *Route) object {
+	op := object{"summary": s.Description, "responses": g.responses(s)}
+	inPath := ""
+
+	if r == nil {
+		op["operationId"] = s.Name
+	} else {
+		inPath = r.Param
+	}
+
+	if s.Options&NoLoginCheck != 0 {
+		op["security"] = []object{}
+	} else if r != nil && r.Method == "GET" {
+		// The CSRF token is not checked on GET requests
+		op["security"] = []object{{"session": []string{}}}
+	}
+
+	var params []object
+	body := object{"type": "object", "properties": object{}}
+	var required []string
+
+	mandatory := make(map[string]bool)
+
+	for _, f := range s.MandatoryFields {
+		mandatory[f] = true
+	}
+
+	// Without a body, GET and DELETE routes take arguments in the query string, as raw bodies do
+	query := s.Options&RawBody != 0 || (r != nil && (r.Method == "GET" || r.Method == "DELETE"))
+
+	for _, f := range s.Fields {
+		schema := fieldSchema(f)
+
+		if r != nil {
+			if def, ok := r.Defaults[f.Name]; ok {
+				schema["default"] = def
+
+				if b, err := strconv.ParseBool(def); err == nil && f.Type == "boolean" {
+					schema["default"] = b
+				}
+			}
+		}
+
+		switch {
+		case f.Name == inPath:
+			params = append(params, object{"name": f.Name, "in": "path", "required": true, "schema": schema})
+		case query:
+			params = append(params, object{"name": f.Name, "in": "query", "required": mandatory[f.Name], "schema": schema})
+		default:
+			body["properties"].(object)[f.Name] = schema
+
+			if mandatory[f.Name] {
+				required = append(required, f.Name)
+			}
+		}
+	}
+
+	if len(required) > 0 {
+		body["required"] = required
+	}
+
+	if len(s.AtLeastOneField) > 0 {
+		var anyOf []object
+
+		for _, f := range s.AtLeastOneField {
+			anyOf = append(anyOf, object{"required": []string{f}})
+		}
+
+		body["anyOf"] = anyOf
+	}
+
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if s.Options&RawBody != 0 {
+		op["requestBody"] = object{
+			"required": true,
+			"content":  object{"application/octet-stream": object{"schema": object{"type": "string", "format": "binary"}}},
+		}
+	} else if len(body["properties"].(object)) > 0 {
+		content := object{}
+
+		if hasFileField(s) {
+			content["multipart/form-data"] = object{"schema": body}
+		} else {
+			content["application/x-www-form-urlencoded"] = object{"schema": body}
+			content["application/json"] = object{"schema": body}
+		}
+
+		op["requestBody"] = object{"required": len(required) > 0, "content": content}
+	}
+
+	return op
+}
+
+func hasFileField(s *Service) bool {
+	for _, f := range s.Fields {
+		if f.Type == "file" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *openAPI) responses(s *Service) object {
+	var content object
+
+	switch {
+	case s.Options&NoJSON != 0:
+		content = object{"application/octet-stream": object{"schema": object{"type": "string", "format": "binary"}}}
+	case s.Response == nil:
+		content = object{"application/json": object{"schema": ref("Success")}}
+	default:
+		content = object{"application/json": object{"schema": g.schema(reflect.TypeOf(s.Response))}}
+	}
+
+	return object{
+		"200":     object{"description": "Success", "content": content},
+		"default": object{"description": "Error", "content": object{"application/json": object{"schema": ref("Error")}}},
+	}
+}
+
+// schema returns the JSON schema of a Go type, named structs being added to the components
+func (g *openAPI) schema(t reflect.Type) object {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// Reserve the name first, types can refer to themselves
+			g.schemas[t.Name()] = object{}
+			g.schemas[t.Name()] = g.object(t)
+		}
+
+		return ref(t.Name())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return object{"type": "string", "format": "byte"}
+		}
+
+		return object{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	}
+
+	return object{}
+}
+
+// object follows encoding/json rules: json tags, omitempty and embedded structs
+func (g *openAPI) object(t reflect.Type) object {
+	properties := object{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				embedded := g.object(ft)
+
+				for k, v := range embedded["properties"].(object) {
+					properties[k] = v
+				}
+
+				if r, ok := embedded["required"].([]string); ok {
+					required = append(required, r...)
+				}
+
+				continue
+			}
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := g.schema(f.Type)
+
+		// Nil slices and maps are encoded as null
+		if k := f.Type.Kind(); k == reflect.Slice || k == reflect.Map {
+			schema["nullable"] = true
+		}
+
+		properties[name] = schema
+
+		if !strings.Contains(tag, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	o := object{"type": "object", "properties": properties}
+
+	if len(required) > 0 {
+		o["required"] = required
+	}
+
+	return o
+}
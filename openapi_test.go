@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newTestRegistry() *Miogo {
+	m := &Miogo{
+		conf:     &MiogoConfig{},
+		services: make(map[string]func(*fasthttp.RequestCtx) error),
+		registry: make(map[string]*Service),
+		metrics:  NewMetrics(),
+	}
+
+	m.registerServices()
+
+	return m
+}
+
+// Every service must be documented for the generated clients to be usable
+func TestServicesDocumentation(t *testing.T) {
+	types := map[string]bool{"string": true, "integer": true, "boolean": true, "file": true}
+
+	for name, s := range newTestRegistry().registry {
+		if s.Description == "" {
+			t.Errorf("%s has no description", name)
+		}
+
+		documented := make(map[string]bool)
+
+		for _, f := range s.Fields {
+			if !types[f.Type] || f.Description == "" {
+				t.Errorf("%s: field %s lacks a valid type or a description", name, f.Name)
+			}
+
+			if documented[f.Name] {
+				t.Errorf("%s: field %s is documented twice", name, f.Name)
+			}
+
+			documented[f.Name] = true
+		}
+
+		for _, f := range append(append([]string{}, s.MandatoryFields...), s.AtLeastOneField...) {
+			if !documented[f] {
+				t.Errorf("%s: field %s is not documented", name, f)
+			}
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	m := newTestRegistry()
+	m.conf.Session.CSRF = true
+	b, err := json.Marshal(m.OpenAPI())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type security []map[string][]string
+
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Security *security
+		}
+		Components struct {
+			Schemas         map[string]interface{}
+			SecuritySchemes map[string]map[string]string
+		}
+		Security security
+	}
+
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range m.registry {
+		if _, ok := doc.Paths["/"+name]["post"]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+
+	for _, r := range m.routes {
+		found := false
+
+		for path, ops := range doc.Paths {
+			if _, ok := ops[strings.ToLower(r.Method)]; ok && strings.HasPrefix(path, r.Prefix) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("Route %s %s is missing", r.Method, r.Prefix)
+		}
+	}
+
+	// Every reference must resolve
+	for _, ref := range strings.Split(string(b), `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("Schema %s is referenced but not defined", name)
+		}
+	}
+
+	for _, name := range []string{"Folder", "User", "UserPage", "GroupDetails", "Error", "Success"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("Schema %s is missing", name)
+		}
+	}
+
+	// The CSRF token is required, except on GET requests and without login
+	if csrf := doc.Components.SecuritySchemes["csrf"]; csrf["in"] != "header" || csrf["name"] != "X-CSRF-Token" {
+		t.Errorf("Wrong CSRF scheme: %v", csrf)
+	}
+
+	if len(doc.Security) != 1 || doc.Security[0]["session"] == nil || doc.Security[0]["csrf"] == nil {
+		t.Errorf("Wrong global security: %v", doc.Security)
+	}
+
+	if op := doc.Paths["/api/v1/users"]["get"]; op.Security == nil || len(*op.Security) != 1 || (*op.Security)[0]["csrf"] != nil {
+		t.Errorf("GET routes should only require the session: %v", op.Security)
+	}
+
+	if op := doc.Paths["/api/v1/users"]["post"]; op.Security != nil {
+		t.Errorf("POST routes should use the global security: %v", op.Security)
+	}
+
+	if op := doc.Paths["/Login"]["post"]; op.Security == nil || len(*op.Security) != 0 {
+		t.Errorf("Login should not require security: %v", op.Security)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+
+	"github.com/valyala/fasthttp"
+)
+
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+func weakPassword(message, rule string) *Error {
+	return NewError(fasthttp.StatusBadRequest, "weak_password", message).WithDetails("rule", rule)
+}
+
+// Check returns an error describing the first unmet requirement.
+// A nil policy only rejects empty passwords.
+func (p *PasswordPolicy) Check(password string) error {
+	if len(password) == 0 {
+		return weakPassword("Password cannot be empty", "empty")
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		return weakPassword(fmt.Sprintf("Password must be at least %d characters long", p.MinLength), "min_length")
+	}
+
+	var upper, lower, digit, symbol bool
+
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireUpper && !upper {
+		return weakPassword("Password must contain an uppercase letter", "upper")
+	}
+
+	if p.RequireLower && !lower {
+		return weakPassword("Password must contain a lowercase letter", "lower")
+	}
+
+	if p.RequireDigit && !digit {
+		return weakPassword("Password must contain a digit", "digit")
+	}
+
+	if p.RequireSymbol && !symbol {
+		return weakPassword("Password must contain a symbol", "symbol")
+	}
+
+	return nil
+}
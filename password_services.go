@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ * Password reset:
+ *   1. A random token is mailed to the user, only its hash is stored in DB
+ *   2. The token is valid for resetTokenDuration and can be used once
+ *   3. Using it sets the new password and closes every session of the user
+ */
+
+const resetTokenDuration = time.Hour
+
+var (
+	errExternalPassword = NewError(fasthttp.StatusConflict, "external_password", "Password is managed by an external provider")
+	errInvalidToken     = NewError(fasthttp.StatusBadRequest, "invalid_token", "Invalid token")
+)
+
+func (m *Miogo) ChangePassword(ctx *fasthttp.RequestCtx, u *User) error {
+	if u.Source != "" {
+		return errExternalPassword
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), ctx.FormValue("password")); err != nil {
+		return errWrongPassword
+	}
+
+	newPassword := string(ctx.FormValue("new_password"))
+
+	if err := m.conf.PasswordPolicy.Check(newPassword); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+
+	if err != nil {
+		return errFailure
+	}
+
+	usr := *u
+	usr.Password = string(hashedPassword)
+
+	m.usersCache.Invalidate(u.Email)
+	m.invalidateUserSessions(u.Email)
+
+	// A new session replaces the one stored in DB, other clients are logged out
+	m.newUserSession(&usr, ctx)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+func (m *Miogo) RequestPasswordReset(ctx *fasthttp.RequestCtx, u *User) error {
+	if m.conf.Mail == nil {
+		return NewError(fasthttp.StatusServiceUnavailable, "reset_unavailable", "Password reset is not available")
+	}
+
+	link, err := url.Parse(m.conf.Mail.ResetURL)
+
+	if err != nil {
+		log.Printf("Bad password reset URL: %s\n", err)
+		return errFailure
+	}
+
+	// Do not tell whether the user exists: the answer is the same and does not wait for the mail
+	go m.sendPasswordReset(strings.TrimSpace(string(ctx.FormValue("email"))), link)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+// sendPasswordReset mails a reset link to local users, failures are only logged
+func (m *Miogo) sendPasswordReset(email string, link *url.URL) {
+	if usr, exists := m.FetchUser(email); !exists || usr.Source != "" {
+		return
+	}
+
+	randBytes := make([]byte, 16)
+
+	if _, err := rand.Read(randBytes); err != nil {
+		log.Panicf("Cannot read crypto secure bytes: %s\n", err)
+	}
+
+	raw := hex.EncodeToString(randBytes)
+
+	db.C("users").Update(bson.M{"email": email}, bson.M{"$set": bson.M{
+		"reset.hash":   hash(randBytes),
+		"reset.expire": time.Now().Add(resetTokenDuration).Unix(),
+	}})
+
+	m.usersCache.Invalidate(email)
+
+	q := link.Query()
+	q.Set("token", raw)
+	link.RawQuery = q.Encode()
+
+	body := "A password reset has been requested for your Miogo account.\r\n\r\n" +
+		"Follow this link to choose a new password: " + link.String() + "\r\n\r\n" +
+		"If you did not request it, please ignore this message."
+
+	if err := m.SendMail(email, "Miogo password reset", body); err != nil {
+		log.Printf("Cannot send password reset mail to %s: %s\n", email, err)
+	}
+}
+
+func (m *Miogo) ResetPassword(ctx *fasthttp.RequestCtx, u *User) error {
+	val, err := hex.DecodeString(string(ctx.FormValue("token")))
+
+	if err != nil {
+		return errInvalidToken
+	}
+
+	var usr User
+
+	if err := db.C("users").Find(bson.M{"reset.hash": hash(val)}).One(&usr); err != nil {
+		return errInvalidToken
+	}
+
+	if usr.Reset.Expiration < time.Now().Unix() {
+		return errInvalidToken
+	}
+
+	if usr.Source != "" {
+		return errExternalPassword
+	}
+
+	newPassword := string(ctx.FormValue("password"))
+
+	if err := m.conf.PasswordPolicy.Check(newPassword); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+
+	if err != nil {
+		return errFailure
+	}
+
+	db.C("users").Update(bson.M{"email": usr.Email}, bson.M{
+		"$set":   bson.M{"password": string(hashedPassword)},
+		"$unset": bson.M{"reset": "", "session": ""},
+	})
+
+	m.usersCache.Invalidate(usr.Email)
+	m.invalidateUserSessions(usr.Email)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestPasswordPolicy(t *testing.T) {
+	var none *PasswordPolicy
+
+	assert(t, none.Check("") != nil)
+	assert(t, none.Check("a") == nil)
+
+	p := &PasswordPolicy{MinLength: 8, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+
+	assert(t, p.Check("Ab1!") != nil)
+	assert(t, p.Check("abcdefg1!") != nil)
+	assert(t, p.Check("ABCDEFG1!") != nil)
+	assert(t, p.Check("Abcdefgh!") != nil)
+	assert(t, p.Check("Abcdefgh1") != nil)
+	assert(t, p.Check("Abcdefg1!") == nil)
+	assert(t, p.Check("Àbcdéfg1 ") == nil)
+}
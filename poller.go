@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+/*
+ * Queues shared by the instances, such as webhook deliveries and text extractions, are polled:
+ *   1. next leases the first item due by pushing back its time, other instances then skip it
+ *   2. Once handled, the item is updated or left to be handled again when the lease ends
+ *   3. next is called again until it finds nothing, then the poller waits for the next tick
+ */
+
+type poller struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startPoller calls next on every tick, and again as long as it returns true
+func startPoller(interval time.Duration, next func() bool) *poller {
+	p := &poller{stop: make(chan struct{}), done: make(chan struct{})}
+
+	go p.run(interval, next)
+
+	return p
+}
+
+func (p *poller) run(interval time.Duration, next func() bool) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for next() {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// close waits for the item being handled
+func (p *poller) close() {
+	close(p.stop)
+	<-p.done
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoller(t *testing.T) {
+	var calls int32
+
+	// Three items are queued, next finds none afterwards
+	p := startPoller(time.Millisecond, func() bool {
+		return atomic.AddInt32(&calls, 1) <= 3
+	})
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&calls) < 5; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Poller did not go on polling, %d calls", atomic.LoadInt32(&calls))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	p.close()
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(5 * time.Millisecond)
+
+	if atomic.LoadInt32(&calls) != n {
+		t.Error("Poller is still running after close")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Rate limiting with token buckets:
+ *   1. Every service has a bucket per client IP, checked before login, and one per user, checked after
+ *   2. A bucket holds up to Burst tokens and is refilled at the configured rate
+ *   3. A request takes a token, without any it gets a 429 with the time to wait in Retry-After
+ * Buckets are kept in memory, or in MongoDB to share them between instances.
+ */
+
+type RateLimitsConfig struct {
+	// "memory" (default) or "mongo" to share counters between instances
+	Store string `default:"memory"`
+	// Limits of the services not listed in Services
+	Default RateLimit
+	// Limits by service name, e.g. Upload, they can only be given in the file
+	Services map[string]RateLimit
+}
+
+// Rates are given in requests per minute, 0 means unlimited
+type RateLimit struct {
+	PerUser int `default:"0"`
+	PerIP   int `default:"0"`
+	// Requests allowed at once, the rate by default
+	Burst int `default:"0"`
+}
+
+var errTooManyRequests = NewError(fasthttp.StatusTooManyRequests, "too_many_requests", "Too many requests")
+
+type bucketLimit struct {
+	// Tokens per second
+	rate  float64
+	burst float64
+}
+
+func newBucketLimit(perMinute, burst int) bucketLimit {
+	if burst <= 0 {
+		burst = perMinute
+	}
+
+	return bucketLimit{rate: float64(perMinute) / 60, burst: float64(burst)}
+}
+
+// take refills the tokens for the elapsed time and removes one, it returns the tokens left or how long to wait for one
+func (l bucketLimit) take(tokens float64, elapsed time.Duration) (float64, time.Duration) {
+	tokens = math.Min(l.burst, tokens+elapsed.Seconds()*l.rate)
+
+	if tokens < 1 {
+		return tokens, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+
+	return tokens - 1, 0
+}
+
+// untilFull is how long the bucket takes to be full again, it can then be forgotten
+func (l bucketLimit) untilFull(tokens float64) time.Duration {
+	return time.Duration((l.burst - tokens) / l.rate * float64(time.Second))
+}
+
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, it returns how long to wait when the bucket is empty
+	Take(key string, l bucketLimit, now time.Time) (time.Duration, error)
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+type MemoryRateStore struct {
+	sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateStore) Take(key string, l bucketLimit, now time.Time) (time.Duration, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Full buckets are the same as missing ones
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+
+	if !ok {
+		b = &memoryBucket{tokens: l.burst, last: now}
+		s.buckets[key] = b
+	}
+
+	var wait time.Duration
+	b.tokens, wait = l.take(b.tokens, now.Sub(b.last))
+	b.last = now
+	b.full = now.Add(l.untilFull(b.tokens))
+
+	return wait, nil
+}
+
+type mongoBucket struct {
+	Key    string  `bson:"_id"`
+	Tokens float64 `bson:"tokens"`
+	// Unix time in nanoseconds
+	Last int64 `bson:"last"`
+	// Buckets are removed by MongoDB once full
+	Expire time.Time `bson:"expire"`
+}
+
+const (
+	rateLimitsCollection = "rate_limits"
+	rateStoreRetries     = 5
+)
+
+var errRateStoreContention = errors.New("Too many concurrent updates of a rate limit bucket")
+
+// MongoRateStore updates buckets with compare-and-swap, retrying when another request or instance won
+type MongoRateStore struct{}
+
+func NewMongoRateStore() (*MongoRateStore, error) {
+	err := db.C(rateLimitsCollection).EnsureIndex(mgo.Index{Key: []string{"expire"}, ExpireAfter: time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoRateStore{}, nil
+}
+
+func (s *MongoRateStore) Take(key string, l bucketLimit, now time.Time) (time.Duration, error) {
+	c := db.C(rateLimitsCollection)
+
+	for i := 0; i < rateStoreRetries; i++ {
+		var b mongoBucket
+		err := c.FindId(key).One(&b)
+		missing := err == mgo.ErrNotFound
+
+		if missing {
+			b = mongoBucket{Key: key, Tokens: l.burst, Last: now.UnixNano()}
+		} else if err != nil {
+			return 0, err
+		}
+
+		tokens, wait := l.take(b.Tokens, time.Duration(now.UnixNano()-b.Last))
+
+		// Refused requests leave the bucket as it is, the refill is computed from the last request
+		if wait > 0 {
+			return wait, nil
+		}
+
+		update := mongoBucket{Key: key, Tokens: tokens, Last: now.UnixNano(), Expire: now.Add(l.untilFull(tokens))}
+
+		if missing {
+			err = c.Insert(&update)
+		} else {
+			err = c.Update(bson.M{"_id": key, "tokens": b.Tokens, "last": b.Last}, &update)
+		}
+
+		if mgo.IsDup(err) || err == mgo.ErrNotFound {
+			continue
+		}
+
+		return 0, err
+	}
+
+	return 0, errRateStoreContention
+}
+
+// limitRate checks the bucket of the client IP, or of the user if byUser is set
+func (m *Miogo) limitRate(s *Service, byUser bool) Middleware {
+	return func(next Handler) Handler {
+		if m.rateStore == nil {
+			return next
+		}
+
+		rl, ok := m.conf.RateLimits.Services[s.Name]
+
+		if !ok {
+			rl = m.conf.RateLimits.Default
+		}
+
+		perMinute, scope := rl.PerIP, "ip"
+
+		if byUser {
+			perMinute, scope = rl.PerUser, "user"
+		}
+
+		if perMinute <= 0 {
+			return next
+		}
+
+		limit := newBucketLimit(perMinute, rl.Burst)
+
+		return func(ctx *fasthttp.RequestCtx) error {
+			var key string
+
+			if byUser {
+				u := CurrentUser(ctx)
+
+				// Services reachable without login are limited by IP only
+				if u == nil {
+					return next(ctx)
+				}
+
+				key = "user:" + u.Email + ":" + s.Name
+			} else {
+				key = "ip:" + m.clientIP(ctx) + ":" + s.Name
+			}
+
+			wait, err := m.rateStore.Take(key, limit, time.Now())
+
+			// Requests are not refused because of the store
+			if err != nil {
+				log.Printf("Cannot check rate limit of %s: %s\n", key, err)
+				return next(ctx)
+			}
+
+			if wait > 0 {
+				seconds := int(math.Ceil(wait.Seconds()))
+				return errTooManyRequests.WithHeader("Retry-After", strconv.Itoa(seconds)).WithDetails("limit", scope)
+			}
+
+			return next(ctx)
+		}
+	}
+}
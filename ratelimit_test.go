@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testRateStore(t *testing.T, s RateLimitStore, key string) {
+	l := newBucketLimit(60, 2)
+	now := time.Now()
+
+	for i, expected := range []time.Duration{0, 0, time.Second} {
+		if wait, err := s.Take(key, l, now); err != nil || wait != expected {
+			t.Errorf("Request %d: waiting %s instead of %s (%v)", i, wait, expected, err)
+		}
+	}
+
+	// One token per second is refilled
+	if wait, _ := s.Take(key, l, now.Add(time.Second)); wait != 0 {
+		t.Errorf("Bucket was not refilled, waiting %s", wait)
+	}
+
+	if wait, _ := s.Take(key, l, now.Add(1500*time.Millisecond)); wait != 500*time.Millisecond {
+		t.Errorf("Waiting %s instead of 500ms", wait)
+	}
+
+	// Buckets do not hold more than the burst
+	for i := 0; i < 3; i++ {
+		if wait, _ := s.Take(key, l, now.Add(time.Hour)); (wait == 0) != (i < 2) {
+			t.Errorf("Request %d after a refill: waiting %s", i, wait)
+		}
+	}
+}
+
+func TestMemoryRateStore(t *testing.T) {
+	s := NewMemoryRateStore()
+	testRateStore(t, s, "ip:127.0.0.1:Login")
+
+	// Full buckets are swept
+	s.Take("other", newBucketLimit(60, 2), time.Now().Add(2*time.Hour))
+
+	if _, ok := s.buckets["ip:127.0.0.1:Login"]; ok || len(s.buckets) != 1 {
+		t.Errorf("Full buckets were not removed: %d left", len(s.buckets))
+	}
+}
+
+func TestMongoRateStore(t *testing.T) {
+	s, err := NewMongoRateStore()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRateStore(t, s, "test:"+bson.NewObjectId().Hex())
+}
+
+func TestLimitRate(t *testing.T) {
+	m := newTestRegistry()
+	m.conf.ClientIPHeader = "X-Forwarded-For"
+	m.conf.RateLimits = &RateLimitsConfig{
+		Default:  RateLimit{PerIP: 1000},
+		Services: map[string]RateLimit{"Ping": {PerIP: 1}},
+	}
+	m.rateStore = NewMemoryRateStore()
+
+	m.RegisterService(&Service{
+		Name:    "Ping",
+		Handler: func(ctx *fasthttp.RequestCtx, u *User) error { return nil },
+		Options: NoLoginCheck,
+	})
+
+	handler := m.GetHandler()
+
+	request := func(ip string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/Ping")
+		ctx.Request.Header.Set("X-Forwarded-For", "10.0.0.1, "+ip)
+		handler(&ctx)
+
+		return &ctx
+	}
+
+	if ctx := request("10.0.0.2"); ctx.Response.StatusCode() != 200 {
+		t.Fatalf("First request refused: %d", ctx.Response.StatusCode())
+	}
+
+	ctx := request("10.0.0.2")
+
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests || string(ctx.Response.Header.Peek("Retry-After")) != "60" {
+		t.Errorf("Expected 429 with Retry-After: %d %s", ctx.Response.StatusCode(), ctx.Response.Header.Peek("Retry-After"))
+	}
+
+	// Other clients have their own bucket
+	if ctx := request("10.0.0.3"); ctx.Response.StatusCode() != 200 {
+		t.Errorf("Other client refused: %d", ctx.Response.StatusCode())
+	}
+}
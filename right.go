@@ -35,8 +35,15 @@ func RightStringToRightType(str string) RightType {
 	return Nothing
 }
 
+// Memberships, when resolved, include groups the user belongs to through nested groups
 func UserBelongsToGroup(u *User, g string) bool {
-	for _, group := range u.Groups {
+	groups := u.Groups
+
+	if u.Memberships != nil {
+		groups = u.Memberships
+	}
+
+	for _, group := range groups {
 		if group == g {
 			return true
 		}
@@ -90,3 +97,44 @@ func GetRightType(u *User, r *Right) RightType {
 
 	return result
 }
+
+// readFilter hides from a user what they cannot read, rights being looked up once per path.
+// Rights are checked after querying, so the requests using it cap the documents read, see cappedIter.
+type readFilter struct {
+	m        *Miogo
+	u        *User
+	readable map[string]bool
+}
+
+func newReadFilter(m *Miogo, u *User) *readFilter {
+	return &readFilter{m, u, make(map[string]bool)}
+}
+
+func (f *readFilter) canRead(path string, folder bool) (exists, ok bool) {
+	if ok, known := f.readable[path]; known {
+		return true, ok
+	}
+
+	var rights *Right
+
+	if folder {
+		d, found := f.m.FetchFolder(path)
+
+		if !found {
+			return false, false
+		}
+
+		rights = d.Rights
+	} else {
+		file, found := f.m.FetchFile(path)
+
+		if !found {
+			return false, false
+		}
+
+		rights = file.Rights
+	}
+
+	f.readable[path] = GetRightType(f.u, rights) >= AllowedToRead
+	return true, f.readable[path]
+}
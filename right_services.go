@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"strings"
 
 	"gopkg.in/mgo.v2/bson"
@@ -35,7 +34,7 @@ func (m *Miogo) setFolderRights(u *User, path, rights, entityType, entityName st
 	for _, folder := range folders {
 		for _, file := range folder.Files {
 			if GetRightType(u, file.Rights) < AllowedToChangeRights {
-				return errors.New("Access denied")
+				return errAccessDenied
 			}
 
 			fullPath := strings.TrimSuffix(folder.Path, "/") + "/" + file.Name
@@ -76,7 +75,7 @@ func (m *Miogo) SetResourceRights(ctx *fasthttp.RequestCtx, u *User) error {
 
 	if folder, ok := m.FetchFolder(resource); ok {
 		if GetRightType(u, folder.Rights) < AllowedToChangeRights {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 
 		if err := m.setFolderRights(u, resource, rights, entityType, entityName); err != nil {
@@ -84,9 +83,13 @@ func (m *Miogo) SetResourceRights(ctx *fasthttp.RequestCtx, u *User) error {
 		}
 
 		m.foldersCache.InvalidateStartWith(resource)
+
+		if changed, ok := m.FetchFolder(resource); ok {
+			auditRights(ctx, folder.Rights, changed.Rights)
+		}
 	} else if file, ok := m.FetchFile(resource); ok {
 		if GetRightType(u, file.Rights) < AllowedToChangeRights {
-			return errors.New("Access denied")
+			return errAccessDenied
 		}
 
 		d, f := formatF(resource)
@@ -96,10 +99,17 @@ func (m *Miogo) SetResourceRights(ctx *fasthttp.RequestCtx, u *User) error {
 		}
 
 		m.foldersCache.Invalidate(d)
+
+		if changed, ok := m.FetchFile(resource); ok {
+			auditRights(ctx, file.Rights, changed.Rights)
+		}
 	} else {
-		return errors.New("Resource does not exist")
+		return errResourceNotFound
 	}
 
+	d, f := formatF(resource)
+	m.events.Publish(newActivityEvent(u, EventRights, d, []string{f}, ""))
+
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
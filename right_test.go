@@ -62,6 +62,14 @@ func TestRightsChecking(t *testing.T) {
 	assert(t, GetRightType(&usr2, &r3) == AllowedToRead)
 }
 
+func TestNestedGroupsRights(t *testing.T) {
+	usr := usr1
+	assert(t, GetRightType(&usr, &r3) == AllowedToRead)
+
+	usr.Memberships = []string{"group1", "group2", "group4"}
+	assert(t, GetRightType(&usr, &r3) == AllowedToWrite)
+}
+
 func BenchmarkRightsChecking(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		GetRightType(&usr2, &r1)
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Routes give a resource-oriented access to registered services, e.g. GET /api/v1/files/test/a.txt runs GetFile with path=/test/a.txt
+
+type Route struct {
+	Method string
+	// Prefix of the URL, what follows it is given to the service as the Param argument.
+	// Without Param, the URL must be exactly the prefix.
+	Prefix  string
+	Param   string
+	Service string
+	// Arguments used when the request does not give them
+	Defaults map[string]string
+}
+
+var errMethodNotAllowed = NewError(fasthttp.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+
+func (m *Miogo) RegisterRoute(r *Route) {
+	if _, ok := m.registry[r.Service]; !ok {
+		panic("Route to unknown service " + r.Service)
+	}
+
+	m.routes = append(m.routes, r)
+
+	// The longest prefixes are tried first
+	sort.SliceStable(m.routes, func(i, j int) bool {
+		return len(m.routes[i].Prefix) > len(m.routes[j].Prefix)
+	})
+}
+
+func (r *Route) match(path string) (string, bool) {
+	if r.Param == "" {
+		return "", path == r.Prefix
+	}
+
+	if !strings.HasPrefix(path, r.Prefix) {
+		return "", false
+	}
+
+	rest := path[len(r.Prefix):]
+
+	// Do not let /api/v1/files match /api/v1/filesystem
+	if rest != "" && !strings.HasSuffix(r.Prefix, "/") && rest[0] != '/' {
+		return "", false
+	}
+
+	return rest, true
+}
+
+// route finds the route of the request, it returns false if no route has the path
+func (m *Miogo) route(ctx *fasthttp.RequestCtx) (bool, error) {
+	path := string(ctx.Path())
+	method := string(ctx.Method())
+	var allowed []string
+
+	for _, r := range m.routes {
+		param, ok := r.match(path)
+
+		if !ok {
+			continue
+		}
+
+		if r.Method != method {
+			allowed = append(allowed, r.Method)
+			continue
+		}
+
+		args := ctx.QueryArgs()
+
+		for k, v := range r.Defaults {
+			if !hasArg(ctx, k) {
+				args.Set(k, v)
+			}
+		}
+
+		if r.Param != "" {
+			args.Set(r.Param, param)
+		}
+
+		return true, m.serve(m.registry[r.Service], ctx)
+	}
+
+	if len(allowed) > 0 {
+		return true, errMethodNotAllowed.WithHeader("Allow", strings.Join(allowed, ", "))
+	}
+
+	return false, nil
+}
+
+func hasArg(ctx *fasthttp.RequestCtx, name string) bool {
+	if ctx.QueryArgs().Has(name) || ctx.PostArgs().Has(name) {
+		return true
+	}
+
+	if form, err := ctx.MultipartForm(); err == nil {
+		_, ok := form.Value[name]
+		return ok
+	}
+
+	return false
+}
+
+// parseJSONArgs makes the fields of a JSON object body available as arguments.
+// Strings are given as is and other values in JSON, arguments from the URL take precedence.
+func parseJSONArgs(ctx *fasthttp.RequestCtx) error {
+	if !strings.HasPrefix(string(ctx.Request.Header.ContentType()), "application/json") || len(ctx.Request.Body()) == 0 {
+		return nil
+	}
+
+	var fields map[string]interface{}
+
+	d := json.NewDecoder(bytes.NewReader(ctx.Request.Body()))
+	d.UseNumber()
+
+	if err := d.Decode(&fields); err != nil {
+		return errBadRequest.WithDetails("body", "Invalid JSON object")
+	}
+
+	args := ctx.QueryArgs()
+
+	for k, v := range fields {
+		if args.Has(k) {
+			continue
+		}
+
+		switch val := v.(type) {
+		case string:
+			args.Set(k, val)
+		case nil:
+		case json.Number:
+			args.Set(k, val.String())
+		case bool:
+			args.Set(k, strconv.FormatBool(val))
+		default:
+			b, _ := json.Marshal(val)
+			args.SetBytesV(k, b)
+		}
+	}
+
+	return nil
+}
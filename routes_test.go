@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRouteMatch(t *testing.T) {
+	files := &Route{Prefix: "/api/v1/files", Param: "path"}
+	users := &Route{Prefix: "/api/v1/users/", Param: "email"}
+	list := &Route{Prefix: "/api/v1/users"}
+
+	for _, c := range []struct {
+		route *Route
+		path  string
+		param string
+		ok    bool
+	}{
+		{files, "/api/v1/files/a/b.txt", "/a/b.txt", true},
+		{files, "/api/v1/files", "", true},
+		{files, "/api/v1/filesystem", "", false},
+		{users, "/api/v1/users/a@b.c", "a@b.c", true},
+		{list, "/api/v1/users", "", true},
+		{list, "/api/v1/users/a@b.c", "", false},
+	} {
+		if param, ok := c.route.match(c.path); ok != c.ok || param != c.param {
+			t.Errorf("%s on %s: got %q %v", c.route.Prefix, c.path, param, ok)
+		}
+	}
+}
+
+func TestParseJSONArgs(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetRequestURI("/?path=/query")
+	ctx.Request.SetBodyString(`{"path":"/body","count":12345678,"flag":true,"rights":{"all":"r"},"none":null}`)
+
+	if err := parseJSONArgs(&ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{"path": "/query", "count": "12345678", "flag": "true", "rights": `{"all":"r"}`} {
+		if got := string(ctx.FormValue(k)); got != v {
+			t.Errorf("%s: expected %s, got %s", k, v, got)
+		}
+	}
+
+	if hasArg(&ctx, "none") {
+		t.Error("Null value was given as an argument")
+	}
+
+	ctx.Request.SetBodyString(`[1, 2]`)
+
+	if err := parseJSONArgs(&ctx); err == nil {
+		t.Error("JSON array was accepted")
+	}
+}
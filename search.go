@@ -0,0 +1,221 @@
+package main
+
+import (
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Search index:
+ *   1. Every file has an entry in the search collection, kept up to date by the functions changing folders
+ *   2. Entries hold what can be searched, lower case names and ancestors letting MongoDB use its indexes
+ *   3. Search selects entries, then drops the ones the user cannot read, see search_services.go
+ * The index is built from the folders when the collection is empty, e.g. on the first start.
+ * Indexing a file also queues the extraction of its text, see content.go.
+ */
+
+const searchCollection = "search"
+
+type SearchEntry struct {
+	Path   string `bson:"_id" json:"path"`
+	Folder string `bson:"folder" json:"folder"`
+	Name   string `bson:"name" json:"name"`
+	// Lower case, names are matched without case
+	NameLower string `bson:"name_lower" json:"-"`
+	Ext       string `bson:"ext" json:"ext,omitempty"`
+	// The folder and its parents, a subtree is selected with a single value
+	Ancestors []string `bson:"ancestors" json:"-"`
+	// Bytes
+	Size int64 `bson:"size" json:"size"`
+	// Unix time
+	Uploaded int64 `bson:"uploaded" json:"uploaded"`
+	// Email of the user who uploaded the file, unknown for files older than the index
+	Uploader string   `bson:"uploader,omitempty" json:"uploader,omitempty"`
+	Tags     []string `bson:"tags" json:"tags"`
+}
+
+func ancestors(folder string) []string {
+	list := []string{"/"}
+
+	for i := 1; i < len(folder); i++ {
+		if folder[i] == '/' {
+			list = append(list, folder[:i])
+		}
+	}
+
+	if folder != "/" {
+		list = append(list, folder)
+	}
+
+	return list
+}
+
+// extension returns the lower case extension of a name, without dot
+func extension(name string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+}
+
+// normalizeTags parses comma separated tags, they are matched without case
+func normalizeTags(s string) []string {
+	tags := []string{}
+
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	sort.Strings(tags)
+
+	return tags
+}
+
+// globPattern turns a glob such as report-*.pdf into an anchored regular expression,
+// MongoDB then only reads the index keys starting with the characters before the first wildcard
+func globPattern(glob string) (string, error) {
+	if _, err := path.Match(glob, ""); err != nil {
+		return "", err
+	}
+
+	pattern := "^"
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			pattern += ".*"
+		case '?':
+			pattern += "."
+		case '\\':
+			i++
+			pattern += regexp.QuoteMeta(glob[i : i+1])
+		case '[':
+			// Classes have the same syntax, path.Match made sure this one is closed
+			end := i + 1
+
+			for glob[end] != ']' {
+				if glob[end] == '\\' {
+					end++
+				}
+
+				end++
+			}
+
+			pattern += glob[i : end+1]
+			i = end
+		default:
+			pattern += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+
+	return pattern + "$", nil
+}
+
+func newSearchEntry(folder, name string) *SearchEntry {
+	p := folder + "/" + name
+
+	if folder == "/" {
+		p = "/" + name
+	}
+
+	return &SearchEntry{
+		Path:      p,
+		Folder:    folder,
+		Name:      name,
+		NameLower: strings.ToLower(name),
+		Ext:       extension(name),
+		Ancestors: ancestors(folder),
+		Tags:      []string{},
+	}
+}
+
+// indexFile adds or replaces the entry of a file, size and time being those of its GridFS file
+func indexFile(folder, name string, id bson.ObjectId, uploader string, tags []string) {
+	e := newSearchEntry(folder, name)
+	e.Uploader = uploader
+
+	if tags != nil {
+		e.Tags = tags
+	}
+
+	var gf struct {
+		Length     int64     `bson:"length"`
+		UploadDate time.Time `bson:"uploadDate"`
+	}
+
+	if err := db.C("fs.files").FindId(id).One(&gf); err == nil {
+		e.Size, e.Uploaded = gf.Length, gf.UploadDate.Unix()
+	}
+
+	if _, err := db.C(searchCollection).UpsertId(e.Path, e); err != nil {
+		log.Printf("Cannot index %s: %s\n", e.Path, err)
+	}
+
+	queueExtraction(folder, name, id)
+}
+
+func unindexFile(p string) {
+	if err := db.C(searchCollection).RemoveId(p); err != nil && err != mgo.ErrNotFound {
+		log.Printf("Cannot remove %s from the index: %s\n", p, err)
+	}
+
+	removeContent(p)
+}
+
+// copyIndexEntry indexes a copy of a file, keeping its uploader and tags
+func copyIndexEntry(source, folder, name string, id bson.ObjectId) {
+	var src SearchEntry
+
+	if err := db.C(searchCollection).FindId(source).One(&src); err != nil {
+		indexFile(folder, name, id, "", nil)
+		return
+	}
+
+	e := newSearchEntry(folder, name)
+	e.Size, e.Uploaded, e.Uploader, e.Tags = src.Size, src.Uploaded, src.Uploader, src.Tags
+
+	if _, err := db.C(searchCollection).UpsertId(e.Path, e); err != nil {
+		log.Printf("Cannot index %s: %s\n", e.Path, err)
+	}
+
+	copyContent(source, folder, name, id)
+}
+
+func ensureSearchIndexes() {
+	c := db.C(searchCollection)
+
+	for _, key := range [][]string{{"ancestors", "name_lower"}, {"name_lower"}, {"ext"}, {"size"}, {"uploaded"}, {"uploader"}, {"tags"}} {
+		if err := c.EnsureIndex(mgo.Index{Key: key}); err != nil {
+			log.Printf("Cannot index the search collection: %s\n", err)
+		}
+	}
+
+	if n, err := c.Count(); err != nil || n > 0 {
+		return
+	}
+
+	iter := db.C("folders").Find(bson.M{"files.0": bson.M{"$exists": true}}).Iter()
+	var folder Folder
+	indexed := 0
+
+	for iter.Next(&folder) {
+		for _, f := range folder.Files {
+			indexFile(folder.Path, f.Name, f.FileID, "", f.Tags)
+			indexed++
+		}
+
+		folder = Folder{}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.Printf("Cannot build the search index: %s\n", err)
+	} else if indexed > 0 {
+		logInfo("Search index built with %d files\n", indexed)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Entries checked by Search, large subtrees needing more criteria
+const searchScanLimit = 10000
+
+type SearchPage struct {
+	Results []SearchEntry `json:"results"`
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	// Entries were left unread, more files may match
+	Truncated bool `json:"truncated"`
+}
+
+// intRange reads two integer arguments bounding a field
+func intRange(ctx *fasthttp.RequestCtx, min, max string) (bson.M, error) {
+	r := bson.M{}
+
+	for name, op := range map[string]string{min: "$gte", max: "$lte"} {
+		if v := string(ctx.FormValue(name)); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+
+			if err != nil {
+				return nil, errWrongArgs.WithDetails(name, "Integer expected")
+			}
+
+			r[op] = n
+		}
+	}
+
+	return r, nil
+}
+
+// searchSelector builds the query from the criteria given as arguments, names being matched without case
+func searchSelector(ctx *fasthttp.RequestCtx) (bson.M, error) {
+	selector := bson.M{}
+
+	if p := formatD(string(ctx.FormValue("path"))); p != "/" {
+		selector["ancestors"] = p
+	}
+
+	var names []bson.M
+
+	if prefix := strings.ToLower(string(ctx.FormValue("name"))); prefix != "" {
+		names = append(names, bson.M{"name_lower": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}})
+	}
+
+	// Unanchored, MongoDB reads every key of the name index, or of the folder when a path is given
+	if sub := strings.ToLower(string(ctx.FormValue("contains"))); sub != "" {
+		names = append(names, bson.M{"name_lower": bson.RegEx{Pattern: regexp.QuoteMeta(sub)}})
+	}
+
+	if glob := strings.ToLower(string(ctx.FormValue("glob"))); glob != "" {
+		pattern, err := globPattern(glob)
+
+		if err != nil {
+			return nil, errWrongArgs.WithDetails("glob", "Malformed pattern")
+		}
+
+		names = append(names, bson.M{"name_lower": bson.RegEx{Pattern: pattern}})
+	}
+
+	switch len(names) {
+	case 0:
+	case 1:
+		selector["name_lower"] = names[0]["name_lower"]
+	default:
+		selector["$and"] = names
+	}
+
+	if ext := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(string(ctx.FormValue("ext")))), "."); ext != "" {
+		selector["ext"] = ext
+	}
+
+	if uploader := strings.TrimSpace(string(ctx.FormValue("uploader"))); uploader != "" {
+		selector["uploader"] = uploader
+	}
+
+	if tags := normalizeTags(string(ctx.FormValue("tags"))); len(tags) > 0 {
+		selector["tags"] = bson.M{"$all": tags}
+	}
+
+	for field, bounds := range map[string][2]string{"size": {"min_size", "max_size"}, "uploaded": {"from", "to"}} {
+		r, err := intRange(ctx, bounds[0], bounds[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(r) > 0 {
+			selector[field] = r
+		}
+	}
+
+	return selector, nil
+}
+
+// Search lists the files matching every criteria in a folder and below it, sorted by path
+func (m *Miogo) Search(ctx *fasthttp.RequestCtx, u *User) error {
+	if hasArg(ctx, "path") {
+		p := formatD(string(ctx.FormValue("path")))
+
+		if folder, ok := m.FetchFolder(p); !ok {
+			return errFolderMissing.WithDetails("path", p)
+		} else if GetRightType(u, folder.Rights) < AllowedToRead {
+			return errAccessDenied
+		}
+	}
+
+	selector, err := searchSelector(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	page, perPage := pagination(ctx)
+	iter := scanCapped(db.C(searchCollection).Find(selector).Sort("_id"), searchScanLimit)
+	filter := newReadFilter(m, u)
+	results := []SearchEntry{}
+	total := 0
+
+	var e SearchEntry
+
+	for iter.Next(&e) {
+		// Entries of removed files are hidden as well
+		if _, ok := filter.canRead(e.Folder, true); ok {
+			if _, ok := filter.canRead(e.Path, false); ok {
+				total++
+
+				if total > (page-1)*perPage && len(results) < perPage {
+					results = append(results, e)
+				}
+			}
+		}
+
+		e = SearchEntry{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return errFailure
+	}
+
+	res, _ := json.Marshal(SearchPage{results, total, page, perPage, iter.truncated})
+
+	ctx.SetBody(res)
+	return nil
+}
+
+// SetTags replaces the tags of a file, an empty list removing them
+func (m *Miogo) SetTags(ctx *fasthttp.RequestCtx, u *User) error {
+	p := formatD(string(ctx.FormValue("path")))
+	file, ok := m.FetchFile(p)
+
+	if !ok {
+		return errFileNotFound
+	}
+
+	if GetRightType(u, file.Rights) < AllowedToWrite {
+		return errAccessDenied
+	}
+
+	tags := normalizeTags(string(ctx.FormValue("tags")))
+	d, f := formatF(p)
+
+	if err := db.C("folders").Update(bson.M{"path": d, "files.name": f}, bson.M{"$set": bson.M{"files.$.tags": tags}}); err != nil {
+		return errFailure
+	}
+
+	m.filesCache.Invalidate(p)
+	m.foldersCache.Invalidate(d)
+
+	if err := db.C(searchCollection).UpdateId(p, bson.M{"$set": bson.M{"tags": tags}}); err != nil {
+		indexFile(d, f, file.FileID, "", tags)
+	}
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGlobPattern(t *testing.T) {
+	for glob, names := range map[string]map[string]bool{
+		"report-*.pdf": {"report-2024.pdf": true, "report-.pdf": true, "report.pdf": false, "a-report-1.pdf": false},
+		"?.txt":        {"a.txt": true, "ab.txt": false},
+		"[a-c]*.md":    {"b.md": true, "d.md": false},
+		"[^a]x":        {"bx": true, "ax": false},
+		`\*.go`:        {"*.go": true, "a.go": false},
+		"a+b(1).txt":   {"a+b(1).txt": true, "aab(1).txt": false},
+	} {
+		pattern, err := globPattern(glob)
+
+		if err != nil {
+			t.Fatalf("%s: %s", glob, err)
+		}
+
+		re := regexp.MustCompile(pattern)
+
+		for name, expected := range names {
+			if re.MatchString(name) != expected {
+				t.Errorf("%s (%s) matching %s: expected %v", glob, pattern, name, expected)
+			}
+		}
+	}
+
+	for _, glob := range []string{"[a", `a\`} {
+		if _, err := globPattern(glob); err == nil {
+			t.Errorf("%s should be malformed", glob)
+		}
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	for folder, expected := range map[string][]string{
+		"/":     {"/"},
+		"/a":    {"/", "/a"},
+		"/a/bc": {"/", "/a", "/a/bc"},
+	} {
+		if got := ancestors(folder); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", folder, expected, got)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	if got := normalizeTags(" Invoice, 2024,,invoice "); !reflect.DeepEqual(got, []string{"2024", "invoice"}) {
+		t.Errorf("Wrong tags %v", got)
+	}
+
+	if got := normalizeTags(""); len(got) != 0 {
+		t.Errorf("Wrong tags %v", got)
+	}
+}
+
+func TestSearchSelector(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/?path=/docs/&name=Rep&ext=.PDF&min_size=10&tags=b,A&uploader=u@miogo.tld")
+
+	selector, err := searchSelector(&ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bson.M{
+		"ancestors":  "/docs",
+		"name_lower": bson.RegEx{Pattern: "^rep"},
+		"ext":        "pdf",
+		"size":       bson.M{"$gte": int64(10)},
+		"tags":       bson.M{"$all": []string{"a", "b"}},
+		"uploader":   "u@miogo.tld",
+	}
+
+	if !reflect.DeepEqual(selector, expected) {
+		t.Errorf("Expected %v, got %v", expected, selector)
+	}
+
+	ctx.Request.SetRequestURI("/?name=a&contains=b")
+
+	if selector, _ := searchSelector(&ctx); len(selector["$and"].([]bson.M)) != 2 {
+		t.Errorf("Name criteria not combined: %v", selector)
+	}
+
+	for _, args := range []string{"glob=[a", "max_size=big"} {
+		ctx.Request.SetRequestURI("/?" + args)
+
+		if _, err := searchSelector(&ctx); err == nil {
+			t.Errorf("%s should be refused", args)
+		}
+	}
+}
@@ -2,176 +2,754 @@ package main
 
 import (
 	"log"
+	"net"
 	"os"
-	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type MiogoConfig struct {
-	MongoDBHost     string
-	TemporaryFolder string
-	SessionDuration int
+	MongoDBHost     string `default:"localhost"`
+	TemporaryFolder string `default:""`
+	SessionDuration int    `default:"30"`
+	Session         SessionConfig
+	// "error", "info" or "debug"
+	LogLevel string `default:"info"`
+	// Seconds given to in-flight requests on shutdown
+	ShutdownTimeout int `default:"30"`
 	AdminEmail      string
 	AdminPassword   string
+	// Header giving the client IP when Miogo is behind a proxy, e.g. X-Forwarded-For
+	ClientIPHeader string `default:""`
+	// Addresses serving HTTP, they redirect to HTTPS when TLS is set
+	Listen         []string `default:":8080"`
+	TLS            *TLSConfig
+	Limits         LimitsConfig
+	Caches         CachesConfig
+	Mail           *MailConfig
+	PasswordPolicy *PasswordPolicy
+	LDAP           *LDAPConfig
+	OIDC           *OIDCConfig
+	Metrics        *MetricsConfig
+	Cluster        *ClusterConfig
+	CORS           *CORSConfig
+	RateLimits     *RateLimitsConfig
+	Webhooks       WebhooksConfig
 }
 
 type Miogo struct {
-	conf              *MiogoConfig
-	services          map[string]func(*fasthttp.RequestCtx) error
-	sessionDuration   time.Duration
-	foldersCache      *Cache
-	filesCache        *Cache
-	filesContentCache *Cache
-	sessionsCache     *Cache
-	usersCache        *Cache
-	groupsCache       *Cache
+	conf               *MiogoConfig
+	services           map[string]func(*fasthttp.RequestCtx) error
+	registry           map[string]*Service
+	routes             []*Route
+	middlewares        []Middleware
+	serviceMiddlewares []Middleware
+	compiled           sync.Once
+	handler            Handler
+	chains             map[string]Handler
+	authProviders      []AuthProvider
+	metrics            *Metrics
+	bus                InvalidationBus
+	rateStore          RateLimitStore
+	events             *EventHub
+	webhooks           *webhookSender
+	extractor          *contentExtractor
+	sessionDuration    int64 // time.Duration, accessed atomically as it can be reloaded
+	foldersCache       *Cache
+	filesCache         *Cache
+	filesContentCache  *Cache
+	sessionsCache      *Cache
+	usersCache         *Cache
+	groupsCache        *Cache
+	webhooksCache      *Cache
 }
 
 func (m *Miogo) GetHandler() fasthttp.RequestHandler {
+	m.compiled.Do(m.compile)
+
 	return func(ctx *fasthttp.RequestCtx) {
-		if f, ok := m.services[string(ctx.Path())]; ok {
-			if err := f(ctx); err != nil {
-				ctx.Response.Reset()
-				ctx.SetContentType("application/json")
-				ctx.SetBodyString(jsonkv("error", err.Error()))
-			}
-		} else {
-			ctx.Error("Wrong service name", fasthttp.StatusNotFound)
-		}
+		respond(m.handler, ctx)
 	}
 }
 
-func NewMiogo() *Miogo {
-	var conf MiogoConfig
+func (m *Miogo) SessionDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.sessionDuration))
+}
 
-	md, err := toml.DecodeFile("miogo.conf", &conf)
+// Reload applies the settings which can change without a restart
+func (m *Miogo) Reload(conf *MiogoConfig) error {
+	level, err := parseLogLevel(conf.LogLevel)
 
 	if err != nil {
-		log.Fatalf("Error while loading configuration: %s", err)
+		return err
 	}
 
-	s := reflect.ValueOf(&conf).Elem().Type()
-	good := true
+	setLogLevel(level)
+	atomic.StoreInt64(&m.sessionDuration, int64(time.Duration(conf.SessionDuration)*time.Minute))
+
+	m.foldersCache.SetMemoryLimit(megabytes(conf.Caches.Folders))
+	m.filesCache.SetMemoryLimit(megabytes(conf.Caches.Files))
+	m.filesContentCache.SetMemoryLimit(megabytes(conf.Caches.FilesContent))
+	m.sessionsCache.SetMemoryLimit(megabytes(conf.Caches.Sessions))
+	m.usersCache.SetMemoryLimit(megabytes(conf.Caches.Users))
+	m.groupsCache.SetMemoryLimit(megabytes(conf.Caches.Groups))
+
+	return nil
+}
+
+// Close releases background resources, servers must be shut down first
+func (m *Miogo) Close() {
+	for _, c := range m.caches() {
+		c.Close()
+	}
+
+	if m.events != nil {
+		m.events.Close()
+	}
+
+	if m.webhooks != nil {
+		m.webhooks.close()
+	}
+
+	if m.extractor != nil {
+		m.extractor.close()
+	}
+
+	if m.bus != nil {
+		m.bus.Close()
+	}
 
-	for i := 0; i < s.NumField(); i++ {
-		f := s.Field(i).Name
-		if !md.IsDefined(f) {
-			log.Printf("Lacking configuration field: %s\n", f)
-			good = false
+	db.Session.Close()
+}
+
+// NewServer returns a server accepting bodies within the configured limits
+func (m *Miogo) NewServer(handler fasthttp.RequestHandler) *fasthttp.Server {
+	limit := m.conf.Limits.MaxRequestBodySize
+
+	if m.conf.Limits.MaxUploadSize > limit {
+		limit = m.conf.Limits.MaxUploadSize
+	}
+
+	return &fasthttp.Server{
+		Handler:            handler,
+		MaxRequestBodySize: int(megabytes(limit)),
+	}
+}
+
+func redirectToHTTPS(port string) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		host := string(ctx.Host())
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
 		}
+
+		ctx.Redirect("https://"+host+string(ctx.RequestURI()), fasthttp.StatusMovedPermanently)
+	}
+}
+
+func NewMiogo(conf *MiogoConfig) *Miogo {
+	level, err := parseLogLevel(conf.LogLevel)
+
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if !good {
-		log.Fatalf("Please provide the required data in the configuration file")
+	setLogLevel(level)
+
+	if _, err := sameSiteMode(conf.Session.SameSite); err != nil {
+		log.Fatal(err)
 	}
 
-	os.Setenv("TMPDIR", conf.TemporaryFolder)
+	if conf.TemporaryFolder != "" {
+		os.Setenv("TMPDIR", conf.TemporaryFolder)
+	}
 
 	InitDB(conf.MongoDBHost, conf.AdminEmail, conf.AdminPassword)
 
 	miogo := Miogo{
-		&conf,
-		make(map[string]func(*fasthttp.RequestCtx) error),
-		time.Duration(conf.SessionDuration) * time.Minute,
-		NewCache(0),
-		NewCache(0),
-		NewCache(64 >> 20), // 64 megabytes
-		NewCache(0),
-		NewCache(0),
-		NewCache(0),
-	}
-
-	miogo.RegisterService(&Service{
-		Handler:         miogo.GetFile,
+		conf:              conf,
+		services:          make(map[string]func(*fasthttp.RequestCtx) error),
+		registry:          make(map[string]*Service),
+		sessionDuration:   int64(time.Duration(conf.SessionDuration) * time.Minute),
+		foldersCache:      NewCache(megabytes(conf.Caches.Folders)),
+		filesCache:        NewCache(megabytes(conf.Caches.Files)),
+		filesContentCache: NewCache(megabytes(conf.Caches.FilesContent)),
+		sessionsCache:     NewCache(megabytes(conf.Caches.Sessions)),
+		usersCache:        NewCache(megabytes(conf.Caches.Users)),
+		groupsCache:       NewCache(megabytes(conf.Caches.Groups)),
+		webhooksCache:     NewCache(0),
+		metrics:           NewMetrics(),
+	}
+
+	miogo.Use(RequestIDMiddleware, AccessLogMiddleware, RecoverMiddleware)
+
+	if conf.CORS != nil {
+		miogo.Use(CORSMiddleware(conf.CORS))
+	}
+
+	miogo.sessionsCache.RegisterMatcher("user", sessionsOfUser)
+
+	if conf.Cluster == nil || conf.Cluster.Bus != "none" {
+		var size int
+
+		if conf.Cluster != nil {
+			size = conf.Cluster.BusSize
+		}
+
+		bus, err := NewMongoBus(db, size)
+
+		if err != nil {
+			log.Fatalf("Cannot start the invalidation bus: %s", err)
+		}
+
+		miogo.bus = bus
+		connectCaches(bus, bson.NewObjectId().Hex(), miogo.caches())
+
+		if miogo.events, err = NewMongoEventHub(db, size); err != nil {
+			log.Fatalf("Cannot start the event stream: %s", err)
+		}
+	} else {
+		miogo.events = NewEventHub(nil)
+	}
+
+	if rl := conf.RateLimits; rl != nil {
+		switch rl.Store {
+		case "memory":
+			miogo.rateStore = NewMemoryRateStore()
+		case "mongo":
+			if miogo.rateStore, err = NewMongoRateStore(); err != nil {
+				log.Fatalf("Cannot create the rate limits store: %s", err)
+			}
+		default:
+			log.Fatalf("Unknown rate limits store %s", rl.Store)
+		}
+	}
+
+	if conf.Metrics != nil && conf.Metrics.Listen == "" {
+		miogo.services["/metrics"] = miogo.ServeMetrics
+	}
+
+	miogo.RegisterAuthProvider(&localAuth{&miogo})
+
+	if conf.LDAP != nil {
+		miogo.RegisterAuthProvider(&ldapAuth{&miogo, conf.LDAP})
+	}
+
+	if conf.OIDC != nil {
+		o := newOIDCAuth(&miogo, conf.OIDC)
+		miogo.services["/oidc/login"] = o.Login
+		miogo.services["/oidc/callback"] = o.Callback
+	}
+
+	ensureAuditIndexes()
+	ensureActivityIndexes()
+	ensureWebhookIndexes()
+	ensureFileMetadata()
+	ensureSearchIndexes()
+	ensureContentIndexes()
+	miogo.extractor = newContentExtractor()
+	miogo.webhooks = newWebhookSender(&conf.Webhooks)
+	miogo.registerServices()
+	miogo.services["/openapi.json"] = miogo.ServeOpenAPI
+
+	return &miogo
+}
+
+func (m *Miogo) registerServices() {
+	m.RegisterService(&Service{
+		Handler:         m.GetFile,
 		Options:         NoJSON,
+		Description:     "Downloads the content of a file",
 		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the file"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.Remove,
-		Options:         NoJSON,
+	m.RegisterService(&Service{
+		Handler:         m.PutFile,
+		Options:         LargeBody | RawBody | Audited,
+		Description:     "Stores the request body as the content of a file, replacing it if the file exists",
 		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the file"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.Copy,
-		Options:         NoJSON,
+	m.RegisterService(&Service{
+		Handler:         m.Remove,
+		Options:         Audited,
+		Description:     "Removes a file or a folder with its content",
+		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the file or folder"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.Copy,
+		Options:         Audited,
+		Description:     "Copies a file or a folder into another folder",
 		MandatoryFields: []string{"path", "destination"},
+		Fields: []Field{
+			{"path", "string", "Path of the file or folder to copy"},
+			{"destination", "string", "Path of the destination folder"},
+			{"destFilename", "string", "Name of the copy, the source name by default"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.Move,
-		Options:         NoJSON,
+	m.RegisterService(&Service{
+		Handler:         m.Move,
+		Options:         Audited,
+		Description:     "Moves a file or a folder into another folder",
 		MandatoryFields: []string{"path", "destination"},
+		Fields: []Field{
+			{"path", "string", "Path of the file or folder to move"},
+			{"destination", "string", "Path of the destination folder"},
+			{"destFilename", "string", "New name, the source name by default"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.GetFolder,
+	m.RegisterService(&Service{
+		Handler:         m.GetFolder,
+		Description:     "Returns a folder with its files and subfolders",
 		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the folder"},
+			{"children", "boolean", "List files and subfolders, true unless set to false"},
+		},
+		Response: Folder{},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.NewFolder,
+	m.RegisterService(&Service{
+		Handler:         m.NewFolder,
+		Options:         Audited,
+		Description:     "Creates a folder, its parent must exist",
 		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the new folder"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler: miogo.Upload,
+	m.RegisterService(&Service{
+		Handler:         m.Upload,
+		Options:         LargeBody | Audited,
+		Description:     "Uploads files into a folder with a multipart form",
+		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the destination folder"},
+			{"file", "file", "Files to upload, the field can be repeated"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.Login,
-		Options:         NoLoginCheck,
+	m.RegisterService(&Service{
+		Handler:         m.Login,
+		Options:         NoLoginCheck | Audited,
+		Description:     "Opens a session, its ID is given in the session cookie",
 		MandatoryFields: []string{"email", "password"},
+		Fields: []Field{
+			{"email", "string", "Email of the user"},
+			{"password", "string", "Password of the user"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler: miogo.Logout,
+	m.RegisterService(&Service{
+		Handler:     m.Logout,
+		Options:     Audited,
+		Description: "Closes the current session",
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.NewUser,
-		MandatoryFields: []string{"email", "password"},
+	m.RegisterService(&Service{
+		Handler:         m.NewUser,
+		Options:         Audited,
+		Description:     "Creates a user, admins only",
+		MandatoryFields: []string{"email"},
+		Fields: []Field{
+			{"email", "string", "Email of the new user"},
+			{"password", "string", "Password, it must follow the password policy, mandatory without source"},
+			{"source", "string", "ldap or oidc for a user logging in through this provider only, without password"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.RemoveUser,
+		Options:         Audited,
+		Description:     "Removes a user, admins only",
+		MandatoryFields: []string{"email"},
+		Fields: []Field{
+			{"email", "string", "Email of the user"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:     m.Me,
+		Description: "Returns the logged in user",
+		Response:    User{},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.RemoveUser,
+	m.RegisterService(&Service{
+		Handler:         m.GetUser,
+		Description:     "Returns a user",
 		MandatoryFields: []string{"email"},
+		Fields: []Field{
+			{"email", "string", "Email of the user"},
+		},
+		Response: User{},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.NewGroup,
+	m.RegisterService(&Service{
+		Handler:     m.ListUsers,
+		Description: "Lists users, admins only",
+		Fields: []Field{
+			{"search", "string", "Part of the email or display name, case insensitive"},
+			{"page", "integer", "Page number, starting at 1"},
+			{"per_page", "integer", "Number of users by page"},
+		},
+		Response: UserPage{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.UpdateProfile,
+		Description:     "Updates the profile of the logged in user",
+		AtLeastOneField: []string{"display_name", "locale", "avatar"},
+		Fields: []Field{
+			{"display_name", "string", "Name displayed instead of the email"},
+			{"locale", "string", "Language tag such as fr_FR"},
+			{"avatar", "string", "HTTP(S) URL of a picture"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.ChangePassword,
+		Options:         Audited,
+		Description:     "Changes the password of the logged in user",
+		MandatoryFields: []string{"password", "new_password"},
+		Fields: []Field{
+			{"password", "string", "Current password"},
+			{"new_password", "string", "New password, it must follow the password policy"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.RequestPasswordReset,
+		Options:         NoLoginCheck | Audited,
+		Description:     "Sends a password reset link by mail, it succeeds even if the user does not exist",
+		MandatoryFields: []string{"email"},
+		Fields: []Field{
+			{"email", "string", "Email of the user"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.ResetPassword,
+		Options:         NoLoginCheck | Audited,
+		Description:     "Sets a new password with a token sent by RequestPasswordReset",
+		MandatoryFields: []string{"token", "password"},
+		Fields: []Field{
+			{"token", "string", "Token given in the reset link"},
+			{"password", "string", "New password, it must follow the password policy"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.NewGroup,
+		Options:         Audited,
+		Description:     "Creates a group",
 		MandatoryFields: []string{"name"},
+		Fields: []Field{
+			{"name", "string", "Name of the group"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.RemoveGroup,
+	m.RegisterService(&Service{
+		Handler:         m.RemoveGroup,
+		Options:         Audited,
+		Description:     "Removes a group",
 		MandatoryFields: []string{"name"},
+		Fields: []Field{
+			{"name", "string", "Name of the group"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.AddUserToGroup,
+	m.RegisterService(&Service{
+		Handler:         m.AddUserToGroup,
+		Options:         Audited,
+		Description:     "Adds a user to a group",
 		MandatoryFields: []string{"user", "group"},
+		Fields: []Field{
+			{"user", "string", "Email of the user"},
+			{"group", "string", "Name of the group"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.RemoveUserFromGroup,
+	m.RegisterService(&Service{
+		Handler:         m.RemoveUserFromGroup,
+		Options:         Audited,
+		Description:     "Removes a user from a group",
 		MandatoryFields: []string{"user", "group"},
+		Fields: []Field{
+			{"user", "string", "Email of the user"},
+			{"group", "string", "Name of the group"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.SetGroupAdmin,
+	m.RegisterService(&Service{
+		Handler:         m.SetGroupAdmin,
+		Options:         Audited,
+		Description:     "Makes a user an admin of a group",
 		MandatoryFields: []string{"user", "group"},
+		Fields: []Field{
+			{"user", "string", "Email of the user"},
+			{"group", "string", "Name of the group"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.AddGroupToGroup,
+		Options:         Audited,
+		Description:     "Nests a group in another one, its members become members of the parent group",
+		MandatoryFields: []string{"subgroup", "group"},
+		Fields: []Field{
+			{"subgroup", "string", "Name of the nested group"},
+			{"group", "string", "Name of the parent group"},
+		},
 	})
 
-	miogo.RegisterService(&Service{
-		Handler:         miogo.SetResourceRights,
+	m.RegisterService(&Service{
+		Handler:         m.RemoveGroupFromGroup,
+		Options:         Audited,
+		Description:     "Removes a nested group from its parent",
+		MandatoryFields: []string{"subgroup", "group"},
+		Fields: []Field{
+			{"subgroup", "string", "Name of the nested group"},
+			{"group", "string", "Name of the parent group"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.RemoveGroupAdmin,
+		Options:         Audited,
+		Description:     "Removes a user from the admins of a group",
+		MandatoryFields: []string{"user", "group"},
+		Fields: []Field{
+			{"user", "string", "Email of the user"},
+			{"group", "string", "Name of the group"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:     m.ListGroups,
+		Description: "Lists groups",
+		Fields: []Field{
+			{"search", "string", "Part of the name, case insensitive"},
+			{"page", "integer", "Page number, starting at 1"},
+			{"per_page", "integer", "Number of groups by page"},
+		},
+		Response: GroupPage{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.GetGroup,
+		Description:     "Returns a group with its members and nested groups",
+		MandatoryFields: []string{"name"},
+		Fields: []Field{
+			{"name", "string", "Name of the group"},
+		},
+		Response: GroupDetails{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.RenameGroup,
+		Options:         Audited,
+		Description:     "Renames a group everywhere it is referenced",
+		MandatoryFields: []string{"name", "new_name"},
+		Fields: []Field{
+			{"name", "string", "Current name of the group"},
+			{"new_name", "string", "New name of the group"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.SetResourceRights,
+		Options:         Audited,
+		Description:     "Sets the rights of a user, a group or everyone on a file or a folder",
 		MandatoryFields: []string{"resource", "rights"},
 		AtLeastOneField: []string{"user", "group", "all"},
+		Fields: []Field{
+			{"resource", "string", "Path of the file or folder"},
+			{"rights", "string", "One of n, r, rw or rwa (read, write and change rights)"},
+			{"user", "string", "Email of the user"},
+			{"group", "string", "Name of the group"},
+			{"all", "string", "Set to apply the rights to everyone"},
+		},
 	})
 
-	return &miogo
+	m.RegisterService(&Service{
+		Handler:         m.GetActivity,
+		Description:     "Lists recent changes in a folder and below it, newest first, similar consecutive changes being grouped",
+		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of the folder"},
+			{"before", "integer", "Unix time, only older changes are listed"},
+			{"limit", "integer", "Maximum number of activities"},
+		},
+		Response: ActivityFeed{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.Events,
+		Options:         NoJSON,
+		Description:     "Streams the changes in folders and below them as Server-Sent Events, until the client disconnects",
+		MandatoryFields: []string{"path"},
+		Fields: []Field{
+			{"path", "string", "Path of a folder, can be given several times"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:     m.Search,
+		Description: "Lists the files matching every criteria given in a folder and below it, sorted by path",
+		Fields: []Field{
+			{"path", "string", "Path of the folder, / by default"},
+			{"name", "string", "Beginning of the name, without case"},
+			{"contains", "string", "Part of the name, without case, slower than name and glob on large folders"},
+			{"glob", "string", "Pattern matching the whole name with *, ? and [...], without case"},
+			{"ext", "string", "Extension, e.g. pdf"},
+			{"min_size", "integer", "Minimum size in bytes"},
+			{"max_size", "integer", "Maximum size in bytes"},
+			{"from", "integer", "Unix time of the oldest uploads"},
+			{"to", "integer", "Unix time of the newest uploads"},
+			{"uploader", "string", "Email of the user who uploaded the files"},
+			{"tags", "string", "Comma separated tags the files must all have"},
+			{"page", "integer", "Page number, starting at 1"},
+			{"per_page", "integer", "Number of files by page"},
+		},
+		Response: SearchPage{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.SearchContent,
+		Description:     "Lists the documents containing words, best matches first, with highlighted extracts of their text",
+		MandatoryFields: []string{"query"},
+		Fields: []Field{
+			{"query", "string", "Words to find, \"quoted phrases\" and -excluded words being supported"},
+			{"path", "string", "Path of the folder, / by default"},
+			{"page", "integer", "Page number, starting at 1"},
+			{"per_page", "integer", "Number of documents by page"},
+		},
+		Response: ContentPage{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.SetTags,
+		Options:         Audited,
+		Description:     "Replaces the tags of a file",
+		MandatoryFields: []string{"path", "tags"},
+		Fields: []Field{
+			{"path", "string", "Path of the file"},
+			{"tags", "string", "Comma separated tags, empty to remove them"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.AddWebhook,
+		Options:         Audited,
+		Description:     "Registers a URL receiving signed POST requests on changes in a folder and below it, admins only",
+		MandatoryFields: []string{"url", "prefix", "secret"},
+		Fields: []Field{
+			{"url", "string", "HTTP or HTTPS URL of the receiver"},
+			{"prefix", "string", "Path of the folder"},
+			{"events", "string", "Comma separated actions among upload, update, new_folder, remove, copy and move, all of them by default"},
+			{"secret", "string", "Key of the HMAC-SHA256 signature sent in the X-Miogo-Signature header"},
+		},
+		Response: Webhook{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:     m.ListWebhooks,
+		Description: "Lists the webhooks, admins only",
+		Response:    WebhookList{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.RemoveWebhook,
+		Options:         Audited,
+		Description:     "Removes a webhook, its pending deliveries are given up, admins only",
+		MandatoryFields: []string{"id"},
+		Fields: []Field{
+			{"id", "string", "ID of the webhook"},
+		},
+	})
+
+	m.RegisterService(&Service{
+		Handler:         m.GetWebhookDeliveries,
+		Description:     "Lists the deliveries of a webhook with their attempts, newest first, admins only",
+		MandatoryFields: []string{"webhook"},
+		Fields: []Field{
+			{"webhook", "string", "ID of the webhook"},
+			{"status", "string", "pending, delivered or failed"},
+			{"page", "integer", "Page number, starting at 1"},
+			{"per_page", "integer", "Number of deliveries by page"},
+		},
+		Response: DeliveryPage{},
+	})
+
+	m.RegisterService(&Service{
+		Handler:     m.GetAuditLog,
+		Description: "Lists the audit log, newest entries first, admins only",
+		Fields: []Field{
+			{"actor", "string", "Email of the user who called the services"},
+			{"service", "string", "Name of the service called"},
+			{"path", "string", "File or folder, folders include everything below them"},
+			{"outcome", "string", "success, failure or an error code"},
+			{"from", "integer", "Unix time of the oldest entries"},
+			{"to", "integer", "Unix time of the newest entries"},
+			{"page", "integer", "Page number, starting at 1"},
+			{"per_page", "integer", "Number of entries by page"},
+			{"format", "string", "json (default) or csv to export every matching entry"},
+		},
+		Response: AuditPage{},
+	})
+
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/files", Param: "path", Service: "GetFile"})
+	m.RegisterRoute(&Route{Method: "PUT", Prefix: "/api/v1/files", Param: "path", Service: "PutFile"})
+	m.RegisterRoute(&Route{Method: "DELETE", Prefix: "/api/v1/files", Param: "path", Service: "Remove"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/folders", Param: "path", Service: "GetFolder", Defaults: map[string]string{"children": "false"}})
+	m.RegisterRoute(&Route{Method: "PUT", Prefix: "/api/v1/folders", Param: "path", Service: "NewFolder"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/folders", Param: "path", Service: "Upload"})
+	m.RegisterRoute(&Route{Method: "DELETE", Prefix: "/api/v1/folders", Param: "path", Service: "Remove"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/copy", Service: "Copy"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/move", Service: "Move"})
+	m.RegisterRoute(&Route{Method: "PUT", Prefix: "/api/v1/rights", Service: "SetResourceRights"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/session", Service: "Login"})
+	m.RegisterRoute(&Route{Method: "DELETE", Prefix: "/api/v1/session", Service: "Logout"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/activity", Param: "path", Service: "GetActivity"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/audit", Service: "GetAuditLog"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/search", Service: "Search"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/search/content", Service: "SearchContent"})
+	m.RegisterRoute(&Route{Method: "PUT", Prefix: "/api/v1/tags", Param: "path", Service: "SetTags"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/webhooks", Service: "ListWebhooks"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/webhooks", Service: "AddWebhook"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/deliveries/", Param: "webhook", Service: "GetWebhookDeliveries"})
+	m.RegisterRoute(&Route{Method: "DELETE", Prefix: "/api/v1/webhooks/", Param: "id", Service: "RemoveWebhook"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/events", Service: "Events"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/me", Service: "Me"})
+	m.RegisterRoute(&Route{Method: "PATCH", Prefix: "/api/v1/me", Service: "UpdateProfile"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/users", Service: "ListUsers"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/users", Service: "NewUser"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/users/", Param: "email", Service: "GetUser"})
+	m.RegisterRoute(&Route{Method: "DELETE", Prefix: "/api/v1/users/", Param: "email", Service: "RemoveUser"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/groups", Service: "ListGroups"})
+	m.RegisterRoute(&Route{Method: "POST", Prefix: "/api/v1/groups", Service: "NewGroup"})
+	m.RegisterRoute(&Route{Method: "GET", Prefix: "/api/v1/groups/", Param: "name", Service: "GetGroup"})
+	m.RegisterRoute(&Route{Method: "DELETE", Prefix: "/api/v1/groups/", Param: "name", Service: "RemoveGroup"})
 }
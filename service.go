@@ -13,6 +13,12 @@ type ServiceOption int
 const (
 	NoJSON ServiceOption = (1 << iota)
 	NoLoginCheck
+	// Accept bodies up to the upload size limit instead of the request one
+	LargeBody
+	// The body is content rather than arguments, it must not be parsed as JSON
+	RawBody
+	// Every call is recorded in the audit log
+	Audited
 )
 
 type ServiceFunc func(*fasthttp.RequestCtx, *User) error
@@ -21,8 +27,22 @@ type Service struct {
 	Name            string
 	Handler         ServiceFunc
 	Options         ServiceOption
+	Description     string
 	MandatoryFields []string
 	AtLeastOneField []string
+	// Every accepted field, including the optional ones
+	Fields []Field
+	// A value of the type written in the response, nil when it is {"success": "true"}
+	Response interface{}
+	// Run after the middlewares given to UseForServices
+	Middlewares []Middleware
+}
+
+type Field struct {
+	Name string
+	// "string", "integer", "boolean" or "file"
+	Type        string
+	Description string
 }
 
 func (m *Miogo) RegisterService(s *Service) {
@@ -31,46 +51,50 @@ func (m *Miogo) RegisterService(s *Service) {
 		s.Name = strings.Split(s.Name[strings.LastIndex(s.Name, ".")+1:], "-")[0]
 	}
 
-	m.services["/"+s.Name] = func(ctx *fasthttp.RequestCtx) error {
-		var ok bool
+	m.registry[s.Name] = s
 
+	m.services["/"+s.Name] = func(ctx *fasthttp.RequestCtx) error {
 		if !ctx.Request.Header.IsPost() {
-			ctx.Error("Please send POST requests", fasthttp.StatusBadRequest)
-			return nil
+			return errNotPOST
 		}
 
-		if ok = s.Validate(ctx.PostArgs()); !ok {
-			ctx.Error("Wrong arguments", fasthttp.StatusBadRequest)
-			return nil
-		}
+		return m.serve(s, ctx)
+	}
+}
 
-		var u *User
+// serve runs a service whatever the way it was reached, arguments being already in the request
+func (m *Miogo) serve(s *Service, ctx *fasthttp.RequestCtx) error {
+	m.compiled.Do(m.compile)
+	ctx.SetUserValue(serviceKey, s)
 
-		if s.Options&NoLoginCheck == 0 {
-			if u, ok = m.GetUserFromRequest(ctx); !ok {
-				ctx.Error("Not logged in", fasthttp.StatusForbidden)
-				return nil
-			}
-		}
+	return m.chains[s.Name](ctx)
+}
 
-		if s.Options&NoJSON == 0 {
-			ctx.SetContentType("application/json")
-		}
+func (s *Service) argumentsError() *Error {
+	var kv []string
 
-		return s.Handler(ctx, u)
+	if len(s.MandatoryFields) > 0 {
+		kv = append(kv, "mandatory", strings.Join(s.MandatoryFields, ","))
 	}
+
+	if len(s.AtLeastOneField) > 0 {
+		kv = append(kv, "at_least_one", strings.Join(s.AtLeastOneField, ","))
+	}
+
+	return errWrongArgs.WithDetails(kv...)
 }
 
-func (s *Service) Validate(a *fasthttp.Args) bool {
+// Validate checks arguments given in the query string, the form or a JSON body
+func (s *Service) Validate(ctx *fasthttp.RequestCtx) bool {
 	for _, v := range s.MandatoryFields {
-		if !a.Has(v) {
+		if !hasArg(ctx, v) {
 			return false
 		}
 	}
 
 	if len(s.AtLeastOneField) > 0 {
 		for _, v := range s.AtLeastOneField {
-			if a.Has(v) {
+			if hasArg(ctx, v) {
 				return true
 			}
 		}
@@ -1,30 +1,49 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	miogo   *Miogo
 	session string
+	csrf    string
 )
 
 func init() {
-	miogo = NewMiogo()
-	server := &fasthttp.Server{Handler: miogo.GetHandler()}
-	go server.ListenAndServe(":8080")
+	conf, err := LoadConfig(nil)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	miogo = NewMiogo(conf)
+	go miogo.NewServer(miogo.GetHandler()).ListenAndServe(":8080")
+}
+
+// authenticate gives the session and its CSRF token to a request
+func authenticate(request *http.Request) {
+	request.AddCookie(&http.Cookie{Name: "session", Value: session})
+	request.Header.Set("X-CSRF-Token", csrf)
 }
 
 func downloadAndHash(path string) string {
@@ -34,7 +53,7 @@ func downloadAndHash(path string) string {
 		return ""
 	}
 
-	request.AddCookie(&http.Cookie{Name: "session", Value: session})
+	authenticate(request)
 	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	res, err := http.DefaultClient.Do(request)
 
@@ -68,11 +87,11 @@ func hashFile(file string) string {
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
-func upload(file, path, expected string) (bool, string) {
+func uploadRequest(file, path string) (*http.Request, error) {
 	f, err := os.Open(file)
 
 	if err != nil {
-		return false, err.Error()
+		return nil, err
 	}
 
 	defer f.Close()
@@ -82,13 +101,13 @@ func upload(file, path, expected string) (bool, string) {
 	part, err := writer.CreateFormFile("file", filepath.Base(file))
 
 	if err != nil {
-		return false, err.Error()
+		return nil, err
 	}
 
 	_, err = io.Copy(part, f)
 
 	if err != nil {
-		return false, err.Error()
+		return nil, err
 	}
 
 	writer.WriteField("path", path)
@@ -96,17 +115,27 @@ func upload(file, path, expected string) (bool, string) {
 	err = writer.Close()
 
 	if err != nil {
-		return false, err.Error()
+		return nil, err
 	}
 
 	request, err := http.NewRequest("POST", "http://localhost:8080/Upload", body)
 
 	if err != nil {
-		return false, err.Error()
+		return nil, err
 	}
 
 	request.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
 
+	return request, nil
+}
+
+func upload(file, path, expected string) (bool, string) {
+	request, err := uploadRequest(file, path)
+
+	if err != nil {
+		return false, err.Error()
+	}
+
 	return testRequest(request, expected)
 }
 
@@ -124,7 +153,7 @@ func testUpload(t *testing.T, file, path, expected string) {
 
 func testRequest(request *http.Request, expected string) (bool, string) {
 	if session != "" {
-		request.AddCookie(&http.Cookie{Name: "session", Value: session})
+		authenticate(request)
 	}
 
 	res, err := http.DefaultClient.Do(request)
@@ -150,8 +179,11 @@ func testRequest(request *http.Request, expected string) (bool, string) {
 	}
 
 	for _, v := range res.Cookies() {
-		if v.Name == "session" {
+		switch v.Name {
+		case "session":
 			session = v.Value
+		case "csrf_token":
+			csrf = v.Value
 		}
 	}
 
@@ -176,6 +208,77 @@ func testPOST(t *testing.T, service, params, expected string) {
 	}
 }
 
+func testPOSTContains(t *testing.T, service, params string, expected ...string) {
+	request, err := http.NewRequest("POST", "http://localhost:8080/"+service, strings.NewReader(params))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	authenticate(request)
+
+	res, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+
+	for _, e := range expected {
+		if !strings.Contains(string(b), e) {
+			t.Errorf("Expected '%s' in '%s'", e, string(b))
+		}
+	}
+}
+
+func testPOSTError(t *testing.T, service, params string, status int, code string) {
+	request, err := http.NewRequest("POST", "http://localhost:8080/"+service, strings.NewReader(params))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testError(t, request, status, code)
+}
+
+func testUploadError(t *testing.T, file, path string, status int, code string) {
+	request, err := uploadRequest(file, path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testError(t, request, status, code)
+}
+
+func testError(t *testing.T, request *http.Request, status int, code string) {
+	if session != "" {
+		authenticate(request)
+	}
+
+	res, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	var e Error
+
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != status || e.Code != code || e.Message == "" {
+		t.Errorf("Expected %d %s, got %s %+v", status, code, res.Status, e)
+	}
+}
+
 func testFailPOST(t *testing.T, service, params string) {
 	if ok, _ := sendPOST(service, params, ""); ok {
 		t.Error("Test should have failed but succeeded")
@@ -191,8 +294,8 @@ func TestArgs(t *testing.T) {
 }
 
 func TestLogin(t *testing.T) {
-	testPOST(t, "Login", fmt.Sprintf("email=%sXXX&password=%s", miogo.conf.AdminEmail, miogo.conf.AdminPassword), jsonkv("error", "User does not exist"))
-	testPOST(t, "Login", fmt.Sprintf("email=%s&password=%sXXX", miogo.conf.AdminEmail, miogo.conf.AdminPassword), jsonkv("error", "Wrong password"))
+	testPOSTError(t, "Login", fmt.Sprintf("email=%sXXX&password=%s", miogo.conf.AdminEmail, miogo.conf.AdminPassword), fasthttp.StatusNotFound, "user_not_found")
+	testPOSTError(t, "Login", fmt.Sprintf("email=%s&password=%sXXX", miogo.conf.AdminEmail, miogo.conf.AdminPassword), fasthttp.StatusUnauthorized, "wrong_password")
 
 	if session != "" {
 		t.Error("Session cookie should not have been returned by the server")
@@ -205,42 +308,241 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestCSRF(t *testing.T) {
+	if csrf != csrfToken(session) {
+		t.Errorf("Wrong CSRF token %s", csrf)
+	}
+
+	token := csrf
+	defer func() { csrf = token }()
+
+	csrf = ""
+	testPOSTError(t, "NewFolder", "path=/csrf", fasthttp.StatusForbidden, "invalid_csrf_token")
+	csrf = csrfToken("other session")
+	testPOSTError(t, "NewFolder", "path=/csrf", fasthttp.StatusForbidden, "invalid_csrf_token")
+
+	// Safe methods do not need the token
+	if res, _ := restRequest(t, "GET", "/api/v1/me", "", ""); res.StatusCode != 200 {
+		t.Errorf("Expected 200 without token, got %s", res.Status)
+	}
+}
+
 func TestNewFolder(t *testing.T) {
-	testPOST(t, "NewFolder", "path=/test/test", jsonkv("error", "Bad folder name"))
+	testPOSTError(t, "NewFolder", "path=/test/test", fasthttp.StatusBadRequest, "bad_folder_name")
 	testPOST(t, "NewFolder", "path=/test", jsonkv("success", "true"))
 	testPOST(t, "NewFolder", "path=/test/test", jsonkv("success", "true"))
-	testPOST(t, "NewFolder", "path=/test/test", jsonkv("error", "Folder already exists"))
+	testPOSTError(t, "NewFolder", "path=/test/test", fasthttp.StatusConflict, "folder_exists")
 }
 
 func TestUpload(t *testing.T) {
 	testUpload(t, "README.md", "/test", jsonkv("success", "true"))
 	// TODO: test multiple files upload
-	testUpload(t, "main.go", "/test/a/b", jsonkv("error", "Wrong path"))
+	testUploadError(t, "main.go", "/test/a/b", fasthttp.StatusNotFound, "folder_not_found")
 }
 
 func TestGetFile(t *testing.T) {
 	testDownload(t, "/test/README.md", "README.md")
 }
 
+func restRequest(t *testing.T, method, url, contentType, body string, headers ...string) (*http.Response, string) {
+	request, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+
+	authenticate(request)
+	res, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+
+	return res, string(b)
+}
+
+func TestRESTFiles(t *testing.T) {
+	res, body := restRequest(t, "GET", "/api/v1/files/test/README.md", "", "")
+
+	if res.StatusCode != 200 || fmt.Sprintf("%x", md5.Sum([]byte(body))) != hashFile("README.md") {
+		t.Errorf("Wrong download: %s", res.Status)
+	}
+
+	if res, _ := restRequest(t, "GET", "/api/v1/files/test/README.md", "", "", "If-None-Match", res.Header.Get("ETag")); res.StatusCode != fasthttp.StatusNotModified {
+		t.Errorf("Expected 304, got %s", res.Status)
+	}
+
+	if res, _ := restRequest(t, "PUT", "/api/v1/files/test/rest.txt", "text/plain", "hello"); res.StatusCode != fasthttp.StatusCreated {
+		t.Errorf("Expected 201, got %s", res.Status)
+	}
+
+	if res, _ := restRequest(t, "PUT", "/api/v1/files/test/rest.txt", "text/plain", "bye"); res.StatusCode != 200 {
+		t.Errorf("Expected 200, got %s", res.Status)
+	}
+
+	if _, body := restRequest(t, "GET", "/api/v1/files/test/rest.txt", "", ""); body != "bye" {
+		t.Errorf("File content was not replaced: %s", body)
+	}
+
+	if _, body := restRequest(t, "GET", "/api/v1/folders/test", "", ""); !strings.Contains(body, `"path":"/test"`) || strings.Contains(body, "rest.txt") {
+		t.Errorf("Wrong folder without children: %s", body)
+	}
+
+	if _, body := restRequest(t, "GET", "/api/v1/folders/test?children", "", ""); !strings.Contains(body, `"name":"rest.txt"`) {
+		t.Errorf("Wrong folder with children: %s", body)
+	}
+
+	// JSON bodies are accepted by the old endpoints as well
+	if _, body := restRequest(t, "POST", "/NewFolder", "application/json", `{"path":"/test/json"}`); body != jsonkv("success", "true") {
+		t.Errorf("JSON body was not accepted: %s", body)
+	}
+
+	if _, body := restRequest(t, "DELETE", "/api/v1/folders/test/json", "", ""); body != jsonkv("success", "true") {
+		t.Errorf("Folder was not removed: %s", body)
+	}
+
+	if _, body := restRequest(t, "DELETE", "/api/v1/files/test/rest.txt", "", ""); body != jsonkv("success", "true") {
+		t.Errorf("File was not removed: %s", body)
+	}
+
+	if res, _ := restRequest(t, "GET", "/api/v1/files/test/rest.txt", "", ""); res.StatusCode != fasthttp.StatusNotFound {
+		t.Errorf("Expected 404, got %s", res.Status)
+	}
+
+	if res, _ := restRequest(t, "POST", "/api/v1/files/test/rest.txt", "", ""); res.StatusCode != fasthttp.StatusMethodNotAllowed || res.Header.Get("Allow") == "" {
+		t.Errorf("Expected 405 with allowed methods, got %s", res.Status)
+	}
+}
+
 func TestUser(t *testing.T) {
 	testPOST(t, "NewUser", "email=test@miogo.tld&password=test", jsonkv("success", "true"))
 	testPOST(t, "NewUser", "email=test2@miogo.tld&password=test", jsonkv("success", "true"))
 	testPOST(t, "NewUser", "email=test3@miogo.tld&password=test", jsonkv("success", "true"))
 	testPOST(t, "RemoveUser", "email=test3@miogo.tld", jsonkv("success", "true"))
-	testPOST(t, "NewUser", "email=test@miogo.tld&password=1234", jsonkv("error", "User already exists"))
-	// TODO: List users
+	testPOSTError(t, "NewUser", "email=test@miogo.tld&password=1234", fasthttp.StatusConflict, "user_exists")
+	testPOSTError(t, "NewUser", "email=test4@miogo.tld", fasthttp.StatusBadRequest, "wrong_arguments")
+	testPOSTError(t, "NewUser", "email=test4@miogo.tld&password=test&source=oidc", fasthttp.StatusBadRequest, "wrong_arguments")
+	testPOSTError(t, "NewUser", "email=test4@miogo.tld&source=saml", fasthttp.StatusBadRequest, "wrong_arguments")
+
+	// Only admins manage accounts
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test@miogo.tld&password=test", jsonkv("success", "true"))
+	testPOSTError(t, "NewUser", "email=test4@miogo.tld&password=test", fasthttp.StatusForbidden, "access_denied")
+	testPOSTError(t, "RemoveUser", "email="+miogo.conf.AdminEmail, fasthttp.StatusForbidden, "access_denied")
+	session, csrf = admin, adminCSRF
+}
+
+func TestUserDirectory(t *testing.T) {
+	testPOSTContains(t, "Me", "", `"email":"`+miogo.conf.AdminEmail+`"`, `"is_admin":true`, `"last_login":`)
+	testPOSTContains(t, "GetUser", "email=test@miogo.tld", `"email":"test@miogo.tld"`, `"created":`)
+	testPOSTError(t, "GetUser", "email=random@miogo.tld", fasthttp.StatusNotFound, "user_not_found")
+
+	testPOST(t, "UpdateProfile", "display_name=Test&locale=fr_FR&avatar=https://miogo.tld/test.png", jsonkv("success", "true"))
+	testPOSTError(t, "UpdateProfile", "locale=<script>", fasthttp.StatusBadRequest, "bad_locale")
+	testPOSTError(t, "UpdateProfile", "avatar=javascript:alert(1)", fasthttp.StatusBadRequest, "bad_avatar")
+	testPOSTContains(t, "Me", "", `"display_name":"Test"`, `"locale":"fr_FR"`)
+
+	// JSON bodies of REST routes are arguments as well
+	if res, _ := restRequest(t, "PATCH", "/api/v1/me", "application/json", `{"locale":"en_GB"}`); res.StatusCode != 200 {
+		t.Errorf("Expected 200 updating the profile, got %s", res.Status)
+	}
+
+	testPOSTContains(t, "Me", "", `"locale":"en_GB"`)
+
+	testPOSTContains(t, "ListUsers", "search=TEST2", `"total":1`, `"email":"test2@miogo.tld"`)
+	testPOSTContains(t, "ListUsers", "per_page=1&page=2", `"page":2`, `"per_page":1`)
+
+	for _, service := range []string{"Me", "GetUser", "ListUsers"} {
+		request, _ := http.NewRequest("POST", "http://localhost:8080/"+service, strings.NewReader("email=test@miogo.tld"))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		authenticate(request)
+
+		if res, err := http.DefaultClient.Do(request); err == nil {
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if strings.Contains(string(b), "password") {
+				t.Errorf("%s exposes passwords", service)
+			}
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	admin, adminCSRF := session, csrf
+
+	testPOST(t, "Login", "email=test2@miogo.tld&password=test", jsonkv("success", "true"))
+	testPOSTError(t, "ChangePassword", "password=wrong&new_password=test1234", fasthttp.StatusUnauthorized, "wrong_password")
+	testPOST(t, "ChangePassword", "password=test&new_password=test1234", jsonkv("success", "true"))
+	testPOSTError(t, "Login", "email=test2@miogo.tld&password=test", fasthttp.StatusUnauthorized, "wrong_password")
+	testPOST(t, "Login", "email=test2@miogo.tld&password=test1234", jsonkv("success", "true"))
+
+	session, csrf = admin, adminCSRF
+}
+
+func TestPasswordReset(t *testing.T) {
+	f, err := newFakeSMTP()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	miogo.conf.Mail = f.Config()
+	defer func() { miogo.conf.Mail = nil }()
+
+	testPOST(t, "RequestPasswordReset", "email=nobody@miogo.tld", jsonkv("success", "true"))
+	testPOST(t, "RequestPasswordReset", "email=test2@miogo.tld", jsonkv("success", "true"))
+
+	msg, ok := f.Receive()
+
+	if !ok {
+		t.Fatal("Password reset mail has not been sent")
+	}
+
+	pos := strings.Index(msg, "token=")
+
+	if pos < 0 {
+		t.Fatal("Password reset mail does not contain a token")
+	}
+
+	token := strings.Fields(msg[pos+len("token="):])[0]
+
+	testPOSTError(t, "ResetPassword", "token=00"+token+"&password=reset", fasthttp.StatusBadRequest, "invalid_token")
+	testPOST(t, "ResetPassword", "token="+token+"&password=reset", jsonkv("success", "true"))
+	testPOSTError(t, "ResetPassword", "token="+token+"&password=again", fasthttp.StatusBadRequest, "invalid_token")
+
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test2@miogo.tld&password=reset", jsonkv("success", "true"))
+	session, csrf = admin, adminCSRF
+
+	// Mail failures do not tell that the user exists either
+	miogo.conf.Mail = &MailConfig{SMTPHost: "127.0.0.1", SMTPPort: 1, ResetURL: "http://localhost:8080/reset"}
+	testPOST(t, "RequestPasswordReset", "email=test@miogo.tld", jsonkv("success", "true"))
 }
 
 func TestGroup(t *testing.T) {
 	testPOST(t, "NewGroup", "name=miogo", jsonkv("success", "true"))
 	testPOST(t, "NewGroup", "name=test", jsonkv("success", "true"))
-	testPOST(t, "NewGroup", "name=miogo", jsonkv("error", "Group already exists"))
+	testPOSTError(t, "NewGroup", "name=miogo", fasthttp.StatusConflict, "group_exists")
 
 	testPOST(t, "AddUserToGroup", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
-	testPOST(t, "AddUserToGroup", "group=miogo&user=random@miogo.tld", jsonkv("error", "User does not exist"))
+	testPOSTError(t, "AddUserToGroup", "group=miogo&user=random@miogo.tld", fasthttp.StatusNotFound, "user_not_found")
 
 	testPOST(t, "RemoveUserFromGroup", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
-	testPOST(t, "RemoveUserFromGroup", "group=miogo&user=random@miogo.tld", jsonkv("error", "User does not exist"))
+	testPOSTError(t, "RemoveUserFromGroup", "group=miogo&user=random@miogo.tld", fasthttp.StatusNotFound, "user_not_found")
 
 	testPOST(t, "AddUserToGroup", "group=test&user=test@miogo.tld", jsonkv("success", "true"))
 	testPOST(t, "AddUserToGroup", "group=miogo&user=test@miogo.tld", jsonkv("success", "true"))
@@ -249,6 +551,38 @@ func TestGroup(t *testing.T) {
 	testPOST(t, "RemoveGroup", "name=test", jsonkv("success", "true"))
 }
 
+func TestGroupDirectory(t *testing.T) {
+	testPOSTContains(t, "ListGroups", "search=MIOG", `"total":1`, `"name":"miogo"`)
+	testPOSTContains(t, "GetGroup", "name=miogo", `"members":["test@miogo.tld"]`)
+	testPOSTError(t, "GetGroup", "name=random", fasthttp.StatusNotFound, "group_not_found")
+
+	testPOST(t, "SetGroupAdmin", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
+	testPOSTContains(t, "GetGroup", "name=miogo", `"admins":["test2@miogo.tld"]`)
+	testPOST(t, "RemoveGroupAdmin", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
+	testPOSTError(t, "RemoveGroupAdmin", "group=miogo&user=test2@miogo.tld", fasthttp.StatusConflict, "not_group_admin")
+
+	// Members and admins of a group are only managed by its admins
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test2@miogo.tld&password=reset", jsonkv("success", "true"))
+	user, userCSRF := session, csrf
+
+	testPOSTError(t, "SetGroupAdmin", "group=miogo&user=test2@miogo.tld", fasthttp.StatusForbidden, "access_denied")
+	testPOSTError(t, "AddUserToGroup", "group=miogo&user=test2@miogo.tld", fasthttp.StatusForbidden, "access_denied")
+	testPOSTError(t, "RemoveUserFromGroup", "group=miogo&user=test@miogo.tld", fasthttp.StatusForbidden, "access_denied")
+	testPOSTError(t, "RemoveGroup", "name=miogo", fasthttp.StatusForbidden, "access_denied")
+
+	session, csrf = admin, adminCSRF
+	testPOST(t, "SetGroupAdmin", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
+
+	session, csrf = user, userCSRF
+	testPOST(t, "AddUserToGroup", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
+	testPOST(t, "RemoveUserFromGroup", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
+	testPOST(t, "RemoveGroupAdmin", "group=miogo&user=test2@miogo.tld", jsonkv("success", "true"))
+	testPOSTError(t, "AddUserToGroup", "group=miogo&user=test2@miogo.tld", fasthttp.StatusForbidden, "access_denied")
+
+	session, csrf = admin, adminCSRF
+}
+
 func TestSetRights(t *testing.T) {
 	testPOST(t, "SetResourceRights", "resource=/&rights=rw&all=", jsonkv("success", "true"))
 	testPOST(t, "SetResourceRights", "resource=/&rights=rw&group=miogo", jsonkv("success", "true"))
@@ -259,17 +593,60 @@ func TestGetFolder(t *testing.T) {
 	testPOST(t, "GetFolder", "path=/", `{"path":"/","folders":[{"path":"/test"}],"rights":{"all":"rw","groups":[{"name":"miogo","rights":"rw"}]}}`)
 }
 
+func TestNestedGroups(t *testing.T) {
+	testPOST(t, "NewGroup", "name=department", jsonkv("success", "true"))
+	testPOST(t, "NewGroup", "name=company", jsonkv("success", "true"))
+
+	testPOST(t, "AddGroupToGroup", "subgroup=miogo&group=department", jsonkv("success", "true"))
+	testPOST(t, "AddGroupToGroup", "subgroup=department&group=company", jsonkv("success", "true"))
+	testPOSTError(t, "AddGroupToGroup", "subgroup=company&group=miogo", fasthttp.StatusConflict, "group_cycle")
+	testPOSTError(t, "AddGroupToGroup", "subgroup=miogo&group=miogo", fasthttp.StatusConflict, "group_cycle")
+	testPOSTContains(t, "GetGroup", "name=department", `"subgroups":["miogo"]`)
+
+	usr, _ := miogo.FetchUser("test@miogo.tld")
+	r := &Right{Groups: []EntityRight{{Name: "company", Rights: "rw"}}}
+
+	rightType := func() RightType {
+		u := *usr
+		u.Memberships = miogo.FetchMemberships(usr)
+		return GetRightType(&u, r)
+	}
+
+	if rightType() != AllowedToWrite {
+		t.Error("Rights are not inherited from nested groups")
+	}
+
+	testPOST(t, "RemoveGroupFromGroup", "subgroup=department&group=company", jsonkv("success", "true"))
+
+	if rightType() != Nothing {
+		t.Error("Memberships have not been invalidated")
+	}
+
+	testPOST(t, "RemoveGroup", "name=company", jsonkv("success", "true"))
+	testPOST(t, "RemoveGroup", "name=department", jsonkv("success", "true"))
+	testPOSTContains(t, "GetGroup", "name=miogo", `"name":"miogo","members"`)
+}
+
+func TestRenameGroup(t *testing.T) {
+	testPOSTError(t, "RenameGroup", "name=miogo&new_name=miogo", fasthttp.StatusConflict, "group_exists")
+	testPOST(t, "RenameGroup", "name=miogo&new_name=renamed", jsonkv("success", "true"))
+	testPOST(t, "GetFolder", "path=/", `{"path":"/","folders":[{"path":"/test"}],"rights":{"all":"rw","groups":[{"name":"renamed","rights":"rw"}]}}`)
+	testPOSTContains(t, "GetUser", "email=test@miogo.tld", `"groups":["renamed"]`)
+	testPOST(t, "RenameGroup", "name=renamed&new_name=miogo", jsonkv("success", "true"))
+}
+
 /*
 // TODO: the current logged-in user is now an admin and has the right to do everything, log in as a regular user and do these tests
 func TestRightsVerification(t *testing.T) {
-	testPOST(t, "GetFile", "path=/test/README.md", jsonkv("error", "Access denied"))
-	testPOST(t, "GetFolder", "path=/test", jsonkv("error", "Access denied"))
-	testUpload(t, "main.go", "/test", jsonkv("error", "Access denied"))
+	testPOSTError(t, "GetFile", "path=/test/README.md", fasthttp.StatusForbidden, "access_denied")
+	testPOSTError(t, "GetFolder", "path=/test", fasthttp.StatusForbidden, "access_denied")
+	testUploadError(t, "main.go", "/test", fasthttp.StatusForbidden, "access_denied")
 }*/
 
 func TestRemoveFile(t *testing.T) {
 	testUpload(t, "README.md", "/", jsonkv("success", "true"))
 	testPOST(t, "Remove", "path=/README.md", jsonkv("success", "true"))
+	testPOSTError(t, "Remove", "path=/missing.md", fasthttp.StatusNotFound, "resource_not_found")
 	// TODO:  add a test with GetFolder
 }
 
@@ -300,13 +677,256 @@ func TestCopyFolder(t *testing.T) {
 func TestMoveFile(t *testing.T) {
 	testPOST(t, "Move", "path=/README.md&destination=/&destFilename=READMEdeRACINE.md", jsonkv("success", "true"))
 	testPOST(t, "Move", "path=/READMEdeRACINE.md&destination=/&destFilename=fourni.md", jsonkv("success", "true"))
+	testPOSTError(t, "Move", "path=/missing.md&destination=/&destFilename=moved.md", fasthttp.StatusNotFound, "resource_not_found")
+	testPOSTError(t, "Copy", "path=/missing.md&destination=/&destFilename=copied.md", fasthttp.StatusNotFound, "resource_not_found")
+
+	// Nothing happened, nothing is recorded
+	if n, err := db.C(activityCollection).Find(bson.M{"items": "missing.md"}).Count(); n != 0 || err != nil {
+		t.Errorf("Activity recorded for a missing path: %d %v", n, err)
+	}
 }
 
 func TestMoveFolder(t *testing.T) {
 	testPOST(t, "Move", "path=/dossiercopie&destination=/&destFilename=dossierbouge", jsonkv("success", "true"))
 }
 
+func TestActivity(t *testing.T) {
+	testPOST(t, "NewFolder", "path=/activity", jsonkv("success", "true"))
+	testUpload(t, "README.md", "/activity", jsonkv("success", "true"))
+	testUpload(t, "main.go", "/activity", jsonkv("success", "true"))
+	testPOST(t, "SetResourceRights", "resource=/activity&rights=n&all=", jsonkv("success", "true"))
+
+	testPOSTContains(t, "GetActivity", "path=/", `"action":"move"`, `"READMEdeRACINE.md"`, `"destination":"/"`, `"items":["activity"]`)
+	testPOSTContains(t, "GetActivity", "path=/activity&limit=1", `"activities":[{"actor":"`+miogo.conf.AdminEmail+`","action":"upload","folder":"/activity","items":["main.go","README.md"]`, `"count":2}]`)
+	testPOSTContains(t, "GetActivity", "path=/&before=1", `"activities":[]`, `"truncated":false`)
+	testPOSTError(t, "GetActivity", "path=/missing", fasthttp.StatusNotFound, "folder_not_found")
+
+	// Users only see what they can read
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test2@miogo.tld&password=reset", jsonkv("success", "true"))
+
+	if res, body := restRequest(t, "GET", "/api/v1/activity/", "", ""); res.StatusCode != 200 || strings.Contains(body, "activity") {
+		t.Errorf("Unreadable activity listed: %s %s", res.Status, body)
+	}
+
+	session, csrf = admin, adminCSRF
+}
+
+func TestEvents(t *testing.T) {
+	if res, _ := restRequest(t, "GET", "/events?path=/missing", "", ""); res.StatusCode != fasthttp.StatusNotFound {
+		t.Errorf("Stream of a missing folder opened: %s", res.Status)
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost:8080/events?path=/activity", nil)
+	authenticate(request)
+	res, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Wrong content type %s", ct)
+	}
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+
+	// The reader stops with the test, the body being closed afterwards
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(res.Body)
+
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	testUpload(t, "utils.go", "/activity", jsonkv("success", "true"))
+	timeout := time.After(10 * time.Second)
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("Stream closed before the upload event")
+			}
+
+			if strings.HasPrefix(line, "data: ") {
+				if !strings.Contains(line, `"action":"upload"`) || !strings.Contains(line, `"items":["utils.go"]`) {
+					t.Errorf("Wrong event %s", line)
+				}
+
+				return
+			}
+		case <-timeout:
+			t.Fatal("No event received")
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer receiver.Close()
+
+	testPOSTError(t, "AddWebhook", "url=ftp://host&prefix=/inbox&secret=s", fasthttp.StatusBadRequest, "wrong_arguments")
+	testPOSTError(t, "AddWebhook", "url="+receiver.URL+"&prefix=/inbox&secret=s&events=rename", fasthttp.StatusBadRequest, "wrong_arguments")
+
+	_, body := restRequest(t, "POST", "/api/v1/webhooks", "application/x-www-form-urlencoded", "url="+receiver.URL+"&prefix=/inbox&events=upload&secret=s3cr3t")
+	var w Webhook
+
+	if err := json.Unmarshal([]byte(body), &w); err != nil || !w.Id.Valid() || strings.Contains(body, "s3cr3t") {
+		t.Fatalf("Wrong webhook %s", body)
+	}
+
+	testPOSTContains(t, "ListWebhooks", "", `"id":"`+w.Id.Hex()+`"`, `"events":["upload"]`)
+
+	// Only the upload to /inbox is sent
+	testPOST(t, "NewFolder", "path=/inbox", jsonkv("success", "true"))
+	testUpload(t, "utils.go", "/activity", jsonkv("success", "true"))
+	testUpload(t, "utils.go", "/inbox", jsonkv("success", "true"))
+
+	select {
+	case r := <-received:
+		b := <-bodies
+
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Miogo-Timestamp"), 10, 64)
+
+		if r.Header.Get("X-Miogo-Signature") != signPayload("s3cr3t", timestamp, b) || r.Header.Get("X-Miogo-Event") != "upload" {
+			t.Errorf("Wrong headers %v", r.Header)
+		}
+
+		if !strings.Contains(string(b), `"folder":"/inbox"`) || !strings.Contains(string(b), `"items":["utils.go"]`) {
+			t.Errorf("Wrong payload %s", b)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Webhook not called")
+	}
+
+	time.Sleep(time.Second)
+	testPOSTContains(t, "GetWebhookDeliveries", "webhook="+w.Id.Hex(), `"total":1`, `"status":"delivered"`, `"status":200`)
+
+	if res, _ := restRequest(t, "DELETE", "/api/v1/webhooks/"+w.Id.Hex(), "", ""); res.StatusCode != 200 {
+		t.Errorf("Webhook not removed: %s", res.Status)
+	}
+
+	testPOSTContains(t, "ListWebhooks", "", `"webhooks":[]`)
+	testPOSTError(t, "RemoveWebhook", "id="+w.Id.Hex(), fasthttp.StatusNotFound, "webhook_not_found")
+}
+
+func TestSearch(t *testing.T) {
+	testPOSTContains(t, "Search", "path=/inbox&name=UTIL", `"path":"/inbox/utils.go"`, `"ext":"go"`, `"uploader":"`+miogo.conf.AdminEmail+`"`, `"total":1`)
+	testPOSTContains(t, "Search", "glob=*.GO&contains=til", `"path":"/activity/utils.go"`, `"path":"/inbox/utils.go"`)
+	testPOSTContains(t, "Search", "name=utils&min_size=100000000", `"results":[]`, `"total":0`, `"truncated":false`)
+	testPOSTError(t, "Search", "glob=[a", fasthttp.StatusBadRequest, "wrong_arguments")
+	testPOSTError(t, "Search", "path=/missing", fasthttp.StatusNotFound, "folder_not_found")
+
+	testPOST(t, "SetTags", "path=/inbox/utils.go&tags=CI, Go", jsonkv("success", "true"))
+	testPOSTContains(t, "GetFolder", "path=/inbox", `"tags":["ci","go"]`)
+	testPOSTContains(t, "Search", "tags=ci", `"path":"/inbox/utils.go"`, `"tags":["ci","go"]`, `"total":1`)
+
+	// Copies keep their tags
+	testPOST(t, "Copy", "path=/inbox/utils.go&destination=/inbox&destFilename=copy.go", jsonkv("success", "true"))
+	testPOSTContains(t, "Search", "tags=go&path=/inbox", `"path":"/inbox/copy.go"`, `"total":2`)
+
+	// Users only find what they can read
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test2@miogo.tld&password=reset", jsonkv("success", "true"))
+
+	if res, body := restRequest(t, "GET", "/api/v1/search?name=utils", "", ""); res.StatusCode != 200 || strings.Contains(body, "/activity") {
+		t.Errorf("Unreadable file found: %s %s", res.Status, body)
+	}
+
+	session, csrf = admin, adminCSRF
+}
+
+func TestSearchContent(t *testing.T) {
+	testUpload(t, "README.md", "/inbox", jsonkv("success", "true"))
+	testPOSTError(t, "SearchContent", "query= ", fasthttp.StatusBadRequest, "wrong_arguments")
+
+	// Texts are extracted in the background
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		res, body := restRequest(t, "GET", "/api/v1/search/content?query=webhooks&path=/inbox", "", "")
+
+		if strings.Contains(body, `"path":"/inbox/README.md"`) {
+			if !strings.Contains(body, `\u003cmark\u003eWebhooks\u003c/mark\u003e`) || strings.Contains(body, "utils.go") {
+				t.Errorf("Wrong results %s", body)
+			}
+
+			break
+		}
+
+		if res.StatusCode != 200 || time.Now().After(deadline) {
+			t.Fatalf("Content not indexed: %s %s", res.Status, body)
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Users only find what they can read
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test2@miogo.tld&password=reset", jsonkv("success", "true"))
+
+	if res, body := restRequest(t, "GET", "/api/v1/search/content?query=webhooks", "", ""); res.StatusCode != 200 || strings.Contains(body, "/activity") {
+		t.Errorf("Unreadable file found: %s %s", res.Status, body)
+	}
+
+	session, csrf = admin, adminCSRF
+}
+
+func TestFileMetadata(t *testing.T) {
+	if res, _ := restRequest(t, "PUT", "/api/v1/files/inbox/meta.txt", "text/plain", "hello"); res.StatusCode != fasthttp.StatusCreated {
+		t.Fatalf("Expected 201, got %s", res.Status)
+	}
+
+	testPOSTContains(t, "GetFolder", "path=/inbox", `"name":"meta.txt","size":5,"mime_type":"text/plain; charset=utf-8","created":`, `"creator":"`+miogo.conf.AdminEmail+`"`)
+
+	// Moves keep the metadata, replacing the content only changes the size, type and modification
+	testPOST(t, "Move", "path=/inbox/meta.txt&destination=/inbox&destFilename=moved.txt", jsonkv("success", "true"))
+	testPOSTContains(t, "GetFolder", "path=/inbox", `"name":"moved.txt","size":5,"mime_type":"text/plain; charset=utf-8"`)
+
+	if res, _ := restRequest(t, "PUT", "/api/v1/files/inbox/moved.txt", "application/pdf", "%PDF-1.4\n"); res.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %s", res.Status)
+	}
+
+	if _, body := restRequest(t, "GET", "/api/v1/folders/inbox?children", "", ""); !strings.Contains(body, `"name":"moved.txt","size":9,"mime_type":"application/pdf"`) || !strings.Contains(body, `"modifier":"`+miogo.conf.AdminEmail+`"`) {
+		t.Errorf("Wrong metadata after replacement: %s", body)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	testPOSTContains(t, "GetAuditLog", "service=Login&outcome=wrong_password", `"actor":"`+miogo.conf.AdminEmail+`"`, `"status":401`)
+	testPOSTContains(t, "GetAuditLog", "service=NewFolder&path=/test&per_page=1", `"path":"/test`, `"outcome":"success"`, `"per_page":1`)
+	testPOSTContains(t, "GetAuditLog", "service=SetResourceRights", `"rights_after":`)
+	testPOSTContains(t, "GetAuditLog", "service=Upload", `"files":"`)
+	testPOSTContains(t, "GetAuditLog", "format=csv&service=Move", "time,actor,ip,service,path", ",Move,/README.md,destFilename=")
+	testPOSTError(t, "GetAuditLog", "format=xml", fasthttp.StatusBadRequest, "wrong_arguments")
+
+	admin, adminCSRF := session, csrf
+	testPOST(t, "Login", "email=test2@miogo.tld&password=reset", jsonkv("success", "true"))
+	testPOSTError(t, "GetAuditLog", "", fasthttp.StatusForbidden, "access_denied")
+	session, csrf = admin, adminCSRF
+}
+
 func TestLogout(t *testing.T) {
+	old, oldCSRF := session, csrf
 	testPOST(t, "Logout", "", jsonkv("success", "true"))
 
 	if session != "" {
@@ -315,4 +935,9 @@ func TestLogout(t *testing.T) {
 
 	testFailPOST(t, "Logout", "")
 	testFailPOST(t, "GetFolder", "path=/")
+
+	// The session is over on the server as well
+	session, csrf = old, oldCSRF
+	testPOSTError(t, "GetFolder", "path=/", fasthttp.StatusUnauthorized, "not_logged_in")
+	session, csrf = "", ""
 }
@@ -4,13 +4,17 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"errors"
+	"encoding/json"
 	"log"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/valyala/fasthttp"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"golang.org/x/crypto/bcrypt"
@@ -21,7 +25,7 @@ import (
  *   1. User's password is checked
  *   2. Session is created in DB
  *   3. Raw session is cached (unsecure but only in RAM)
- *   4. Cookie is set
+ *   4. Cookies are set, see csrf.go
  *
  * Access to a service requiring login:
  *   1. Cookie is fetched
@@ -31,15 +35,28 @@ import (
  */
 
 type User struct {
-	Id       bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Email    string        `bson:"email" json:"email"`
-	Password string        `bson:"password" json:"password"`
-	Groups   []string      `bson:"groups" json:"groups,omitempty"`
-	Session  struct {
+	Id          bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Email       string        `bson:"email" json:"email"`
+	Password    string        `bson:"password" json:"-"`
+	Groups      []string      `bson:"groups" json:"groups,omitempty"`
+	Memberships []string      `bson:"-" json:"memberships,omitempty"`
+	Source      string        `bson:"source,omitempty" json:"source,omitempty"`
+	DisplayName string        `bson:"display_name,omitempty" json:"display_name,omitempty"`
+	Locale      string        `bson:"locale,omitempty" json:"locale,omitempty"`
+	Avatar      string        `bson:"avatar,omitempty" json:"avatar,omitempty"`
+	Created     int64         `bson:"created,omitempty" json:"created,omitempty"`
+	LastLogin   int64         `bson:"last_login,omitempty" json:"last_login,omitempty"`
+	Session     struct {
 		Hash       string `bson:"hash"`
 		Expiration int64  `bson:"expire"`
 	} `bson:"session,omitempty" json:"-"`
+	Reset struct {
+		Hash       string `bson:"hash"`
+		Expiration int64  `bson:"expire"`
+	} `bson:"reset,omitempty" json:"-"`
 	IsAdmin *bool `bson:"is_admin,omitempty" json:"is_admin,omitempty"`
+	// Groups given by the external provider on the last login, the others were given in Miogo
+	ProviderGroups []string `bson:"provider_groups" json:"-"`
 }
 
 func hash(val []byte) string {
@@ -59,87 +76,206 @@ func (m *Miogo) newUserSession(usr *User, ctx *fasthttp.RequestCtx) {
 	raw := hex.EncodeToString(randBytes)
 
 	usr.Session.Hash = hash(randBytes)
-	usr.Session.Expiration = bson.Now().Add(m.sessionDuration).Unix()
+	usr.Session.Expiration = bson.Now().Add(m.SessionDuration()).Unix()
+	usr.LastLogin = time.Now().Unix()
 
-	db.C("users").Update(bson.M{"email": usr.Email}, usr)
+	// The rest of the document may be changed meanwhile, e.g. the groups synced by a provider
+	db.C("users").Update(bson.M{"email": usr.Email}, bson.M{"$set": bson.M{"session": usr.Session, "last_login": usr.LastLogin}})
 
 	m.sessionsCache.Set(raw, usr)
-
-	// The cookie will have a "session" duration on the client side (until the browser is closed)
-	cookie := fasthttp.AcquireCookie()
-	cookie.SetHTTPOnly(true)
-	cookie.SetKey("session")
-	cookie.SetValue(raw)
-	ctx.Response.Header.SetCookie(cookie)
-	fasthttp.ReleaseCookie(cookie)
+	m.setSessionCookies(ctx, raw)
 }
 
 func (m *Miogo) Login(ctx *fasthttp.RequestCtx, u *User) error {
-	if usr, ok := m.FetchUser(strings.TrimSpace(string(ctx.FormValue("email")))); ok {
-		if err := bcrypt.CompareHashAndPassword([]byte(usr.Password), []byte(ctx.FormValue("password"))); err == nil {
-			m.newUserSession(usr, ctx)
-			ctx.SetBodyString(jsonkv("success", "true"))
-			return nil
-		}
+	usr, err := m.authenticate(strings.TrimSpace(string(ctx.FormValue("email"))), string(ctx.FormValue("password")))
 
-		return errors.New("Wrong password")
+	if err != nil {
+		return err
 	}
 
-	return errors.New("User does not exist")
+	m.newUserSession(usr, ctx)
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
 }
 
 func (m *Miogo) Logout(ctx *fasthttp.RequestCtx, u *User) error {
 	raw := string(ctx.Request.Header.Cookie("session"))
+	val, _ := hex.DecodeString(raw)
 
-	if raw == u.Session.Hash {
+	// The session, and the CSRF token derived from it, must not be usable anymore
+	if hash(val) == u.Session.Hash {
 		m.sessionsCache.Invalidate(raw)
-		db.C("users").Update(bson.M{"session.hash": u.Session.Hash}, bson.M{"$unset": "session"})
+		db.C("users").Update(bson.M{"session.hash": u.Session.Hash}, bson.M{"$unset": bson.M{"session": ""}})
 	}
 
-	ctx.Response.Header.DelClientCookie("session")
+	m.clearSessionCookies(ctx)
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
 
 func (m *Miogo) NewUser(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
 	email := string(ctx.FormValue("email"))
-	hashedPassword, _ := bcrypt.GenerateFromPassword(ctx.FormValue("password"), bcrypt.DefaultCost)
+	password := string(ctx.FormValue("password"))
+	source := string(ctx.FormValue("source"))
 
 	if _, exists := m.FetchUser(email); exists {
-		return errors.New("User already exists")
+		return errUserExists
 	}
 
-	db.C("users").Insert(bson.M{"email": email, "password": string(hashedPassword)})
+	usr := bson.M{"email": email, "password": "", "created": time.Now().Unix()}
+
+	// Accounts of external providers have no local password, they log in through their provider
+	switch source {
+	case "":
+		if !hasArg(ctx, "password") {
+			return errWrongArgs.WithDetails("password", "Mandatory without source")
+		}
+
+		if err := m.conf.PasswordPolicy.Check(password); err != nil {
+			return err
+		}
+
+		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		usr["password"] = string(hashedPassword)
+	case "ldap", "oidc":
+		if password != "" {
+			return errWrongArgs.WithDetails("password", "Not allowed with a source")
+		}
+
+		usr["source"] = source
+		usr["groups"] = []string{}
+	default:
+		return errWrongArgs.WithDetails("source", "ldap or oidc expected")
+	}
+
+	db.C("users").Insert(usr)
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
 
 func (m *Miogo) RemoveUser(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
 	email := string(ctx.FormValue("email"))
 
 	if _, exists := m.FetchUser(email); !exists {
-		return errors.New("User does not exist")
+		return errUnknownUser
 	}
 
 	db.C("users").Remove(bson.M{"email": email})
 	m.usersCache.Invalidate(email)
+	m.invalidateMemberships(email)
+	m.invalidateUserSessions(email)
 
 	ctx.SetBodyString(jsonkv("success", "true"))
 	return nil
 }
 
+var errAccountConflict = NewError(fasthttp.StatusConflict, "account_conflict", "Account belongs to another login method")
+
+// provisionUser creates a user authenticated by an external provider or syncs its groups, nil groups being left as they are.
+// Accounts of another source, local ones included, are never taken over.
+func (m *Miogo) provisionUser(email, source string, groups []string) (*User, error) {
+	if _, err := db.C("users").Upsert(bson.M{"email": email}, bson.M{
+		"$setOnInsert": bson.M{"source": source, "groups": []string{}, "created": time.Now().Unix()},
+	}); err != nil {
+		log.Printf("Cannot provision user %s: %s\n", email, err)
+		return nil, errFailure
+	}
+
+	var usr User
+
+	if err := db.C("users").Find(bson.M{"email": email}).One(&usr); err != nil {
+		log.Printf("Cannot provision user %s: %s\n", email, err)
+		return nil, errFailure
+	}
+
+	if usr.Source != source {
+		log.Printf("Login of %s by %s refused, the account comes from another source\n", email, source)
+		return nil, errAccountConflict
+	}
+
+	if groups != nil {
+		if err := m.syncProviderGroups(&usr, groups); err != nil {
+			log.Printf("Cannot sync the groups of %s: %s\n", email, err)
+			return nil, errFailure
+		}
+	}
+
+	m.usersCache.Invalidate(email)
+	m.invalidateMemberships(email)
+
+	if usr, ok := m.FetchUser(email); ok {
+		return usr, nil
+	}
+
+	return nil, errUnknownUser
+}
+
+// syncProviderGroups replaces the groups previously given by the provider, keeping the ones given in Miogo
+func (m *Miogo) syncProviderGroups(usr *User, groups []string) error {
+	for _, group := range groups {
+		if err := db.C("groups").Insert(bson.M{"_id": group}); err != nil && !mgo.IsDup(err) {
+			log.Printf("Cannot create group %s: %s\n", group, err)
+		}
+	}
+
+	previous := usr.ProviderGroups
+
+	// Groups of users provisioned before the provider ones were recorded all come from the provider
+	if previous == nil {
+		previous = usr.Groups
+	}
+
+	var removed []string
+
+	for _, group := range previous {
+		if !contains(groups, group) {
+			removed = append(removed, group)
+		}
+	}
+
+	selector := bson.M{"email": usr.Email, "source": usr.Source}
+
+	if len(removed) > 0 {
+		if err := db.C("users").Update(selector, bson.M{"$pullAll": bson.M{"groups": removed}}); err != nil {
+			return err
+		}
+	}
+
+	return db.C("users").Update(selector, bson.M{
+		"$addToSet": bson.M{"groups": bson.M{"$each": groups}},
+		"$set":      bson.M{"provider_groups": groups},
+	})
+}
+
+// Sessions are cached by raw session value, the "user" matcher selects them by email
+func sessionsOfUser(email string, _ string, val interface{}) bool {
+	return val.(*User).Email == email
+}
+
+func (m *Miogo) invalidateUserSessions(email string) {
+	m.sessionsCache.InvalidateMatching("user", email)
+}
+
 func (m *Miogo) updateUserSession(usr *User, raw string) (*User, bool) {
 	if usr.Session.Expiration < time.Now().Unix() {
 		return nil, false
 	}
 
-	usr.Session.Expiration = time.Now().Add(m.sessionDuration).Unix()
+	usr.Session.Expiration = time.Now().Add(m.SessionDuration()).Unix()
 
 	// If time until session expiration is enough, don't annoy MongoDB
-	if time.Unix(usr.Session.Expiration, 0).Sub(time.Now()) < m.sessionDuration/4 {
-		db.C("users").Update(bson.M{"session.hash": usr.Session.Hash}, usr)
+	if time.Unix(usr.Session.Expiration, 0).Sub(time.Now()) < m.SessionDuration()/4 {
+		db.C("users").Update(bson.M{"session.hash": usr.Session.Hash}, bson.M{"$set": bson.M{"session.expire": usr.Session.Expiration}})
 	}
 
 	m.sessionsCache.Set(raw, usr)
@@ -166,21 +302,164 @@ func (m *Miogo) GetUserFromRequest(ctx *fasthttp.RequestCtx) (*User, bool) {
 	return nil, false
 }
 
+// sessionAlive tells whether the session is still valid, unlike GetUserFromRequest it does not extend it
+func (m *Miogo) sessionAlive(raw string) bool {
+	now := time.Now().Unix()
+
+	if val, ok := m.sessionsCache.Get(raw); ok {
+		return val.(*User).Session.Expiration >= now
+	}
+
+	val, _ := hex.DecodeString(raw)
+	count, err := db.C("users").Find(bson.M{"session.hash": hash(val), "session.expire": bson.M{"$gte": now}}).Count()
+
+	return count > 0 && err == nil
+}
+
 func (m *Miogo) FetchUser(email string) (*User, bool) {
-	if val, ok := m.usersCache.Get(email); ok {
-		return val.(*User), ok
+	val, _ := m.usersCache.GetOrLoad(email, func() (interface{}, error) {
+		query := db.C("users").Find(bson.M{"email": email})
+
+		if count, err := query.Count(); count > 0 && err == nil {
+			var user User
+			query.One(&user)
+
+			return &user, nil
+		}
+
+		return nil, nil
+	})
+
+	if val == nil {
+		return nil, false
 	}
 
-	query := db.C("users").Find(bson.M{"email": email})
+	return val.(*User), true
+}
 
-	if count, err := query.Count(); count > 0 && err == nil {
-		var user User
-		query.One(&user)
+func isAdmin(u *User) bool {
+	return u.IsAdmin != nil && *u.IsAdmin
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
 
-		m.usersCache.Set(email, &user)
+// pagination reads the "page" (starting at 1) and "per_page" arguments
+func pagination(ctx *fasthttp.RequestCtx) (page, perPage int) {
+	page, _ = strconv.Atoi(string(ctx.FormValue("page")))
+	perPage, _ = strconv.Atoi(string(ctx.FormValue("per_page")))
 
-		return &user, true
+	if page < 1 {
+		page = 1
 	}
 
-	return nil, false
+	if perPage < 1 {
+		perPage = defaultPageSize
+	} else if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+
+	return
+}
+
+func (m *Miogo) Me(ctx *fasthttp.RequestCtx, u *User) error {
+	res, _ := json.Marshal(u)
+	ctx.SetBody(res)
+	return nil
+}
+
+func (m *Miogo) GetUser(ctx *fasthttp.RequestCtx, u *User) error {
+	usr, exists := m.FetchUser(strings.TrimSpace(string(ctx.FormValue("email"))))
+
+	if !exists {
+		return errUnknownUser
+	}
+
+	res, _ := json.Marshal(usr)
+	ctx.SetBody(res)
+	return nil
+}
+
+func (m *Miogo) ListUsers(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
+	selector := bson.M{}
+
+	if search := strings.TrimSpace(string(ctx.FormValue("search"))); search != "" {
+		pattern := bson.RegEx{Pattern: regexp.QuoteMeta(search), Options: "i"}
+		selector["$or"] = []bson.M{{"email": pattern}, {"display_name": pattern}}
+	}
+
+	page, perPage := pagination(ctx)
+	query := db.C("users").Find(selector)
+	total, err := query.Count()
+
+	if err != nil {
+		return errFailure
+	}
+
+	users := []User{}
+	query.Sort("email").Skip((page - 1) * perPage).Limit(perPage).All(&users)
+
+	res, _ := json.Marshal(UserPage{users, total, page, perPage})
+
+	ctx.SetBody(res)
+	return nil
+}
+
+type UserPage struct {
+	Users   []User `json:"users"`
+	Total   int    `json:"total"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+}
+
+var localeFormat = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$`)
+
+func (m *Miogo) UpdateProfile(ctx *fasthttp.RequestCtx, u *User) error {
+	fields := bson.M{}
+
+	if hasArg(ctx, "display_name") {
+		name := strings.TrimSpace(string(ctx.FormValue("display_name")))
+
+		if len(name) > 256 {
+			return NewError(fasthttp.StatusBadRequest, "bad_display_name", "Display name is too long")
+		}
+
+		fields["display_name"] = name
+	}
+
+	if hasArg(ctx, "locale") {
+		locale := strings.TrimSpace(string(ctx.FormValue("locale")))
+
+		if locale != "" && !localeFormat.MatchString(locale) {
+			return NewError(fasthttp.StatusBadRequest, "bad_locale", "Bad locale")
+		}
+
+		fields["locale"] = locale
+	}
+
+	if hasArg(ctx, "avatar") {
+		avatar := strings.TrimSpace(string(ctx.FormValue("avatar")))
+
+		if avatar != "" {
+			if a, err := url.Parse(avatar); err != nil || (a.Scheme != "http" && a.Scheme != "https") || a.Host == "" {
+				return NewError(fasthttp.StatusBadRequest, "bad_avatar", "Bad avatar URL")
+			}
+		}
+
+		fields["avatar"] = avatar
+	}
+
+	db.C("users").Update(bson.M{"email": u.Email}, bson.M{"$set": fields})
+
+	m.usersCache.Invalidate(u.Email)
+	m.invalidateUserSessions(u.Email)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
 }
@@ -1,6 +1,9 @@
 package main
 
-import "strings"
+import (
+	"encoding/json"
+	"strings"
+)
 
 func formatD(res string) string {
 	res = strings.TrimRight(strings.TrimSpace(res), "/")
@@ -27,5 +30,8 @@ func formatF(res string) (dir string, file string) {
 }
 
 func jsonkv(key, value string) string {
-	return `{"` + key + `": "` + value + `"}`
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+
+	return `{` + string(k) + `: ` + string(v) + `}`
 }
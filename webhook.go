@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Outgoing webhooks:
+ *   1. Admins register a URL with the folder and the events it wants, see AddWebhook
+ *   2. recordActivity queues a delivery for each webhook matching the event, the webhooks being cached
+ *   3. Deliveries due are polled by every instance, see poller.go
+ *   4. Failed deliveries are retried with exponential back-off, every attempt is kept in the delivery log
+ */
+
+type WebhooksConfig struct {
+	// Seconds to wait for the receiver to answer
+	Timeout int `default:"10"`
+	// Deliveries are given up after this many attempts
+	MaxAttempts int `default:"8"`
+	// Seconds before the first retry, doubled for each following one
+	RetryDelay int `default:"10"`
+}
+
+const (
+	webhooksCollection   = "webhooks"
+	deliveriesCollection = "webhook_deliveries"
+	webhookPollInterval  = time.Second
+	// Retries are not delayed further
+	webhookMaxRetryDelay = time.Hour
+	// Key of the webhook list in webhooksCache
+	webhooksKey = "all"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	Id  bson.ObjectId `bson:"_id" json:"id"`
+	URL string        `bson:"url" json:"url"`
+	// Folder whose subtree is watched
+	Prefix string `bson:"prefix" json:"prefix"`
+	// Actions of the activity feed, all of them when empty
+	Events []string `bson:"events" json:"events"`
+	// Key of the HMAC signing the payloads
+	Secret  string `bson:"secret" json:"-"`
+	Creator string `bson:"creator" json:"creator"`
+	Created int64  `bson:"created" json:"created"`
+}
+
+// WebhookPayload is the body POSTed to receivers
+type WebhookPayload struct {
+	Delivery bson.ObjectId `json:"delivery"`
+	Webhook  bson.ObjectId `json:"webhook"`
+	Event    ActivityEvent `json:"event"`
+}
+
+type WebhookAttempt struct {
+	Time int64 `bson:"time" json:"time"`
+	// HTTP status of the answer, 0 when none was received
+	Status int    `bson:"status" json:"status"`
+	Error  string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id       bson.ObjectId    `bson:"_id" json:"id"`
+	Webhook  bson.ObjectId    `bson:"webhook" json:"webhook"`
+	Event    ActivityEvent    `bson:"event" json:"event"`
+	Status   string           `bson:"status" json:"status"`
+	Attempts []WebhookAttempt `bson:"attempts" json:"attempts"`
+	// Unix time of the next attempt, or of the end of the lease while it is being sent
+	Next int64 `bson:"next" json:"next,omitempty"`
+}
+
+func (w *Webhook) matches(e *ActivityEvent) bool {
+	return (len(w.Events) == 0 || contains(w.Events, e.Action)) && follows([]string{w.Prefix}, e)
+}
+
+// signPayload returns the X-Miogo-Signature header of the body sent at the X-Miogo-Timestamp time,
+// receivers rejecting old timestamps cannot be sent a delivery again
+func signPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is the back-off after the given number of failed attempts
+func (c *WebhooksConfig) retryDelay(attempts int) time.Duration {
+	delay := time.Duration(c.RetryDelay) * time.Second
+
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > webhookMaxRetryDelay {
+		return webhookMaxRetryDelay
+	}
+
+	return delay
+}
+
+func ensureWebhookIndexes() {
+	for _, key := range [][]string{{"status", "next"}, {"webhook", "-_id"}} {
+		if err := db.C(deliveriesCollection).EnsureIndex(mgo.Index{Key: key}); err != nil {
+			log.Printf("Cannot index the webhook deliveries: %s\n", err)
+		}
+	}
+}
+
+// cachedWebhooks returns every webhook, the list being read on each change of the files
+func (m *Miogo) cachedWebhooks() ([]Webhook, error) {
+	val, err := m.webhooksCache.GetOrLoad(webhooksKey, func() (interface{}, error) {
+		webhooks := []Webhook{}
+		err := db.C(webhooksCollection).Find(nil).All(&webhooks)
+
+		return webhooks, err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return val.([]Webhook), nil
+}
+
+// queueWebhooks adds a delivery for each webhook interested in the event
+func (m *Miogo) queueWebhooks(e *ActivityEvent) {
+	webhooks, err := m.cachedWebhooks()
+
+	if err != nil {
+		log.Printf("Cannot read the webhooks: %s\n", err)
+		return
+	}
+
+	for _, w := range webhooks {
+		if !w.matches(e) {
+			continue
+		}
+
+		d := WebhookDelivery{
+			Id:       bson.NewObjectId(),
+			Webhook:  w.Id,
+			Event:    *e,
+			Status:   DeliveryPending,
+			Attempts: []WebhookAttempt{},
+			Next:     e.Time,
+		}
+
+		if err := db.C(deliveriesCollection).Insert(&d); err != nil {
+			log.Printf("Cannot queue the %s event for webhook %s: %s\n", e.Action, w.Id.Hex(), err)
+		}
+	}
+}
+
+type webhookSender struct {
+	*poller
+	conf   *WebhooksConfig
+	client *fasthttp.Client
+}
+
+func newWebhookSender(conf *WebhooksConfig) *webhookSender {
+	s := &webhookSender{conf: conf, client: &fasthttp.Client{Name: "Miogo"}}
+	s.poller = startPoller(webhookPollInterval, s.sendNext)
+
+	return s
+}
+
+// sendNext leases a due delivery and sends it, it returns false when there is none
+func (s *webhookSender) sendNext() bool {
+	now := time.Now()
+	timeout := time.Duration(s.conf.Timeout) * time.Second
+
+	// Leased for twice the timeout, see poller.go
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"next": now.Add(2 * timeout).Unix()}},
+		ReturnNew: true,
+	}
+
+	var d WebhookDelivery
+	_, err := db.C(deliveriesCollection).Find(bson.M{"status": DeliveryPending, "next": bson.M{"$lte": now.Unix()}}).Sort("next").Apply(change, &d)
+
+	if err == mgo.ErrNotFound {
+		return false
+	} else if err != nil {
+		log.Printf("Cannot read the webhook deliveries: %s\n", err)
+		return false
+	}
+
+	var w Webhook
+	update := bson.M{}
+
+	if err := db.C(webhooksCollection).FindId(d.Webhook).One(&w); err != nil {
+		// Removed webhooks are not retried
+		update["status"] = DeliveryFailed
+		update["attempts"] = append(d.Attempts, WebhookAttempt{Time: now.Unix(), Error: "webhook removed"})
+	} else {
+		attempt := s.send(&w, &d, timeout)
+		d.Attempts = append(d.Attempts, attempt)
+		update["attempts"] = d.Attempts
+
+		switch {
+		case attempt.Status >= 200 && attempt.Status < 300:
+			update["status"] = DeliveryDelivered
+		case len(d.Attempts) >= s.conf.MaxAttempts:
+			update["status"] = DeliveryFailed
+		default:
+			update["next"] = now.Add(s.conf.retryDelay(len(d.Attempts))).Unix()
+		}
+	}
+
+	if err := db.C(deliveriesCollection).UpdateId(d.Id, bson.M{"$set": update}); err != nil {
+		log.Printf("Cannot update webhook delivery %s: %s\n", d.Id.Hex(), err)
+	}
+
+	return true
+}
+
+func (s *webhookSender) send(w *Webhook, d *WebhookDelivery, timeout time.Duration) WebhookAttempt {
+	attempt := WebhookAttempt{Time: time.Now().Unix()}
+	body, _ := json.Marshal(WebhookPayload{d.Id, w.Id, d.Event})
+
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(w.URL)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	req.Header.Set("X-Miogo-Event", d.Event.Action)
+	req.Header.Set("X-Miogo-Delivery", d.Id.Hex())
+	req.Header.Set("X-Miogo-Timestamp", strconv.FormatInt(attempt.Time, 10))
+	req.Header.Set("X-Miogo-Signature", signPayload(w.Secret, attempt.Time, body))
+	req.SetBody(body)
+
+	if err := s.client.DoTimeout(req, res, timeout); err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	attempt.Status = res.StatusCode()
+
+	if attempt.Status < 200 || attempt.Status >= 300 {
+		attempt.Error = fmt.Sprintf("Receiver answered %d", attempt.Status)
+	}
+
+	return attempt
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type WebhookList struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type DeliveryPage struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	Total      int               `json:"total"`
+	Page       int               `json:"page"`
+	PerPage    int               `json:"per_page"`
+}
+
+var webhookEvents = []string{ActivityUpload, ActivityUpdate, ActivityNewFolder, ActivityRemove, ActivityCopy, ActivityMove}
+
+var errWebhookNotFound = NewError(fasthttp.StatusNotFound, "webhook_not_found", "Webhook does not exist")
+
+func webhookId(ctx *fasthttp.RequestCtx, name string) (bson.ObjectId, error) {
+	id := strings.TrimSpace(string(ctx.FormValue(name)))
+
+	if !bson.IsObjectIdHex(id) {
+		return "", errWebhookNotFound
+	}
+
+	return bson.ObjectIdHex(id), nil
+}
+
+func (m *Miogo) AddWebhook(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
+	w := Webhook{
+		Id:      bson.NewObjectId(),
+		URL:     strings.TrimSpace(string(ctx.FormValue("url"))),
+		Prefix:  formatD(string(ctx.FormValue("prefix"))),
+		Events:  []string{},
+		Secret:  string(ctx.FormValue("secret")),
+		Creator: u.Email,
+		Created: time.Now().Unix(),
+	}
+
+	if parsed, err := url.Parse(w.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errWrongArgs.WithDetails("url", "HTTP or HTTPS URL expected")
+	}
+
+	if w.Secret == "" {
+		return errWrongArgs.WithDetails("secret", "Secret expected")
+	}
+
+	for _, e := range strings.Split(string(ctx.FormValue("events")), ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		} else if !contains(webhookEvents, e) {
+			return errWrongArgs.WithDetails("events", strings.Join(webhookEvents, ", ")+" expected")
+		}
+
+		w.Events = append(w.Events, e)
+	}
+
+	if err := db.C(webhooksCollection).Insert(&w); err != nil {
+		return errFailure
+	}
+
+	m.webhooksCache.Invalidate(webhooksKey)
+
+	res, _ := json.Marshal(w)
+
+	ctx.SetBody(res)
+	return nil
+}
+
+func (m *Miogo) ListWebhooks(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
+	webhooks := []Webhook{}
+
+	if err := db.C(webhooksCollection).Find(nil).Sort("_id").All(&webhooks); err != nil {
+		return errFailure
+	}
+
+	res, _ := json.Marshal(WebhookList{webhooks})
+
+	ctx.SetBody(res)
+	return nil
+}
+
+// RemoveWebhook keeps the delivery log, pending deliveries are given up
+func (m *Miogo) RemoveWebhook(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
+	id, err := webhookId(ctx, "id")
+
+	if err != nil {
+		return err
+	}
+
+	if err := db.C(webhooksCollection).RemoveId(id); err != nil {
+		return errWebhookNotFound
+	}
+
+	m.webhooksCache.Invalidate(webhooksKey)
+
+	ctx.SetBodyString(jsonkv("success", "true"))
+	return nil
+}
+
+// GetWebhookDeliveries lists the deliveries of a webhook, newest first, with all their attempts
+func (m *Miogo) GetWebhookDeliveries(ctx *fasthttp.RequestCtx, u *User) error {
+	if !isAdmin(u) {
+		return errAccessDenied
+	}
+
+	id, err := webhookId(ctx, "webhook")
+
+	if err != nil {
+		return err
+	}
+
+	selector := bson.M{"webhook": id}
+
+	switch status := string(ctx.FormValue("status")); status {
+	case "":
+	case DeliveryPending, DeliveryDelivered, DeliveryFailed:
+		selector["status"] = status
+	default:
+		return errWrongArgs.WithDetails("status", "pending, delivered or failed expected")
+	}
+
+	page, perPage := pagination(ctx)
+	query := db.C(deliveriesCollection).Find(selector).Sort("-_id")
+	total, err := query.Count()
+
+	if err != nil {
+		return errFailure
+	}
+
+	deliveries := []WebhookDelivery{}
+
+	if err := query.Skip((page - 1) * perPage).Limit(perPage).All(&deliveries); err != nil {
+		return errFailure
+	}
+
+	res, _ := json.Marshal(DeliveryPage{deliveries, total, page, perPage})
+
+	ctx.SetBody(res)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	// echo -n '1700000000.{"a":1}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=49f24e537407743fa4a0242bb63b94b9a47ee99cbbe071ccd8a22550ae411686"
+
+	if got := signPayload("secret", 1700000000, []byte(`{"a":1}`)); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	conf := &WebhooksConfig{RetryDelay: 10}
+
+	for attempts, expected := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		20: webhookMaxRetryDelay,
+	} {
+		if got := conf.retryDelay(attempts); got != expected {
+			t.Errorf("After %d attempts: expected %s, got %s", attempts, expected, got)
+		}
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	w := &Webhook{Prefix: "/inbox", Events: []string{ActivityUpload, ActivityMove}}
+
+	for _, test := range []struct {
+		e        ActivityEvent
+		expected bool
+	}{
+		{ActivityEvent{Action: ActivityUpload, Folder: "/inbox/ci"}, true},
+		{ActivityEvent{Action: ActivityMove, Folder: "/drafts", Destination: "/inbox"}, true},
+		{ActivityEvent{Action: ActivityRemove, Folder: "/inbox"}, false},
+		{ActivityEvent{Action: ActivityUpload, Folder: "/outbox"}, false},
+	} {
+		if got := w.matches(&test.e); got != test.expected {
+			t.Errorf("%+v: expected %v", test.e, test.expected)
+		}
+	}
+
+	w.Events = nil
+
+	if !w.matches(&ActivityEvent{Action: ActivityRemove, Folder: "/inbox"}) {
+		t.Error("Webhooks without events should match all of them")
+	}
+}